@@ -0,0 +1,258 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewCachingStore returns a CachingStore keeping up to size sessions of
+// inner for at most ttl.
+func NewCachingStore(inner Store, size int, ttl time.Duration) *CachingStore {
+	return &CachingStore{
+		Inner:      inner,
+		Serializer: GobSerializer{},
+		size:       size,
+		ttl:        ttl,
+		lru:        list.New(),
+		entries:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// CachingStore is a read-through cache in front of a server-side store,
+// e.g. a DatabaseStore, avoiding a backend read when the same session is
+// loaded again within a short time.
+//
+// Sessions are cached by name and ID in an in-process LRU, as serialized
+// values so requests never share them. Save and Delete invalidate the
+// cached session, and a load that raced with them isn't cached, so a
+// process never serves a session older than its own last Save. Other
+// processes writing to the same backend can be served stale sessions for
+// up to the TTL, so keep it short.
+//
+// Sessions without an ID, like those of CookieStore, are not cached.
+type CachingStore struct {
+	Inner Store
+	// Serializer copies the cached values. Values it can't serialize are
+	// not cached.
+	Serializer Serializer
+
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	// cookies maps the cookies seen to the session IDs they hold.
+	cookies map[cacheKey]string
+	// epoch counts invalidations, so loads started before one are not
+	// cached.
+	epoch uint64
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// cacheKey identifies a session, or a cookie, in a CachingStore.
+type cacheKey struct {
+	name  string
+	value string
+}
+
+// cacheEntry is a session cached by CachingStore.
+type cacheEntry struct {
+	key cacheKey
+	// cookies are the cookies mapped to the entry.
+	cookies []cacheKey
+	data    []byte
+	options Options
+	loaded  bool
+	expires time.Time
+	// encrypted holds the keys set with SetEncrypted, so they stay
+	// encrypted when the cached session is saved again.
+	encrypted map[string]bool
+	size      int
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *CachingStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns the cached session for the cookie sent with r, or the session
+// returned by the inner store, caching it.
+//
+// See CookieStore.New().
+func (s *CachingStore) New(r *http.Request, name string) (*Session, error) {
+	c, errCookie := r.Cookie(name)
+	if errCookie != nil {
+		return s.newInner(r, name)
+	}
+	cookie := cacheKey{name, c.Value}
+	if session := s.lookup(cookie); session != nil {
+		if b, ok := s.Inner.(backend); ok {
+			if err := session.checkFingerprint(r, b.config().fingerprint); err != nil {
+				return session, err
+			}
+		}
+		return session, nil
+	}
+
+	s.mu.Lock()
+	epoch := s.epoch
+	s.mu.Unlock()
+	session, err := s.newInner(r, name)
+	if err == nil && !session.IsNew && session.ID != "" {
+		s.add(cookie, session, epoch)
+	}
+	return session, err
+}
+
+// Save invalidates the cached session and saves it with the inner store.
+func (s *CachingStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	id := session.ID
+	defer s.invalidate(session.Name(), id)
+	err := s.Inner.Save(r, w, session)
+	if session.ID != id {
+		s.invalidate(session.Name(), session.ID)
+	}
+	return err
+}
+
+// Delete invalidates the cached session and deletes it with the inner
+// store.
+func (s *CachingStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	defer s.invalidate(session.Name(), session.ID)
+	return s.Inner.Delete(r, w, session)
+}
+
+// newInner returns a session of the inner store, owned by s.
+func (s *CachingStore) newInner(r *http.Request, name string) (*Session, error) {
+	session, err := s.Inner.New(r, name)
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+// lookup returns a copy of the session cached for a cookie, or nil.
+func (s *CachingStore) lookup(cookie cacheKey) *Session {
+	s.mu.Lock()
+	id, ok := s.cookies[cookie]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	elem, ok := s.entries[cacheKey{cookie.name, id}]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if clock(s.now).After(entry.expires) {
+		s.remove(elem)
+		s.mu.Unlock()
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	s.mu.Unlock()
+
+	session := NewSession(s, cookie.name)
+	if err := s.Serializer.Deserialize(entry.data, session); err != nil {
+		return nil
+	}
+	session.ID = id
+	session.Options = entry.options.Clone()
+	session.now = s.now
+	session.size = entry.size
+	for key := range entry.encrypted {
+		if session.encrypted == nil {
+			session.encrypted = make(map[string]bool, len(entry.encrypted))
+		}
+		session.encrypted[key] = true
+	}
+	if entry.loaded {
+		session.setLoaded(nil)
+	}
+	if session.expireAbsolute(clock(s.now)) != nil {
+		// Leave the error to the underlying store.
+		return nil
+	}
+	return session
+}
+
+// add caches session, unless the cache was invalidated since epoch.
+//
+// Sessions with fields that failed to decrypt are not cached, so every load
+// reports the errors.
+func (s *CachingStore) add(cookie cacheKey, session *Session, epoch uint64) {
+	if s.size <= 0 || len(session.fieldErrors) > 0 {
+		return
+	}
+	data, err := s.Serializer.Serialize(session)
+	if err != nil {
+		return
+	}
+	key := cacheKey{session.Name(), session.ID}
+	entry := &cacheEntry{
+		key:     key,
+		cookies: []cacheKey{cookie},
+		data:    data,
+		options: *session.Options,
+		loaded:  session.loaded != nil,
+		expires: clock(s.now).Add(s.ttl),
+		size:    session.size,
+	}
+	for key := range session.encrypted {
+		if entry.encrypted == nil {
+			entry.encrypted = make(map[string]bool, len(session.encrypted))
+		}
+		entry.encrypted[key] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.epoch != epoch {
+		return
+	}
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	for s.lru.Len() >= s.size {
+		s.remove(s.lru.Back())
+	}
+	if s.cookies == nil {
+		s.cookies = make(map[cacheKey]string)
+	}
+	s.cookies[cookie] = session.ID
+	s.entries[key] = s.lru.PushFront(entry)
+}
+
+// invalidate drops the session cached under name and id.
+func (s *CachingStore) invalidate(name, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch++
+	if elem, ok := s.entries[cacheKey{name, id}]; ok {
+		s.remove(elem)
+	}
+}
+
+// remove drops a cached entry and the cookies mapped to it. It must be
+// called with s.mu held.
+func (s *CachingStore) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, entry.key)
+	for _, cookie := range entry.cookies {
+		if s.cookies[cookie] == entry.key.value {
+			delete(s.cookies, cookie)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package sessions
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts the loads of a MemoryStore.
+type countingStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	loads int
+}
+
+func (s *countingStore) New(r *http.Request, name string) (*Session, error) {
+	s.mu.Lock()
+	s.loads++
+	s.mu.Unlock()
+	return s.MemoryStore.New(r, name)
+}
+
+func TestCachingStore(t *testing.T) {
+	inner := &countingStore{MemoryStore: NewMemoryStore()}
+	store := NewCachingStore(inner, 10, time.Minute)
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["count"] = 1
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	load := func() *Session {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		req.AddCookie(cookie)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		return session
+	}
+	first, second := load(), load()
+	if inner.loads != 2 {
+		t.Errorf("expected the second load to be cached, got %d inner loads", inner.loads)
+	}
+	if second.Values["count"] != 1 || second.IsNew || second.Store() != store {
+		t.Fatalf("bad cached session: %+v", second)
+	}
+
+	// Cached sessions don't share their values.
+	second.Values["count"] = 2
+	if load().Values["count"] != 1 {
+		t.Error("expected the cached values to be copied")
+	}
+
+	// A Save invalidates the cached session.
+	first.Values["count"] = 3
+	if err = first.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if got := load().Values["count"]; got != 3 {
+		t.Errorf("expected the saved value after a Save, got %v", got)
+	}
+
+	if err = store.Delete(req, httptest.NewRecorder(), first); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if !load().IsNew {
+		t.Error("expected a deleted session to be gone from the cache")
+	}
+}
+
+func TestCachingStoreExpiry(t *testing.T) {
+	inner := &countingStore{MemoryStore: NewMemoryStore()}
+	now := time.Now()
+	store := NewCachingStore(inner, 1, time.Minute)
+	store.now = func() time.Time { return now }
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.AddCookie(w.Result().Cookies()[0])
+	inner.loads = 0
+	for i := 0; i < 2; i++ {
+		if _, err := store.New(req, "hello"); err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		now = now.Add(time.Minute + time.Second)
+	}
+	if inner.loads != 2 {
+		t.Errorf("expected expired entries to be reloaded, got %d inner loads", inner.loads)
+	}
+}
+
+func TestCachingStoreConcurrent(t *testing.T) {
+	store := NewCachingStore(NewMemoryStore(), 4, time.Minute)
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			req.AddCookie(cookie)
+			session, err := store.New(req, "hello")
+			if err != nil {
+				t.Error("failed to load session", err)
+				return
+			}
+			session.Values["i"] = i
+			if err = session.Save(req, httptest.NewRecorder()); err != nil {
+				t.Error("failed to save session", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCachingStoreEncryptedFields(t *testing.T) {
+	inner := NewMemoryStore()
+	inner.Serializer = FieldEncryptionSerializer{
+		Codecs: CodecsFromPairs(nil, []byte("0123456789abcdef0123456789abcdef")),
+	}
+	store := NewCachingStore(inner, 10, time.Minute)
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	session.SetEncrypted("secret", "first-secret")
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	var cached *Session
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.AddCookie(cookie)
+		var err error
+		if cached, err = store.New(req, "hello"); err != nil {
+			t.Fatal("failed to load session", err)
+		}
+	}
+	if cached.Values["secret"] != "first-secret" {
+		t.Fatalf("expected the decrypted field, got %v", cached.Values)
+	}
+	cached.Set("secret", "second-secret")
+	if err := cached.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if data := inner.sessions[cached.ID].data; bytes.Contains(data, []byte("second-secret")) {
+		t.Errorf("expected the field of a cached session to stay encrypted, got %q", data)
+	}
+}
@@ -53,7 +53,9 @@ Note that in production code, we should check for errors when calling
 session.Save(r, w), and either display an error message or otherwise handle it.
 
 Save must be called before writing to the response, otherwise the session
-cookie will not be sent to the client.
+cookie will not be sent to the client. Wrapping handlers with
+sessions.Middleware takes care of this: it saves all sessions used during
+the request right before the response headers are written.
 
 Important Note: If you aren't using gorilla/mux, you need to wrap your handlers
 with context.ClearHandler as or else you will leak memory! An easy way to do this
@@ -122,6 +124,11 @@ it a pointer to a struct and a pointer to a custom type representing a
 map[string]interface. (We could have passed non-pointer values if we wished.) This will
 then allow us to serialise/deserialise values of those types to and from our sessions.
 
+Stores can use another encoding by setting their Serializer, e.g. to
+JSONSerializer. JSON only supports string keys, so with JSONSerializer every
+key in session.Values must be a plain string: saving a session with any other
+key, such as an int or a named string type, returns an error.
+
 Note that because session values are stored in a map[string]interface{}, there's
 a need to type-assert data when retrieving it. We'll use the Person struct we registered above:
 
@@ -0,0 +1,218 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// DynamoDBItem is a session record stored by DynamoDBStore.
+type DynamoDBItem struct {
+	ID   string
+	Data []byte
+	// ExpiresAt is the expiry in Unix seconds, meant for the attribute the
+	// table's TTL is configured on. It is 0 for sessions with a MaxAge of
+	// 0, which have no TTL attribute and only expire with the browser
+	// session.
+	ExpiresAt int64
+}
+
+// DynamoDBClient is the subset of DynamoDB operations used by
+// DynamoDBStore.
+//
+// It is usually a small adapter around the AWS SDK client mapping items
+// to PutItem, GetItem and DeleteItem calls, with the session ID as the
+// partition key and ExpiresAt as a numeric TTL attribute left out when 0.
+// GetItem must return a nil item and no error if there is no item for id.
+type DynamoDBClient interface {
+	PutItem(table string, item *DynamoDBItem) error
+	GetItem(table, id string) (*DynamoDBItem, error)
+	DeleteItem(table, id string) error
+}
+
+// DynamoDBContextClient is implemented by clients that accept a context,
+// like adapters of the AWS SDK, whose operations all take one.
+// DynamoDBStore then calls them with the context of the request, so a
+// canceled request interrupts the calls. Otherwise the context is only
+// checked before each call.
+type DynamoDBContextClient interface {
+	PutItemContext(ctx context.Context, table string, item *DynamoDBItem) error
+	GetItemContext(ctx context.Context, table, id string) (*DynamoDBItem, error)
+	DeleteItemContext(ctx context.Context, table, id string) error
+}
+
+// NewDynamoDBStore returns a new DynamoDBStore.
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewDynamoDBStore(client DynamoDBClient, tableName string,
+	keyPairs ...[]byte) *DynamoDBStore {
+	ds := &DynamoDBStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Serializer: GobSerializer{},
+		client:     client,
+		table:      tableName,
+	}
+
+	ds.MaxAge(ds.Options.MaxAge)
+	return ds
+}
+
+// DynamoDBStore stores sessions in a DynamoDB table.
+//
+// Only the session ID is sent to the client, in a signed cookie. Items
+// carry their expiry for the table's TTL, and since DynamoDB deletes
+// expired items lazily, New also ignores items past their expiry.
+//
+// Unlike other server-side stores, a session with a MaxAge of 0 and no
+// StoreTTL is kept without a TTL, for a browser-session cookie. A MaxAge < 0
+// deletes it.
+type DynamoDBStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // default configuration
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default the
+	// session is written to the table but its cookie is skipped when the
+	// client already has an identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer Observer
+	client   DynamoDBClient
+	table    string
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *DynamoDBStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// A session whose item is missing or expired results in a new session.
+//
+// See CookieStore.New().
+func (s *DynamoDBStore) New(r *http.Request, name string) (*Session, error) {
+	return newBackendSession(s, s, r, name)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0 then the item is deleted and
+// the cookie is expired.
+func (s *DynamoDBStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return saveBackendSession(r.Context(), s, w, session)
+}
+
+// Delete removes the item of the session and expires the session cookie.
+func (s *DynamoDBStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *DynamoDBStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// config returns the settings used by the backend helpers.
+func (s *DynamoDBStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
+	}
+}
+
+// keepsSessionCookies makes Save keep sessions with a MaxAge of 0.
+func (s *DynamoDBStore) keepsSessionCookies() {}
+
+// save puts the serialized session.Values with their expiry.
+func (s *DynamoDBStore) save(ctx context.Context, session *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.Serializer.Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	item := &DynamoDBItem{ID: session.ID, Data: data}
+	if ttl := session.Options.storeTTL(); ttl > 0 {
+		item.ExpiresAt = clock(s.now).Unix() + int64(ttl)
+	}
+	if c, ok := s.client.(DynamoDBContextClient); ok {
+		return unavailable(c.PutItemContext(ctx, s.table, item))
+	}
+	return unavailable(s.client.PutItem(s.table, item))
+}
+
+// load gets the item of the session and decodes it into session.Values.
+//
+// It returns false if the item is missing or expired.
+func (s *DynamoDBStore) load(ctx context.Context, session *Session) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var item *DynamoDBItem
+	var err error
+	if c, ok := s.client.(DynamoDBContextClient); ok {
+		item, err = c.GetItemContext(ctx, s.table, session.ID)
+	} else {
+		item, err = s.client.GetItem(s.table, session.ID)
+	}
+	if err != nil || item == nil {
+		return false, unavailable(err)
+	}
+	if item.ExpiresAt != 0 && item.ExpiresAt <= clock(s.now).Unix() {
+		return false, nil
+	}
+	session.size = len(item.Data)
+	return true, s.Serializer.Deserialize(item.Data, session)
+}
+
+// erase deletes the item of the session.
+func (s *DynamoDBStore) erase(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c, ok := s.client.(DynamoDBContextClient); ok {
+		return unavailable(c.DeleteItemContext(ctx, s.table, session.ID))
+	}
+	return unavailable(s.client.DeleteItem(s.table, session.ID))
+}
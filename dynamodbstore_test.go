@@ -0,0 +1,166 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamoDB is an in-memory DynamoDBClient.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]DynamoDBItem
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]DynamoDBItem)}
+}
+
+func (f *fakeDynamoDB) PutItem(table string, item *DynamoDBItem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[table+"/"+item.ID] = *item
+	return nil
+}
+
+func (f *fakeDynamoDB) GetItem(table, id string) (*DynamoDBItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[table+"/"+id]
+	if !ok {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(table, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, table+"/"+id)
+	return nil
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	client := newFakeDynamoDB()
+	store := NewDynamoDBStore(client, "sessions", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	item := client.items["sessions/"+session.ID]
+	if want := time.Now().Unix() + 86400*30; item.ExpiresAt < want-5 || item.ExpiresAt > want {
+		t.Errorf("bad expiry: got %d, want about %d", item.ExpiresAt, want)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved session, got %#v", loaded)
+	}
+
+	// Items past their expiry may linger until DynamoDB removes them.
+	item.ExpiresAt = time.Now().Unix() - 1
+	client.items["sessions/"+session.ID] = item
+	if loaded, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !loaded.IsNew {
+		t.Error("expected an expired item to yield a new session")
+	}
+}
+
+func TestDynamoDBStoreMaxAge(t *testing.T) {
+	client := newFakeDynamoDB()
+	store := NewDynamoDBStore(client, "sessions", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options.MaxAge = 0
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	item, ok := client.items["sessions/"+session.ID]
+	if !ok || item.ExpiresAt != 0 {
+		t.Fatalf("expected an item without expiry, got %v, %v", item, ok)
+	}
+
+	session.Options.MaxAge = -1
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(client.items) != 0 {
+		t.Errorf("expected the item to be deleted, got %v", client.items)
+	}
+}
+
+// contextDynamoDB is a fakeDynamoDB whose calls run with a context. Its
+// GetItemContext calls cancel and waits for the context.
+type contextDynamoDB struct {
+	*fakeDynamoDB
+	cancel context.CancelFunc
+}
+
+func (c *contextDynamoDB) PutItemContext(ctx context.Context, table string, item *DynamoDBItem) error {
+	return c.PutItem(table, item)
+}
+
+func (c *contextDynamoDB) GetItemContext(ctx context.Context, table, id string) (*DynamoDBItem, error) {
+	c.cancel()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *contextDynamoDB) DeleteItemContext(ctx context.Context, table, id string) error {
+	return c.DeleteItem(table, id)
+}
+
+func TestDynamoDBStoreContext(t *testing.T) {
+	client := &contextDynamoDB{fakeDynamoDB: newFakeDynamoDB()}
+	store := NewDynamoDBStore(client, "sessions", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.cancel = cancel
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !session.IsNew {
+		t.Errorf("expected a new session, got %#v", session)
+	}
+}
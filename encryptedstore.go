@@ -0,0 +1,231 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewEncryptedStore returns an EncryptedStore encrypting the sessions of
+// inner with the codecs of keyPairs.
+//
+// Every pair must have an encryption key, see NewCookieStore for a
+// description of the key pairs. Keys can be rotated by prepending a new
+// pair: data is decrypted by trying each pair in order.
+//
+// Inner can be any Store, and should no longer be used directly. Stores
+// with a Serializer can instead be given an EncryptionSerializer.
+func NewEncryptedStore(inner Store, keyPairs ...[]byte) (*EncryptedStore, error) {
+	if len(keyPairs) == 0 {
+		return nil, ErrNoKeys
+	}
+	for i := 0; i < len(keyPairs); i += 2 {
+		if i+1 >= len(keyPairs) || len(keyPairs[i+1]) == 0 {
+			return nil, errors.New("sessions: EncryptedStore requires an encryption key in every key pair")
+		}
+	}
+	codecs := CodecsFromPairs(keyPairs...)
+	// The data lives as long as the inner store keeps it, and the inner
+	// store limits its size.
+	setCodecsMaxAge(codecs, 0)
+	setCodecsMaxLength(codecs, 0)
+	return &EncryptedStore{
+		Inner:      inner,
+		Codecs:     codecs,
+		Serializer: GobSerializer{},
+	}, nil
+}
+
+// EncryptedStore keeps the sessions of another store encrypted: the
+// serialized values are encrypted and handed to the inner store as a single
+// value, so it only ever persists, or sends to the client, the ciphertext.
+//
+// Data that fails to decrypt, e.g. after its key was dropped, results in a
+// new session and an error wrapping ErrInvalidCookie.
+//
+// The creation time, expiry and fingerprint of the sessions are kept in the
+// encrypted values: the AbsoluteTimeout and SetExpiry of the session
+// Options, and the Fingerprint of the inner store, are enforced on the
+// decrypted session.
+//
+// It implements Enumerator, Purger and Toucher by delegating to the inner
+// store, and returns an error wrapping errors.ErrUnsupported if the inner
+// store doesn't implement them.
+type EncryptedStore struct {
+	Inner  Store
+	Codecs []securecookie.Codec
+	// Serializer encodes the session values before they are encrypted.
+	// When nil GobSerializer is used.
+	Serializer Serializer
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *EncryptedStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New loads and decrypts the session of the inner store, without adding it
+// to the registry.
+//
+// See CookieStore.New().
+func (s *EncryptedStore) New(r *http.Request, name string) (*Session, error) {
+	session, err := s.Inner.New(r, name)
+	if session == nil {
+		return nil, err
+	}
+	session.store = s
+	session.now = s.now
+	if err != nil {
+		return session, err
+	}
+	// The inner store adds the fingerprint of r, if it has a
+	// FingerprintFunc, which is compared with the decrypted one.
+	fingerprint, hasFingerprint := session.Values[fingerprintKey].(string)
+	if session.IsNew {
+		return session, nil
+	}
+	if err = s.decrypt(session); err != nil {
+		// Don't hand out the ciphertext.
+		session.ID = ""
+		session.IsNew = true
+		session.Values = make(map[interface{}]interface{})
+		return session, invalidCookie(err)
+	}
+	if err = session.expireAbsolute(clock(s.now)); err != nil || session.IsNew {
+		return session, err
+	}
+	if hasFingerprint {
+		return session, session.checkFingerprint(r, func(*http.Request) string {
+			return fingerprint
+		})
+	}
+	return session, nil
+}
+
+// Save encrypts the session and saves it with the inner store.
+func (s *EncryptedStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	// The inner store only sees the ciphertext, so the plaintext is stamped
+	// and its MaxAge set from its expiry here.
+	session.stampCreated(clock(s.now))
+	data, err := s.serializer().Serialize(session)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encodeCookie(encryptedDataName, data, s.Codecs)
+	if err != nil {
+		return fmt.Errorf("sessions: error encrypting session data -- %w", err)
+	}
+	// The inner store saves a copy, so the values of session are never
+	// replaced by the ciphertext.
+	sealed := *session
+	sealed.Values = map[interface{}]interface{}{encryptedDataName: encrypted}
+	err = s.Inner.Save(r, w, &sealed)
+	sealed.Values = session.Values
+	*session = sealed
+	return err
+}
+
+// Delete deletes the session with the inner store.
+func (s *EncryptedStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return s.Inner.Delete(r, w, session)
+}
+
+// List returns the unexpired sessions of the inner store. It implements
+// Enumerator.
+func (s *EncryptedStore) List(ctx context.Context) ([]SessionMeta, error) {
+	e, ok := s.Inner.(Enumerator)
+	if !ok {
+		return nil, s.unsupported("Enumerator")
+	}
+	return e.List(ctx)
+}
+
+// DeleteByID deletes the session stored under id by the inner store. It
+// implements Enumerator.
+func (s *EncryptedStore) DeleteByID(ctx context.Context, id string) error {
+	e, ok := s.Inner.(Enumerator)
+	if !ok {
+		return s.unsupported("Enumerator")
+	}
+	return e.DeleteByID(ctx, id)
+}
+
+// DeleteAll deletes all the sessions of the inner store. It implements
+// Purger.
+func (s *EncryptedStore) DeleteAll(ctx context.Context) error {
+	p, ok := s.Inner.(Purger)
+	if !ok {
+		return s.unsupported("Purger")
+	}
+	return p.DeleteAll(ctx)
+}
+
+// DeleteByUserID deletes the sessions of a user from the inner store. It
+// implements Purger.
+func (s *EncryptedStore) DeleteByUserID(ctx context.Context, userID string) error {
+	p, ok := s.Inner.(Purger)
+	if !ok {
+		return s.unsupported("Purger")
+	}
+	return p.DeleteByUserID(ctx, userID)
+}
+
+// Touch sets the lifetime of the session stored under id by the inner
+// store. It implements Toucher.
+func (s *EncryptedStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	t, ok := s.Inner.(Toucher)
+	if !ok {
+		return s.unsupported("Toucher")
+	}
+	return t.Touch(ctx, id, ttl)
+}
+
+// decrypt replaces the encrypted values of a session loaded by the inner
+// store by the decrypted ones. The reserved values the inner store adds
+// next to the ciphertext are dropped.
+func (s *EncryptedStore) decrypt(session *Session) error {
+	encrypted, ok := session.Values[encryptedDataName].(string)
+	for k := range session.Values {
+		switch k {
+		case encryptedDataName, createdKey, fingerprintKey:
+		default:
+			ok = false
+		}
+	}
+	if !ok {
+		return errors.New("sessions: the session data is not encrypted")
+	}
+	var data []byte
+	if err := securecookie.DecodeMulti(encryptedDataName, encrypted, &data, s.Codecs...); err != nil {
+		return fmt.Errorf("sessions: error decrypting session data -- %w", err)
+	}
+	session.Values = make(map[interface{}]interface{})
+	return s.serializer().Deserialize(data, session)
+}
+
+func (s *EncryptedStore) serializer() Serializer {
+	if s.Serializer == nil {
+		return GobSerializer{}
+	}
+	return s.Serializer
+}
+
+// unsupported returns the error of the optional interfaces the inner store
+// doesn't implement.
+func (s *EncryptedStore) unsupported(iface string) error {
+	return fmt.Errorf("sessions: %T doesn't implement %s: %w", s.Inner, iface, errors.ErrUnsupported)
+}
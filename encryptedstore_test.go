@@ -0,0 +1,235 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	store, err := NewEncryptedStore(inner, nil, key)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.Get(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["secret"] = "plaintext-value"
+	w := httptest.NewRecorder()
+	if err = Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	entry := inner.sessions[session.ID]
+	if len(entry.data) == 0 || bytes.Contains(entry.data, []byte("plaintext-value")) {
+		t.Fatalf("expected the stored data to be encrypted, got %q", entry.data)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if err != nil || session.IsNew || session.Values["secret"] != "plaintext-value" {
+		t.Fatalf("failed to decrypt session: %v %#v", err, session)
+	}
+	if session.store != store {
+		t.Error("expected the session to belong to the encrypted store")
+	}
+
+	// Data encrypted with a dropped key yields a new session.
+	store.Codecs = CodecsFromPairs(nil, []byte("fedcba9876543210fedcba9876543210"))
+	session, err = store.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie, got %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a new session, got %#v", session)
+	}
+}
+
+func TestEncryptedStoreInvalid(t *testing.T) {
+	if _, err := NewEncryptedStore(NewMemoryStore(), []byte("signing only")); err == nil {
+		t.Error("expected an error for key pairs without encryption keys")
+	}
+}
+
+func TestEncryptedStoreCookieStore(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	inner := NewCookieStore([]byte("signing only"))
+	store, err := NewEncryptedStore(inner, nil, key)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	// Wrapping twice encrypts twice.
+	store, err = NewEncryptedStore(store, nil, key)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["secret"] = "plaintext-value"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.Values["secret"] != "plaintext-value" || len(session.Values) != 1 {
+		t.Errorf("expected the session values to be kept, got %v", session.Values)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	plain, err := inner.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to decode the inner cookie", err)
+	}
+	for k, v := range plain.Values {
+		if k == "secret" || bytes.Contains([]byte(fmt.Sprint(v)), []byte("plaintext-value")) {
+			t.Errorf("expected the cookie to be encrypted, got %v", plain.Values)
+		}
+	}
+	session, err = store.New(req, "hello")
+	if err != nil || session.IsNew || session.Values["secret"] != "plaintext-value" {
+		t.Fatalf("failed to decrypt session: %v %#v", err, session)
+	}
+}
+
+func TestEncryptedStoreOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	redis := newFakeRedis()
+	store, err := NewEncryptedStore(NewRedisStore(redis.pool, "", []byte("some key")), nil, testEncKey)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err = store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatal("failed to delete the session of the inner store", err)
+	}
+	if len(redis.data) != 0 {
+		t.Errorf("expected the session to be deleted, got %v", redis.data)
+	}
+
+	store, err = NewEncryptedStore(NewCookieStore([]byte("some key")), nil, testEncKey)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	var _ Purger = store
+	if err = store.DeleteAll(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected errors.ErrUnsupported, got %v", err)
+	}
+}
+
+func TestEncryptedStoreInnerOptions(t *testing.T) {
+	inner := NewCookieStore([]byte("signing only"))
+	inner.Options.AbsoluteTimeout = 3600
+	inner.Fingerprint = func(r *http.Request) string { return r.UserAgent() }
+	store, err := NewEncryptedStore(inner, nil, testEncKey)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	now := time.Now()
+	inner.now = func() time.Time { return now }
+	store.now = inner.now
+	load := func(cookie, userAgent string) (*Session, error) {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		req.Header.Set("User-Agent", userAgent)
+		if cookie != "" {
+			req.Header.Add("Cookie", cookie)
+		}
+		return store.New(req, "hello")
+	}
+
+	session, err := load("", "agent")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["secret"] = "plaintext-value"
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Header().Get("Set-Cookie")
+
+	session, err = load(cookie, "agent")
+	if err != nil || session.IsNew || session.Values["secret"] != "plaintext-value" {
+		t.Fatalf("failed to decrypt session: %v %#v", err, session)
+	}
+	if _, ok := session.Created(); !ok {
+		t.Error("expected the decrypted session to have a creation time")
+	}
+
+	session, err = load(cookie, "other agent")
+	if err != ErrFingerprintMismatch {
+		t.Errorf("expected ErrFingerprintMismatch, got %v", err)
+	}
+	if !session.IsNew || session.Values["secret"] != nil {
+		t.Errorf("expected a new session, got %#v", session)
+	}
+
+	now = now.Add(2 * time.Hour)
+	session, err = load(cookie, "agent")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if !session.IsNew || session.Values["secret"] != nil {
+		t.Errorf("expected the session to outlive its AbsoluteTimeout, got %#v", session)
+	}
+}
+
+func TestEncryptedStoreSetExpiry(t *testing.T) {
+	inner := NewMemoryStore()
+	store, err := NewEncryptedStore(inner, nil, testEncKey)
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	now := time.Now()
+	inner.now = func() time.Time { return now }
+	store.now = inner.now
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["secret"] = "plaintext-value"
+	session.SetExpiry(now.Add(time.Hour))
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.Options.MaxAge != 3600 {
+		t.Errorf("expected a MaxAge of 3600, got %d", session.Options.MaxAge)
+	}
+
+	now = now.Add(30 * time.Minute)
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if err != nil || session.IsNew {
+		t.Fatalf("failed to decrypt session: %v %#v", err, session)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.Options.MaxAge != 1800 {
+		t.Errorf("expected a MaxAge of 1800, got %d", session.Options.MaxAge)
+	}
+}
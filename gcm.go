@@ -0,0 +1,196 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+var (
+	errGCMDecrypt   = errors.New("sessions: the value could not be decrypted or was tampered with")
+	errGCMTimestamp = errors.New("sessions: expired timestamp")
+	errGCMLength    = errors.New("sessions: the value is too long")
+	errLegacyCodec  = errors.New("sessions: the codec only decodes values of earlier versions")
+)
+
+// NewGCMCodec returns a codec encrypting values with AES-GCM.
+//
+// The key must be either 16, 24, or 32 bytes to select AES-128, AES-192, or
+// AES-256. An invalid key yields a codec that fails every call.
+func NewGCMCodec(key []byte) *GCMCodec {
+	c := &GCMCodec{
+		serializer: securecookie.GobEncoder{},
+		maxAge:     86400 * 30,
+		maxLength:  4096,
+	}
+	block, err := aes.NewCipher(key)
+	if err == nil {
+		c.aead, err = cipher.NewGCM(block)
+	}
+	if err != nil {
+		c.err = fmt.Errorf("sessions: invalid encryption key: %w", err)
+	}
+	return c
+}
+
+// GCMCodec is a securecookie.Codec using authenticated encryption.
+//
+// Each encoded value carries a fresh random nonce followed by the
+// ciphertext. The cookie name is bound as additional data and a timestamp
+// is encrypted along with the value, so values can't be moved between
+// cookies and expire like securecookie values do.
+type GCMCodec struct {
+	aead       cipher.AEAD
+	serializer securecookie.Serializer
+	maxAge     int64
+	maxLength  int
+	err        error
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// MaxAge restricts the maximum age, in seconds, of decoded values.
+// If age is 0 values don't expire.
+func (c *GCMCodec) MaxAge(age int) *GCMCodec {
+	c.maxAge = int64(age)
+	return c
+}
+
+// MaxLength restricts the maximum length, in bytes, of encoded values.
+// If l is 0 there is no limit.
+func (c *GCMCodec) MaxLength(l int) *GCMCodec {
+	c.maxLength = l
+	return c
+}
+
+// Encode serializes and encrypts value for the cookie called name.
+func (c *GCMCodec) Encode(name string, value interface{}) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	data, err := c.serializer.Serialize(value)
+	if err != nil {
+		return "", err
+	}
+	plain := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(plain, uint64(clock(c.now).Unix()))
+	plain = append(plain, data...)
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(
+		c.aead.Seal(nonce, nonce, plain, []byte(name)))
+	if c.maxLength > 0 && len(encoded) > c.maxLength {
+		return "", errGCMLength
+	}
+	return encoded, nil
+}
+
+// Decode authenticates and decrypts value into dst.
+//
+// A value that was tampered with, encrypted with another key or for
+// another cookie name fails to authenticate and dst is left untouched.
+func (c *GCMCodec) Decode(name, value string, dst interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.maxLength > 0 && len(value) > c.maxLength {
+		return errGCMLength
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return errGCMDecrypt
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil || len(plain) < 8 {
+		return errGCMDecrypt
+	}
+	t := int64(binary.BigEndian.Uint64(plain))
+	if c.maxAge != 0 && t < clock(c.now).Unix()-c.maxAge {
+		return errGCMTimestamp
+	}
+	return c.serializer.Deserialize(plain[8:], dst)
+}
+
+// CodecsFromPairs returns codecs for the given key pairs.
+//
+// The first key of a pair is used for authentication and the second for
+// encryption. Pairs with an encryption key get a GCMCodec, which
+// authenticates through AES-GCM and ignores the first key. Pairs without an
+// encryption key get a securecookie codec that only signs values.
+//
+// Values encrypted by the securecookie codecs of earlier versions can still
+// be read: the encrypting pairs are followed by securecookie codecs that
+// only decode, so such values are encrypted with AES-GCM on their next save.
+//
+// This is used by the constructors of the stores of this package.
+func CodecsFromPairs(keyPairs ...[]byte) []securecookie.Codec {
+	codecs := make([]securecookie.Codec, 0, (len(keyPairs)+1)/2)
+	var legacy []securecookie.Codec
+	for i := 0; i < len(keyPairs); i += 2 {
+		if i+1 < len(keyPairs) && keyPairs[i+1] != nil {
+			codecs = append(codecs, NewGCMCodec(keyPairs[i+1]))
+			legacy = append(legacy, legacyCodec{securecookie.New(keyPairs[i], keyPairs[i+1])})
+		} else {
+			codecs = append(codecs, securecookie.New(keyPairs[i], nil))
+		}
+	}
+	return append(codecs, legacy...)
+}
+
+// legacyCodec decodes values encrypted by a securecookie codec, but doesn't
+// encode any.
+type legacyCodec struct {
+	*securecookie.SecureCookie
+}
+
+// Encode always fails, values are encoded by the codecs preceding it.
+func (c legacyCodec) Encode(name string, value interface{}) (string, error) {
+	return "", errLegacyCodec
+}
+
+// setCodecsMaxAge sets the max age of the known codecs.
+func setCodecsMaxAge(codecs []securecookie.Codec, age int) {
+	for _, codec := range codecs {
+		switch c := codec.(type) {
+		case *securecookie.SecureCookie:
+			c.MaxAge(age)
+		case *GCMCodec:
+			c.MaxAge(age)
+		case legacyCodec:
+			c.MaxAge(age)
+		case *KeyProviderCodec:
+			c.MaxAge(age)
+		}
+	}
+}
+
+// setCodecsMaxLength sets the max length of the known codecs.
+func setCodecsMaxLength(codecs []securecookie.Codec, l int) {
+	for _, codec := range codecs {
+		switch c := codec.(type) {
+		case *securecookie.SecureCookie:
+			c.MaxLength(l)
+		case *GCMCodec:
+			c.MaxLength(l)
+		case legacyCodec:
+			c.MaxLength(l)
+		case *KeyProviderCodec:
+			c.MaxLength(l)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+var (
+	testHashKey = []byte("some key")
+	testEncKey  = []byte("0123456789abcdef0123456789abcdef")
+	testEncKey2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+// saveAndGetCookie saves a session with a value and returns its cookie.
+func saveAndGetCookie(t *testing.T, store Store) *http.Cookie {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+// loadFromCookie decodes the session sent with c.
+func loadFromCookie(store Store, c *http.Cookie) (*Session, error) {
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(c)
+	return store.New(req, "hello")
+}
+
+func TestGCMCodecRoundTrip(t *testing.T) {
+	store := NewCookieStore(testHashKey, testEncKey)
+	if _, ok := store.Codecs[0].(*GCMCodec); !ok {
+		t.Fatalf("expected a GCMCodec, got %T", store.Codecs[0])
+	}
+	c := saveAndGetCookie(t, store)
+	session, err := loadFromCookie(store, c)
+	if err != nil {
+		t.Fatal("failed to decode session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved session, got %v", session.Values)
+	}
+
+	// A fresh nonce is used on every save.
+	if other := saveAndGetCookie(t, store); other.Value == c.Value {
+		t.Error("expected distinct ciphertexts for identical values")
+	}
+}
+
+func TestGCMCodecMaxAge(t *testing.T) {
+	now := time.Now()
+	codec := NewGCMCodec(testEncKey).MaxAge(60)
+	codec.now = func() time.Time { return now }
+	encoded, err := codec.Encode("session", map[interface{}]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal("failed to encode", err)
+	}
+	var dst map[interface{}]interface{}
+	now = now.Add(59 * time.Second)
+	if err = codec.Decode("session", encoded, &dst); err != nil {
+		t.Fatal("failed to decode before MaxAge", err)
+	}
+	now = now.Add(2 * time.Second)
+	if err = codec.Decode("session", encoded, &dst); err == nil {
+		t.Error("expected an error decoding after MaxAge")
+	}
+}
+
+func TestGCMCodecTampered(t *testing.T) {
+	store := NewCookieStore(testHashKey, testEncKey)
+	c := saveAndGetCookie(t, store)
+
+	b := []byte(c.Value)
+	if i := len(b) / 2; b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+	c.Value = string(b)
+
+	session, err := loadFromCookie(store, c)
+	if err == nil {
+		t.Fatal("expected a tampered cookie to fail authentication")
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a fresh session, got IsNew=%v values=%v",
+			session.IsNew, session.Values)
+	}
+}
+
+func TestGCMCodecBindsName(t *testing.T) {
+	codec := NewGCMCodec(testEncKey)
+	encoded, err := codec.Encode("a", "value")
+	if err != nil {
+		t.Fatal("failed to encode", err)
+	}
+	var dst string
+	if err = codec.Decode("b", encoded, &dst); err == nil {
+		t.Error("expected a value encoded for another name to fail")
+	}
+	if err = codec.Decode("a", encoded, &dst); err != nil || dst != "value" {
+		t.Errorf("failed to decode: %q, %v", dst, err)
+	}
+}
+
+func TestGCMCodecInvalidKey(t *testing.T) {
+	if _, err := NewGCMCodec([]byte("short")).Encode("a", "value"); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
+
+func TestGCMKeyRotation(t *testing.T) {
+	c := saveAndGetCookie(t, NewCookieStore(testHashKey, testEncKey))
+
+	rotated := NewCookieStore(testHashKey, testEncKey2, testHashKey, testEncKey)
+	session, err := loadFromCookie(rotated, c)
+	if err != nil {
+		t.Fatal("failed to decode with an old key", err)
+	}
+	if session.Values["foo"] != "bar" {
+		t.Errorf("bad values after rotation: %v", session.Values)
+	}
+	if _, err = loadFromCookie(NewCookieStore(testHashKey, testEncKey2), c); err == nil {
+		t.Error("expected decoding with a different key to fail")
+	}
+}
+
+func TestGCMFilesystemTampered(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFilesystemStore(dir, testHashKey, testEncKey)
+	c := saveAndGetCookie(t, store)
+
+	files, err := filepath.Glob(filepath.Join(dir, "session_*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one session file, got %v, %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal("failed to read session file", err)
+	}
+	data[len(data)/2] ^= 1
+	if err = os.WriteFile(files[0], data, 0600); err != nil {
+		t.Fatal("failed to write session file", err)
+	}
+
+	session, err := loadFromCookie(store, c)
+	if err == nil {
+		t.Fatal("expected a tampered file to fail authentication")
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a fresh session, got IsNew=%v values=%v",
+			session.IsNew, session.Values)
+	}
+}
+
+func TestGCMLegacyFallback(t *testing.T) {
+	legacy := NewCookieStore()
+	legacy.Codecs = securecookie.CodecsFromPairs(testHashKey, testEncKey)
+	c := saveAndGetCookie(t, legacy)
+
+	store := NewCookieStore(testHashKey, testEncKey)
+	session, err := loadFromCookie(store, c)
+	if err != nil {
+		t.Fatal("failed to decode a legacy cookie", err)
+	}
+	if session.Values["foo"] != "bar" {
+		t.Errorf("bad values of a legacy cookie: %v", session.Values)
+	}
+
+	// The next save encrypts with AES-GCM.
+	c = saveAndGetCookie(t, store)
+	if _, err = loadFromCookie(legacy, c); err == nil {
+		t.Error("expected the cookie to be saved with AES-GCM")
+	}
+	if _, err = loadFromCookie(store, c); err != nil {
+		t.Error("failed to decode a cookie", err)
+	}
+}
+
+func TestGCMLegacyFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	legacy := NewFilesystemStore(dir)
+	legacy.Codecs = securecookie.CodecsFromPairs(testHashKey, testEncKey)
+	c := saveAndGetCookie(t, legacy)
+
+	session, err := loadFromCookie(NewFilesystemStore(dir, testHashKey, testEncKey), c)
+	if err != nil {
+		t.Fatal("failed to decode a legacy session file", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Errorf("bad legacy session: IsNew=%v values=%v", session.IsNew, session.Values)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errJWTFormat    = errors.New("sessions: malformed JWT")
+	errJWTAlgorithm = errors.New("sessions: unsupported JWT algorithm")
+	errJWTSignature = errors.New("sessions: invalid JWT signature")
+	errJWTDecrypt   = errors.New("sessions: the JWT could not be decrypted or was tampered with")
+	errJWTExpired   = errors.New("sessions: expired JWT")
+	errJWTIssued    = errors.New("sessions: JWT issued in the future")
+	errJWTAudience  = errors.New("sessions: JWT issued for another cookie")
+)
+
+// DefaultJWTClaim is the default JWTStore.Claim.
+const DefaultJWTClaim = "sess"
+
+// NewJWTStore returns a new JWTStore signing tokens with key.
+//
+// It is recommended to use a key with 32 or 64 bytes. Set EncryptionKey to
+// encrypt the tokens too. An empty key makes New and Save return
+// ErrNoKeys.
+func NewJWTStore(key []byte) *JWTStore {
+	return &JWTStore{
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Key: key,
+	}
+}
+
+// JWTStore stores sessions in cookies holding a JSON Web Token, for
+// services that already consume JWTs.
+//
+// Tokens are signed with HS256 (HMAC-SHA256), the only algorithm accepted
+// when decoding. With an EncryptionKey the signed token is nested in a JWE
+// using direct encryption ("dir") with AES-GCM, A128GCM, A192GCM or A256GCM
+// depending on the key size.
+//
+// The session values are kept under the Claim claim, encoded like the
+// JSONSerializer does, so their keys must be strings. The "exp" claim is
+// set from Options.MaxAge, "iat" from the creation time of sessions with
+// an AbsoluteTimeout, or the time of the save otherwise, and "aud" to the
+// cookie name. Decoding rejects tokens that expired, were issued further in
+// the future than Options.MaxClockSkew, or for another cookie.
+//
+// JSON and base64 make tokens much larger than the cookies of a
+// CookieStore, and encryption adds about a third on top: keep the values
+// small, Save fails with tokens longer than MaxCookieValueLength.
+type JWTStore struct {
+	Options *Options // default configuration
+	// Key signs the tokens.
+	Key []byte
+	// EncryptionKey encrypts the tokens when set. It must be 16, 24 or 32
+	// bytes long.
+	EncryptionKey []byte
+	// Claim is the claim holding the session values. When empty
+	// DefaultJWTClaim is used.
+	Claim string
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *JWTStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// It returns a new session and an error wrapping ErrInvalidCookie if the
+// token can't be verified or expired.
+func (s *JWTStore) New(r *http.Request, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.Options = s.Options.Clone()
+	session.now = s.now
+	session.IsNew = true
+	c, errCookie := r.Cookie(name)
+	if errCookie != nil {
+		return session, nil
+	}
+	if len(s.Key) == 0 {
+		return session, ErrNoKeys
+	}
+	err := checkCookieValue(name, c.Value)
+	if err == nil {
+		err = invalidCookie(s.decode(c.Value, session))
+	}
+	if err != nil {
+		// Don't hand out partially decoded values.
+		session.Values = make(map[interface{}]interface{})
+		return session, err
+	}
+	session.IsNew = false
+	session.size = len(c.Value)
+	return session, session.expireAbsolute(clock(s.now))
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0 the cookie is expired.
+func (s *JWTStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	if err := checkCookie(session.Name(), session.Options); err != nil {
+		return err
+	}
+	now := clock(s.now)
+	session.stampCreated(now)
+	if session.Options.MaxAge < 0 {
+		expireCookie(w, session)
+		return nil
+	}
+	if len(s.Key) == 0 {
+		return ErrNoKeys
+	}
+	token, err := s.encode(session, now)
+	if err != nil {
+		return err
+	}
+	if n := len(token); n > MaxCookieValueLength {
+		return fmt.Errorf("sessions: JWT of session %q is %d bytes, exceeding the maximum of %d",
+			session.Name(), n, MaxCookieValueLength)
+	}
+	session.renew = false
+	session.IsNew = false
+	session.size = len(token)
+	setCookie(w, session, token, now)
+	return nil
+}
+
+// Delete expires the session cookie on the client.
+func (s *JWTStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	expireCookie(w, session)
+	return nil
+}
+
+func (s *JWTStore) claim() string {
+	if s.Claim == "" {
+		return DefaultJWTClaim
+	}
+	return s.Claim
+}
+
+// encode returns the token of session.
+func (s *JWTStore) encode(session *Session, now time.Time) (string, error) {
+	iat := now
+	if created, ok := session.Created(); ok {
+		iat = created
+	}
+	// The creation time travels as iat.
+	values := *session
+	values.Values = make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		if k != createdKey {
+			values.Values[k] = v
+		}
+	}
+	data, err := JSONSerializer{}.Serialize(&values)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		s.claim(): json.RawMessage(data),
+		"iat":     iat.Unix(),
+		"aud":     session.Name(),
+	}
+	if session.Options.MaxAge > 0 {
+		claims["exp"] = now.Unix() + int64(session.Options.MaxAge)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtEncode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + jwtEncode(payload)
+	token := signed + "." + jwtEncode(s.sign(signed))
+	if s.EncryptionKey == nil {
+		return token, nil
+	}
+	return s.encrypt(token)
+}
+
+// decode verifies token and decodes its values into session.
+func (s *JWTStore) decode(token string, session *Session) error {
+	if s.EncryptionKey != nil {
+		var err error
+		if token, err = s.decrypt(token); err != nil {
+			return err
+		}
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errJWTFormat
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := jwtDecodeJSON(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "HS256" {
+		return errJWTAlgorithm
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.sign(parts[0]+"."+parts[1])) {
+		return errJWTSignature
+	}
+	var claims map[string]json.RawMessage
+	if err := jwtDecodeJSON(parts[1], &claims); err != nil {
+		return err
+	}
+	var exp, iat int64
+	if raw, ok := claims["exp"]; ok {
+		if err := json.Unmarshal(raw, &exp); err != nil {
+			return errJWTFormat
+		}
+	}
+	if err := json.Unmarshal(claims["iat"], &iat); err != nil {
+		return errJWTFormat
+	}
+	now := clock(s.now).Unix()
+	if exp != 0 && exp <= now {
+		return errJWTExpired
+	}
+	skew := int64(DefaultMaxClockSkew)
+	if session.Options.MaxClockSkew != 0 {
+		skew = int64(session.Options.MaxClockSkew)
+	}
+	if skew >= 0 && iat > now+skew {
+		return errJWTIssued
+	}
+	if !jwtAudience(claims["aud"], session.Name()) {
+		return errJWTAudience
+	}
+	if raw, ok := claims[s.claim()]; ok {
+		if err := (JSONSerializer{}).Deserialize(raw, session); err != nil {
+			return err
+		}
+	}
+	if session.Options.AbsoluteTimeout > 0 {
+		session.Values[createdKey] = iat
+	}
+	return nil
+}
+
+// jwtAudience reports whether the "aud" claim, a string or an array of
+// strings, holds name.
+func jwtAudience(raw json.RawMessage, name string) bool {
+	var aud string
+	if json.Unmarshal(raw, &aud) == nil {
+		return aud == name
+	}
+	var auds []string
+	if json.Unmarshal(raw, &auds) != nil {
+		return false
+	}
+	for _, aud := range auds {
+		if aud == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the HS256 signature of the signing input.
+func (s *JWTStore) sign(input string) []byte {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+// aead returns the AES-GCM cipher of EncryptionKey and its JWE name.
+func (s *JWTStore) aead() (cipher.AEAD, string, error) {
+	block, err := aes.NewCipher(s.EncryptionKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("sessions: invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+	return aead, fmt.Sprintf("A%dGCM", len(s.EncryptionKey)*8), nil
+}
+
+// encrypt nests the signed token in a JWE in compact serialization.
+func (s *JWTStore) encrypt(token string) (string, error) {
+	aead, enc, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	header := jwtEncode([]byte(`{"alg":"dir","enc":"` + enc + `","cty":"JWT"}`))
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, iv, []byte(token), []byte(header))
+	n := len(sealed) - aead.Overhead()
+	return header + ".." + jwtEncode(iv) + "." + jwtEncode(sealed[:n]) + "." +
+		jwtEncode(sealed[n:]), nil
+}
+
+// decrypt returns the signed token nested in a JWE.
+func (s *JWTStore) decrypt(token string) (string, error) {
+	aead, enc, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", errJWTFormat
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := jwtDecodeJSON(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "dir" || header.Enc != enc {
+		return "", errJWTAlgorithm
+	}
+	iv, errIV := base64.RawURLEncoding.DecodeString(parts[2])
+	ciphertext, errCiphertext := base64.RawURLEncoding.DecodeString(parts[3])
+	tag, errTag := base64.RawURLEncoding.DecodeString(parts[4])
+	if errIV != nil || errCiphertext != nil || errTag != nil || len(iv) != aead.NonceSize() {
+		return "", errJWTFormat
+	}
+	plain, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", errJWTDecrypt
+	}
+	return string(plain), nil
+}
+
+// jwtEncode returns the unpadded base64url encoding of b.
+func jwtEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwtDecodeJSON decodes a base64url encoded JSON JWT segment into v.
+func jwtDecodeJSON(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return errJWTFormat
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package sessions
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTStore(t *testing.T) {
+	for _, encryptionKey := range [][]byte{nil, []byte("0123456789abcdef0123456789abcdef")} {
+		store := NewJWTStore([]byte("some key"))
+		store.EncryptionKey = encryptionKey
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["user"] = "gopher"
+		w := httptest.NewRecorder()
+		if err = session.Save(req, w); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		token := w.Result().Cookies()[0].Value
+		if n := strings.Count(token, "."); encryptionKey == nil && n != 2 || encryptionKey != nil && n != 4 {
+			t.Fatalf("unexpected token format %q", token)
+		}
+		if encryptionKey == nil {
+			payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+			if !strings.Contains(string(payload), `"sess":{"user":"gopher"}`) ||
+				!strings.Contains(string(payload), `"exp":`) || !strings.Contains(string(payload), `"iat":`) {
+				t.Fatalf("unexpected claims %s", payload)
+			}
+		}
+
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+		session, err = store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to decode session", err)
+		}
+		if session.IsNew || session.Values["user"] != "gopher" {
+			t.Fatalf("expected the saved session, got %#v", session)
+		}
+
+		other := NewJWTStore([]byte("other key"))
+		other.EncryptionKey = encryptionKey
+		if _, err = other.New(req, "hello"); !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("expected ErrInvalidCookie with another key, got %v", err)
+		}
+	}
+}
+
+func TestJWTStoreExpired(t *testing.T) {
+	store := NewJWTStore([]byte("some key"))
+	store.Options.MaxAge = 60
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	session.Values["user"] = "gopher"
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err := store.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) || !errors.Is(err, errJWTExpired) {
+		t.Fatalf("expected an expired token error, got %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("expected a fresh session, got %#v", session)
+	}
+}
+
+func TestJWTStoreRejectsAlgNone(t *testing.T) {
+	store := NewJWTStore([]byte("some key"))
+	token := jwtEncode([]byte(`{"alg":"none"}`)) + "." +
+		jwtEncode([]byte(`{"sess":{"user":"admin"},"iat":1}`)) + "."
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "hello", Value: token})
+	if session, err := store.New(req, "hello"); !errors.Is(err, errJWTAlgorithm) || len(session.Values) != 0 {
+		t.Fatalf("expected the token to be rejected, got %v %v", err, session.Values)
+	}
+}
+
+func TestJWTStoreNoKey(t *testing.T) {
+	for _, key := range [][]byte{nil, {}} {
+		store := NewJWTStore(key)
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != ErrNoKeys {
+			t.Errorf("expected ErrNoKeys on Save, got %v", err)
+		}
+		req.AddCookie(&http.Cookie{Name: "hello", Value: "a.b.c"})
+		if _, err = store.New(req, "hello"); err != ErrNoKeys {
+			t.Errorf("expected ErrNoKeys on New, got %v", err)
+		}
+	}
+}
+
+func TestJWTStoreAudience(t *testing.T) {
+	store := NewJWTStore([]byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "admin")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["role"] = "admin"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The token of one cookie isn't accepted for another.
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "user", Value: w.Result().Cookies()[0].Value})
+	session, err = store.New(req, "user")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie for another cookie, got %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a new session, got %#v", session)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// KeyProvider supplies the keys of a store from an external secret manager,
+// e.g. AWS KMS or Vault, so they can be rotated without a redeploy.
+//
+// Both methods return the keys newest first: values are encoded with the
+// first keys and decoded with any of them, like the key pairs described in
+// NewCookieStore. The signing key at index i pairs with the encryption key
+// at the same index; EncryptionKeys may return fewer keys, or none, for
+// pairs that only sign.
+type KeyProvider interface {
+	SigningKeys() [][]byte
+	EncryptionKeys() [][]byte
+}
+
+// NewKeyProviderCodec returns a codec using the keys of p, for the Codecs
+// of any store:
+//
+//	store.Codecs = []securecookie.Codec{sessions.NewKeyProviderCodec(p, 5*time.Minute)}
+//
+// The keys are fetched when a value is first encoded or decoded, and again
+// once ttl elapsed, so the secret manager isn't called on every request.
+// Rotated keys are thus picked up within ttl. A ttl <= 0 fetches the keys
+// on every call.
+//
+// Like the codecs of CodecsFromPairs, it has a MaxAge of 30 days and a
+// MaxLength of 4096; the MaxAge method of stores updates it.
+func NewKeyProviderCodec(p KeyProvider, ttl time.Duration) *KeyProviderCodec {
+	return &KeyProviderCodec{
+		provider:  p,
+		ttl:       ttl,
+		maxAge:    86400 * 30,
+		maxLength: 4096,
+	}
+}
+
+// KeyProviderCodec is a securecookie.Codec encoding values with the keys of
+// a KeyProvider, see NewKeyProviderCodec.
+type KeyProviderCodec struct {
+	provider  KeyProvider
+	ttl       time.Duration
+	mu        sync.Mutex
+	codecs    []securecookie.Codec
+	fetched   time.Time
+	maxAge    int
+	maxLength int
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// MaxAge restricts the maximum age, in seconds, of decoded values. If age
+// is 0 values never expire.
+func (c *KeyProviderCodec) MaxAge(age int) *KeyProviderCodec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxAge = age
+	setCodecsMaxAge(c.codecs, age)
+	return c
+}
+
+// MaxLength restricts the maximum length, in bytes, of encoded values.
+// If l is 0 there is no limit.
+func (c *KeyProviderCodec) MaxLength(l int) *KeyProviderCodec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxLength = l
+	setCodecsMaxLength(c.codecs, l)
+	return c
+}
+
+// Encode encodes value with the newest keys of the provider.
+func (c *KeyProviderCodec) Encode(name string, value interface{}) (string, error) {
+	return encodeCookie(name, value, c.current())
+}
+
+// Decode decodes value by trying each of the keys of the provider in order.
+func (c *KeyProviderCodec) Decode(name, value string, dst interface{}) error {
+	codecs := c.current()
+	if len(codecs) == 0 {
+		return ErrNoKeys
+	}
+	return securecookie.DecodeMulti(name, value, dst, codecs...)
+}
+
+// current returns the codecs of the provider keys, fetching them again if
+// they are older than the ttl.
+func (c *KeyProviderCodec) current() []securecookie.Codec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clock(c.now)
+	if c.codecs != nil && c.ttl > 0 && now.Sub(c.fetched) < c.ttl {
+		return c.codecs
+	}
+	signing, encryption := c.provider.SigningKeys(), c.provider.EncryptionKeys()
+	pairs := make([][]byte, 0, 2*len(signing))
+	for i, key := range signing {
+		var encryptionKey []byte
+		if i < len(encryption) {
+			encryptionKey = encryption[i]
+		}
+		pairs = append(pairs, key, encryptionKey)
+	}
+	c.codecs = CodecsFromPairs(pairs...)
+	c.fetched = now
+	setCodecsMaxAge(c.codecs, c.maxAge)
+	setCodecsMaxLength(c.codecs, c.maxLength)
+	return c.codecs
+}
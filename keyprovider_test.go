@@ -0,0 +1,85 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKeyProvider serves keys that can be rotated, counting the fetches.
+type fakeKeyProvider struct {
+	mu         sync.Mutex
+	signing    [][]byte
+	encryption [][]byte
+	fetches    int
+}
+
+func (p *fakeKeyProvider) SigningKeys() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetches++
+	return p.signing
+}
+
+func (p *fakeKeyProvider) EncryptionKeys() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.encryption
+}
+
+func (p *fakeKeyProvider) rotate(signing, encryption []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signing = append([][]byte{signing}, p.signing...)
+	p.encryption = append([][]byte{encryption}, p.encryption...)
+}
+
+func TestKeyProviderCodec(t *testing.T) {
+	provider := &fakeKeyProvider{}
+	provider.rotate([]byte("old signing key"), []byte("0123456789abcdef"))
+	codec := NewKeyProviderCodec(provider, time.Minute)
+	now := time.Now()
+	codec.now = func() time.Time { return now }
+	store := NewCookieStore()
+	store.Codecs = append(store.Codecs, codec)
+
+	save := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["foo"] = "bar"
+		w := httptest.NewRecorder()
+		if err = session.Save(req, w); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+		return req
+	}
+	oldCookie := save()
+	save()
+	if provider.fetches != 1 {
+		t.Errorf("expected the keys to be cached, got %d fetches", provider.fetches)
+	}
+
+	provider.rotate([]byte("new signing key"), []byte("fedcba9876543210"))
+	now = now.Add(2 * time.Minute)
+	session, err := store.New(oldCookie, "hello")
+	if err != nil || session.Values["foo"] != "bar" {
+		t.Fatalf("failed to decode a cookie encoded with the old keys: %v", err)
+	}
+	if provider.fetches != 2 {
+		t.Errorf("expected the keys to be fetched again after the ttl, got %d fetches", provider.fetches)
+	}
+
+	// New cookies only need the new keys.
+	newCookie := save()
+	newOnly := NewCookieStore([]byte("new signing key"), []byte("fedcba9876543210"))
+	if session, err = newOnly.New(newCookie, "hello"); err != nil || session.Values["foo"] != "bar" {
+		t.Fatalf("failed to decode with the new keys: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// LogObserver is an Observer logging the errors of session loads and saves
+// to Logger, with the session name as the "session" attribute. Nothing is
+// logged when Logger is nil.
+//
+// Cookies that can't be used, because their signature doesn't match, they
+// can't be decoded or are too large, and fingerprint mismatches are logged
+// as warnings, since any client can send them. Other errors, like backend
+// failures, are logged as errors.
+//
+// Set it as the Observer of a store:
+//
+//	store.Observer = sessions.LogObserver{Logger: slog.Default()}
+type LogObserver struct {
+	Logger *slog.Logger
+}
+
+// Loaded logs e if it failed.
+func (o LogObserver) Loaded(e Event) {
+	if o.Logger == nil || e.Err == nil {
+		return
+	}
+	level := slog.LevelError
+	if errors.Is(e.Err, ErrInvalidCookie) || errors.Is(e.Err, ErrFingerprintMismatch) {
+		level = slog.LevelWarn
+	}
+	o.Logger.LogAttrs(context.Background(), level, "sessions: error loading session",
+		slog.String("session", e.Name), slog.Any("error", e.Err))
+}
+
+// Saved logs e if it failed.
+func (o LogObserver) Saved(e Event) {
+	if o.Logger == nil || e.Err == nil {
+		return
+	}
+	o.Logger.LogAttrs(context.Background(), slog.LevelError, "sessions: error saving session",
+		slog.String("session", e.Name), slog.Int("size", e.Size), slog.Any("error", e.Err))
+}
+
+// LogErrors returns an ErrorHandlerFunc logging the errors of Save to
+// logger, one record per error, for MiddlewareWithErrorHandler. The response
+// is left alone. Nothing is logged when logger is nil.
+func LogErrors(logger *slog.Logger) ErrorHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if logger == nil {
+			return
+		}
+		errs, ok := err.(MultiError)
+		if !ok {
+			errs = MultiError{err}
+		}
+		for _, err := range errs {
+			logger.LogAttrs(r.Context(), slog.LevelError, "sessions: error saving sessions",
+				slog.String("path", r.URL.Path), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package sessions
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogObserver(t *testing.T) {
+	var buf bytes.Buffer
+	store := NewCookieStore([]byte("some key"))
+	store.Observer = LogObserver{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing logged on success, got %q", buf.String())
+	}
+
+	req.AddCookie(&http.Cookie{Name: "hello", Value: "tampered"})
+	if _, err = store.New(req, "hello"); err == nil {
+		t.Fatal("expected an error for a tampered cookie")
+	}
+	if out := buf.String(); !strings.Contains(out, "level=WARN") || !strings.Contains(out, "session=hello") {
+		t.Errorf("expected a warning for the session, got %q", out)
+	}
+
+	buf.Reset()
+	session.Options.SameSite = http.SameSiteNoneMode
+	if err = session.Save(req, httptest.NewRecorder()); err == nil {
+		t.Fatal("expected an error saving an insecure SameSite=None cookie")
+	}
+	if out := buf.String(); !strings.Contains(out, "level=ERROR") || !strings.Contains(out, "session=hello") {
+		t.Errorf("expected an error for the session, got %q", out)
+	}
+
+	// The zero value logs nothing.
+	LogObserver{}.Loaded(Event{Name: "hello", Err: errors.New("boom")})
+}
+
+func TestLogErrors(t *testing.T) {
+	var buf bytes.Buffer
+	handler := LogErrors(slog.New(slog.NewTextHandler(&buf, nil)))
+	req, _ := http.NewRequest("GET", "http://www.example.com/login", nil)
+	handler(httptest.NewRecorder(), req, MultiError{errors.New("first"), errors.New("second")})
+	if out := buf.String(); strings.Count(out, "level=ERROR") != 2 || !strings.Contains(out, "path=/login") {
+		t.Errorf("expected one record per error, got %q", out)
+	}
+	LogErrors(nil)(httptest.NewRecorder(), req, errors.New("ignored"))
+}
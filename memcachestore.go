@@ -0,0 +1,211 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// memcacheMaxItemSize is the default maximum size of a memcached item.
+const memcacheMaxItemSize = 1 << 20
+
+// memcacheMaxRelativeExpiration is the largest expiration memcached treats
+// as relative; larger values are taken as Unix timestamps.
+const memcacheMaxRelativeExpiration = 60 * 60 * 24 * 30
+
+// MemcacheClient is the subset of a memcached client used by MemcachedStore.
+//
+// Get must return a nil value and no error on a cache miss, and Delete no
+// error, since deleting a missing session succeeds. A client from
+// github.com/bradfitz/gomemcache can be adapted with a small wrapper that
+// maps memcache.ErrCacheMiss to (nil, nil) in Get and to nil in Delete, and
+// builds a memcache.Item in Set.
+type MemcacheClient interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, expiration int32) error
+	Delete(key string) error
+}
+
+// MemcacheContextClient is implemented by clients that accept a context.
+// MemcachedStore then calls them with the context of the request, so a
+// canceled request interrupts the calls. Otherwise the context is only
+// checked before each call.
+type MemcacheContextClient interface {
+	GetContext(ctx context.Context, key string) ([]byte, error)
+	SetContext(ctx context.Context, key string, value []byte, expiration int32) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// NewMemcachedStore returns a new MemcachedStore.
+//
+// Sessions are stored under keyPrefix + session ID. If keyPrefix is empty
+// "session:" is used.
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewMemcachedStore(client MemcacheClient, keyPrefix string,
+	keyPairs ...[]byte) *MemcachedStore {
+	if keyPrefix == "" {
+		keyPrefix = "session:"
+	}
+	ms := &MemcachedStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Serializer: GobSerializer{},
+		client:     client,
+		keyPrefix:  keyPrefix,
+	}
+
+	ms.MaxAge(ms.Options.MaxAge)
+	return ms
+}
+
+// MemcachedStore stores sessions in memcached.
+//
+// Only the session ID is sent to the client, in a signed cookie. The
+// serialized session values are stored with an expiration matching
+// Options.MaxAge and must fit in a single item of at most 1MB.
+type MemcachedStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // default configuration
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default the
+	// session is written to memcached but its cookie is skipped when the
+	// client already has an identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer  Observer
+	client    MemcacheClient
+	keyPrefix string
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *MemcachedStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// A session ID missing from memcached, e.g. because it expired or was
+// evicted, results in a new session.
+//
+// See CookieStore.New().
+func (s *MemcachedStore) New(r *http.Request, name string) (*Session, error) {
+	return newBackendSession(s, s, r, name)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL,
+// then the session is deleted from memcached and the cookie is expired.
+func (s *MemcachedStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return saveBackendSession(r.Context(), s, w, session)
+}
+
+// Delete removes the session from memcached and expires the session cookie.
+func (s *MemcachedStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *MemcachedStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// config returns the settings used by the backend helpers.
+func (s *MemcachedStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
+	}
+}
+
+// save stores the serialized session.Values.
+func (s *MemcachedStore) save(ctx context.Context, session *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.Serializer.Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	key := s.keyPrefix + session.ID
+	if n := len(key) + len(data); n > memcacheMaxItemSize {
+		return fmt.Errorf("sessions: session %q is %d bytes, exceeding the memcached item limit of %d",
+			session.Name(), n, memcacheMaxItemSize)
+	}
+	expiration := int64(session.Options.storeTTL())
+	if expiration > memcacheMaxRelativeExpiration {
+		expiration += clock(s.now).Unix()
+	}
+	if c, ok := s.client.(MemcacheContextClient); ok {
+		return unavailable(c.SetContext(ctx, key, data, int32(expiration)))
+	}
+	return unavailable(s.client.Set(key, data, int32(expiration)))
+}
+
+// load decodes the session stored in memcached into session.Values.
+func (s *MemcachedStore) load(ctx context.Context, session *Session) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var data []byte
+	var err error
+	if c, ok := s.client.(MemcacheContextClient); ok {
+		data, err = c.GetContext(ctx, s.keyPrefix+session.ID)
+	} else {
+		data, err = s.client.Get(s.keyPrefix + session.ID)
+	}
+	if err != nil || data == nil {
+		return false, unavailable(err)
+	}
+	session.size = len(data)
+	return true, s.Serializer.Deserialize(data, session)
+}
+
+// erase deletes the session from memcached.
+func (s *MemcachedStore) erase(ctx context.Context, session *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c, ok := s.client.(MemcacheContextClient); ok {
+		return unavailable(c.DeleteContext(ctx, s.keyPrefix+session.ID))
+	}
+	return unavailable(s.client.Delete(s.keyPrefix + session.ID))
+}
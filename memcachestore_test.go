@@ -0,0 +1,174 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMemcache is an in-memory MemcacheClient.
+type fakeMemcache struct {
+	mu          sync.Mutex
+	items       map[string][]byte
+	expirations map[string]int32
+}
+
+func newFakeMemcache() *fakeMemcache {
+	return &fakeMemcache{items: make(map[string][]byte), expirations: make(map[string]int32)}
+}
+
+func (f *fakeMemcache) Get(key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items[key], nil
+}
+
+func (f *fakeMemcache) Set(key string, value []byte, expiration int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[key] = value
+	f.expirations[key] = expiration
+	return nil
+}
+
+func (f *fakeMemcache) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, key)
+	return nil
+}
+
+func TestMemcachedStore(t *testing.T) {
+	client := newFakeMemcache()
+	store := NewMemcachedStore(client, "app:", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	session.Options.MaxAge = 3600
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	key := "app:" + session.ID
+	if client.expirations[key] != 3600 {
+		t.Errorf("bad expiration: got %d, want 3600", client.expirations[key])
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved session, got %#v", loaded)
+	}
+
+	if err = store.Delete(req, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, ok := client.items[key]; ok {
+		t.Fatal("expected the item to be deleted")
+	}
+	if loaded, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !loaded.IsNew {
+		t.Error("expected a cache miss to yield a new session")
+	}
+}
+
+func TestMemcachedStoreItemLimit(t *testing.T) {
+	store := NewMemcachedStore(newFakeMemcache(), "", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["big"] = strings.Repeat("x", memcacheMaxItemSize)
+	err = session.Save(req, httptest.NewRecorder())
+	if err == nil || !strings.Contains(err.Error(), "memcached item limit") {
+		t.Fatalf("expected an item limit error, got %v", err)
+	}
+}
+
+func TestMemcachedStoreLongExpiration(t *testing.T) {
+	client := newFakeMemcache()
+	store := NewMemcachedStore(client, "", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options.MaxAge = 86400 * 60
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if exp := client.expirations["session:"+session.ID]; exp <= memcacheMaxRelativeExpiration {
+		t.Errorf("expected an absolute expiration, got %d", exp)
+	}
+}
+
+// contextMemcache is a fakeMemcache whose calls run with a context. Its
+// SetContext calls cancel and waits for the context.
+type contextMemcache struct {
+	*fakeMemcache
+	cancel context.CancelFunc
+}
+
+func (c *contextMemcache) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return c.Get(key)
+}
+
+func (c *contextMemcache) SetContext(ctx context.Context, key string, value []byte, expiration int32) error {
+	c.cancel()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *contextMemcache) DeleteContext(ctx context.Context, key string) error {
+	return c.Delete(key)
+}
+
+func TestMemcachedStoreContext(t *testing.T) {
+	client := &contextMemcache{fakeMemcache: newFakeMemcache()}
+	store := NewMemcachedStore(client, "", []byte("some key"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.cancel = cancel
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://www.example.com", nil)
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	err = session.Save(req, w)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(client.items) != 0 {
+		t.Fatalf("expected nothing stored, got %v", client.items)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("expected no cookie, got %q", c)
+	}
+}
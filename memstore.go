@@ -0,0 +1,225 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewMemoryStore returns a new MemoryStore.
+//
+// Without keyPairs the session IDs are signed with a random key, which is
+// lost with the sessions when the process exits. See NewCookieStore() for a
+// description of the parameters.
+func NewMemoryStore(keyPairs ...[]byte) *MemoryStore {
+	if len(keyPairs) == 0 {
+		keyPairs = [][]byte{securecookie.GenerateRandomKey(32)}
+	}
+	ms := &MemoryStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Serializer: GobSerializer{},
+		sessions:   make(map[string]memoryEntry),
+	}
+
+	ms.MaxAge(ms.Options.MaxAge)
+	return ms
+}
+
+// memorySweepInterval is how often Save removes expired sessions from a
+// MemoryStore.
+const memorySweepInterval = time.Minute
+
+// MemoryStore stores sessions in memory.
+//
+// It is meant for tests and single-process apps: sessions are lost when the
+// process exits. Only the session ID is sent to the client, in a signed
+// cookie. Expired sessions are removed when they are accessed, and by Save
+// at most once per minute; Cleanup removes them at once.
+//
+// It is safe for concurrent use.
+type MemoryStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // default configuration
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default the
+	// session is stored but its cookie is skipped when the client already
+	// has an identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer Observer
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	// swept is when expired sessions were last removed.
+	swept time.Time
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// memoryEntry is a session stored by MemoryStore.
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *MemoryStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// An unknown or expired session ID results in a new session.
+//
+// See CookieStore.New().
+func (s *MemoryStore) New(r *http.Request, name string) (*Session, error) {
+	return newBackendSession(s, s, r, name)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL,
+// then the session is removed from memory and the cookie is expired.
+func (s *MemoryStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return saveBackendSession(r.Context(), s, w, session)
+}
+
+// Prepare checks that the session can be saved, see TwoPhaseSaver. The
+// returned commit saves it like Save.
+func (s *MemoryStore) Prepare(r *http.Request, session *Session) (func(w http.ResponseWriter) error, error) {
+	if err := checkCookie(session.Name(), session.Options); err != nil {
+		return nil, err
+	}
+	if session.Options.MaxAge > 0 {
+		if _, err := s.Serializer.Serialize(session); err != nil {
+			return nil, err
+		}
+	}
+	return func(w http.ResponseWriter) error {
+		return s.Save(r, w, session)
+	}, nil
+}
+
+// Delete removes the session from memory and expires the session cookie.
+func (s *MemoryStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *MemoryStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// Reset removes all sessions from the store.
+func (s *MemoryStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]memoryEntry)
+}
+
+// Cleanup removes the expired sessions from memory.
+func (s *MemoryStore) Cleanup() {
+	now := clock(s.now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+}
+
+// sweep removes the sessions expired at now. s.mu must be held.
+func (s *MemoryStore) sweep(now time.Time) {
+	for id, entry := range s.sessions {
+		if entry.expires.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+	s.swept = now
+}
+
+// config returns the settings used by the backend helpers.
+func (s *MemoryStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
+	}
+}
+
+// save keeps the serialized session.Values in memory, and removes the
+// expired sessions if they weren't for memorySweepInterval.
+func (s *MemoryStore) save(ctx context.Context, session *Session) error {
+	data, err := s.Serializer.Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	now := clock(s.now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= memorySweepInterval {
+		s.sweep(now)
+	}
+	s.sessions[session.ID] = memoryEntry{
+		data:    data,
+		expires: now.Add(time.Duration(session.Options.storeTTL()) * time.Second),
+	}
+	return nil
+}
+
+// load decodes the stored session into session.Values.
+//
+// It returns false if there is no unexpired session stored for the ID.
+func (s *MemoryStore) load(ctx context.Context, session *Session) (bool, error) {
+	s.mu.Lock()
+	entry, ok := s.sessions[session.ID]
+	if ok && entry.expires.Before(clock(s.now)) {
+		delete(s.sessions, session.ID)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	session.size = len(entry.data)
+	return true, s.Serializer.Deserialize(entry.data, session)
+}
+
+// erase removes the session from memory.
+func (s *MemoryStore) erase(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.ID)
+	return nil
+}
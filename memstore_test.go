@@ -0,0 +1,215 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.ID != session.ID || loaded.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved session, got %#v", loaded)
+	}
+
+	// Sessions don't share their values.
+	loaded.Values["foo"] = "baz"
+	if again, _ := store.New(req, "hello"); again.Values["foo"] != "bar" {
+		t.Errorf("expected the stored value to be unaffected, got %v", again.Values["foo"])
+	}
+
+	store.Reset()
+	if loaded, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !loaded.IsNew || len(loaded.Values) != 0 {
+		t.Fatalf("expected a fresh session after Reset, got %#v", loaded)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	store.mu.Lock()
+	entry := store.sessions[session.ID]
+	entry.expires = time.Now().Add(-time.Second)
+	store.sessions[session.ID] = entry
+	store.mu.Unlock()
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !session.IsNew {
+		t.Fatal("expected the expired session to be discarded")
+	}
+	if len(store.sessions) != 0 {
+		t.Error("expected the expired session to be removed")
+	}
+}
+
+func TestMemoryStoreClock(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	store.Options.MaxAge = 60
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	if want := now.Add(60 * time.Second).Truncate(time.Second); !cookie.Expires.Equal(want) {
+		t.Errorf("expected the cookie to expire at %v, got %v", want, cookie.Expires)
+	}
+
+	load := func() *Session {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		req.AddCookie(cookie)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		return session
+	}
+	now = now.Add(59 * time.Second)
+	if load().IsNew {
+		t.Fatal("expected the session to be valid before MaxAge")
+	}
+	now = now.Add(2 * time.Second)
+	if !load().IsNew {
+		t.Fatal("expected the session to expire after MaxAge")
+	}
+}
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	store := NewMemoryStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			session, err := store.Get(req, "hello")
+			if err != nil {
+				t.Errorf("failed to get session: %v", err)
+				return
+			}
+			session.Values["foo"] = "bar"
+			if err = session.Save(req, httptest.NewRecorder()); err != nil {
+				t.Errorf("failed to save session: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(store.sessions) != 20 {
+		t.Errorf("expected 20 sessions, got %d", len(store.sessions))
+	}
+}
+
+func TestMemoryStoreSignedID(t *testing.T) {
+	store := NewMemoryStore([]byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if c := w.Result().Cookies()[0]; c.Value == session.ID {
+		t.Fatal("expected the cookie to hold a signed ID")
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "hello", Value: session.ID})
+	forged, err := store.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie for an unsigned ID, got %v", err)
+	}
+	if !forged.IsNew || forged.ID != "" {
+		t.Errorf("expected a new session for an unsigned ID, got %#v", forged)
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	save := func(maxAge int) {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Options.MaxAge = maxAge
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+	save(60)
+	save(3600)
+
+	now = now.Add(30 * time.Second)
+	save(60)
+	if len(store.sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %d", len(store.sessions))
+	}
+	now = now.Add(40 * time.Second)
+	store.Cleanup()
+	if len(store.sessions) != 2 {
+		t.Errorf("expected Cleanup to keep 2 sessions, got %d", len(store.sessions))
+	}
+
+	// Save sweeps at most once per memorySweepInterval.
+	now = now.Add(memorySweepInterval)
+	save(3600)
+	if len(store.sessions) != 2 {
+		t.Errorf("expected Save to sweep the expired session, got %d sessions", len(store.sessions))
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// ErrorHandlerFunc handles an error returned when saving sessions.
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// Middleware attaches a registry to each request and saves all its sessions
+// automatically.
+//
+// The sessions are saved right before the response headers are written,
+// i.e. on the first call to WriteHeader, Write, Flush or Hijack, or when the
+// handler returns without writing anything. Errors returned by Save are
+// ignored; use MiddlewareWithErrorHandler to handle them.
+func Middleware(next http.Handler) http.Handler {
+	return MiddlewareWithErrorHandler(next, nil)
+}
+
+// MiddlewareWithErrorHandler is like Middleware, but calls onError when
+// saving the sessions fails. The handler is called before the response
+// headers are written, so it can still change the response status. If it
+// writes a response, e.g. with http.Error, what the wrapped handler writes
+// afterwards is discarded.
+func MiddlewareWithErrorHandler(next http.Handler,
+	onError ErrorHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = ContextWithRegistry(r)
+		sw := &saveWriter{ResponseWriter: w, r: r, onError: onError}
+		next.ServeHTTP(wrapSaveWriter(sw), r)
+		sw.save()
+	})
+}
+
+// wrapSaveWriter returns sw with the optional interfaces of the underlying
+// writer: an http.Flusher, http.Hijacker or both. Other interfaces are
+// reached through Unwrap, e.g. by http.ResponseController.
+func wrapSaveWriter(sw *saveWriter) http.ResponseWriter {
+	_, flusher := sw.ResponseWriter.(http.Flusher)
+	_, hijacker := sw.ResponseWriter.(http.Hijacker)
+	switch {
+	case flusher && hijacker:
+		return flushHijackSaveWriter{sw}
+	case flusher:
+		return flushSaveWriter{sw}
+	case hijacker:
+		return hijackSaveWriter{sw}
+	}
+	return sw
+}
+
+// saveWriter saves the sessions of a request before the headers are sent.
+type saveWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	onError     ErrorHandlerFunc
+	saved       bool
+	wroteHeader bool
+	// discard drops the writes of the handler once onError responded.
+	discard bool
+}
+
+// headersWritten reports whether the response headers were sent.
+func (w *saveWriter) headersWritten() bool {
+	return w.wroteHeader
+}
+
+// save saves the registered sessions once.
+func (w *saveWriter) save() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+	if err := GetRegistry(w.r).Save(w.ResponseWriter); err != nil && w.onError != nil {
+		ew := &errorWriter{ResponseWriter: w.ResponseWriter}
+		w.onError(ew, w.r, err)
+		w.discard = ew.wrote
+	}
+}
+
+func (w *saveWriter) WriteHeader(code int) {
+	w.save()
+	w.wroteHeader = true
+	if w.discard {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *saveWriter) Write(b []byte) (int, error) {
+	w.save()
+	w.wroteHeader = true
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *saveWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flush saves the sessions and flushes the underlying http.Flusher.
+func (w *saveWriter) flush() {
+	w.save()
+	w.wroteHeader = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// hijack hands the connection over to the caller. The sessions are saved
+// first, though only a response written by the caller can send their
+// cookies, and nothing is saved when the handler returns.
+func (w *saveWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.save()
+	w.wroteHeader = true
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// flushSaveWriter is a saveWriter implementing http.Flusher.
+type flushSaveWriter struct{ *saveWriter }
+
+func (w flushSaveWriter) Flush() { w.flush() }
+
+// hijackSaveWriter is a saveWriter implementing http.Hijacker.
+type hijackSaveWriter struct{ *saveWriter }
+
+func (w hijackSaveWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+// flushHijackSaveWriter is a saveWriter implementing http.Flusher and
+// http.Hijacker.
+type flushHijackSaveWriter struct{ *saveWriter }
+
+func (w flushHijackSaveWriter) Flush() { w.flush() }
+
+func (w flushHijackSaveWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+// errorWriter records whether the error handler of a saveWriter wrote a
+// response.
+type errorWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *errorWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *errorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
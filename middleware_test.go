@@ -0,0 +1,303 @@
+package sessions
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// failingStore is a Store whose Save always fails.
+type failingStore struct {
+	testStore
+}
+
+func (s *failingStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+func (s *failingStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	return errors.New("save failed")
+}
+
+// requestStore is a CookieStore recording the request its sessions are
+// saved with.
+type requestStore struct {
+	*CookieStore
+	saved *http.Request
+}
+
+func (s *requestStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+func (s *requestStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	s.saved = r
+	return s.CookieStore.Save(r, w, session)
+}
+
+func TestMiddlewareReplacedRequest(t *testing.T) {
+	store := &requestStore{CookieStore: NewCookieStore([]byte("secret-key"))}
+	type key struct{}
+	var replaced *http.Request
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = ContextWithRegistry(r.WithContext(context.WithValue(r.Context(), key{}, "value")))
+		replaced = r
+		session, err := store.Get(r, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["foo"] = "bar"
+		io.WriteString(w, "hello")
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if store.saved == nil || store.saved != replaced {
+		t.Errorf("Expected the session to be saved with the replaced request; Got %v", store.saved)
+	}
+}
+
+func TestMiddlewareSavesBeforeWrite(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["foo"] = "bar"
+		io.WriteString(w, "hello")
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if rsp.Header().Get("Set-Cookie") == "" {
+		t.Fatal("Expected a Set-Cookie header")
+	}
+	if rsp.Body.String() != "hello" {
+		t.Errorf("Expected body %q; Got %q", "hello", rsp.Body.String())
+	}
+}
+
+func TestMiddlewareSavesWithoutWrite(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.Get(r, "session-key")
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if rsp.Header().Get("Set-Cookie") == "" {
+		t.Fatal("Expected a Set-Cookie header")
+	}
+}
+
+func TestMiddlewareErrorHandler(t *testing.T) {
+	store := &failingStore{}
+	var got error
+	handler := MiddlewareWithErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.Get(r, "session-key")
+		w.WriteHeader(http.StatusOK)
+	}), func(w http.ResponseWriter, r *http.Request, err error) {
+		got = err
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if got == nil {
+		t.Fatal("Expected the error handler to be called")
+	}
+	if rsp.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; Got %d", http.StatusInternalServerError, rsp.Code)
+	}
+}
+
+func TestMiddlewareSaveAfterWrite(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	var errSession, errRegistry error
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+		session, err := store.Get(r, "session-key")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		errSession = session.Save(r, w)
+		errRegistry = Save(r, w)
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if errSession != ErrHeadersWritten {
+		t.Errorf("Expected ErrHeadersWritten from Session.Save; Got %v", errSession)
+	}
+	if errRegistry != ErrHeadersWritten {
+		t.Errorf("Expected ErrHeadersWritten from Save; Got %v", errRegistry)
+	}
+	if c := rsp.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("Expected no Set-Cookie header; Got %q", c)
+	}
+}
+
+func TestMiddlewareVaryCookie(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	var useSession bool
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if useSession {
+			store.Get(r, "session-key")
+		}
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+	if vary := rsp.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+		t.Errorf("Expected Vary to be left alone without sessions; Got %q", vary)
+	}
+
+	useSession = true
+	rsp = httptest.NewRecorder()
+	handler.ServeHTTP(rsp, req)
+	if vary := rsp.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding, Cookie" {
+		t.Errorf("Expected Cookie merged into Vary; Got %q", vary)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	store.Get(req, "session-key")
+	rsp = httptest.NewRecorder()
+	rsp.Header().Set("Vary", "cookie")
+	GetRegistry(req).Save(rsp)
+	if vary := rsp.Header().Values("Vary"); len(vary) != 1 || vary[0] != "cookie" {
+		t.Errorf("Expected no duplicate Vary value; Got %q", vary)
+	}
+
+	VaryCookie = false
+	defer func() { VaryCookie = true }()
+	rsp = httptest.NewRecorder()
+	GetRegistry(req).Save(rsp)
+	if vary := rsp.Header().Get("Vary"); vary != "" {
+		t.Errorf("Expected no Vary header when disabled; Got %q", vary)
+	}
+}
+
+func TestMiddlewareErrorHandlerResponse(t *testing.T) {
+	store := &failingStore{}
+	handler := MiddlewareWithErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.Get(r, "session-key")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "hello")
+	}), func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, "failed", http.StatusInternalServerError)
+	})
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if rsp.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; Got %d", http.StatusInternalServerError, rsp.Code)
+	}
+	if body := rsp.Body.String(); body != "failed\n" {
+		t.Errorf("Expected body %q; Got %q", "failed\n", body)
+	}
+}
+
+// plainWriter is an http.ResponseWriter without optional interfaces.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func (w plainWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// hijackRecorder is a ResponseRecorder implementing http.Hijacker.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestMiddlewareOptionalInterfaces(t *testing.T) {
+	var flusher, hijacker bool
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+	}))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	handler.ServeHTTP(plainWriter{httptest.NewRecorder()}, req)
+	if flusher || hijacker {
+		t.Errorf("Expected no Flusher or Hijacker; Got %v, %v", flusher, hijacker)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !flusher || hijacker {
+		t.Errorf("Expected a Flusher only; Got %v, %v", flusher, hijacker)
+	}
+
+	handler.ServeHTTP(&hijackRecorder{ResponseRecorder: httptest.NewRecorder()}, req)
+	if !flusher || !hijacker {
+		t.Errorf("Expected a Flusher and Hijacker; Got %v, %v", flusher, hijacker)
+	}
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	var errSave error
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "session-key")
+		session.Values["a"] = 1
+		if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+			t.Fatalf("Error hijacking: %v", err)
+		}
+		errSave = session.Save(r, w)
+	}))
+
+	rsp := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(rsp, req)
+
+	if !rsp.hijacked {
+		t.Error("Expected the underlying writer to be hijacked")
+	}
+	if errSave != ErrHeadersWritten {
+		t.Errorf("Expected %v; Got %v", ErrHeadersWritten, errSave)
+	}
+}
+
+func TestMiddlewareResponseController(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Error flushing: %v", err)
+		}
+	}))
+
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(plainWriter{rsp}, req)
+
+	if !rsp.Flushed {
+		t.Error("Expected the response to be flushed")
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MsgpackSerializer encodes session values as MessagePack, a compact binary
+// format with implementations in most languages. Unlike JSONSerializer it
+// stores byte slices as is, without base64.
+//
+// It is implemented in this package, without any dependency. Supported
+// values are nil, booleans, integers, floats, strings, []byte, time.Time,
+// and slices, arrays and maps of supported values; other types, like
+// structs, fail to serialize. Values are decoded using generic types:
+// integers as int64, or uint64 if they don't fit, float32 and float64 as
+// is, slices as []interface{}, and maps as map[string]interface{} when all
+// their keys are strings, map[interface{}]interface{} otherwise.
+//
+// Like JSONSerializer, it requires map keys, including those of
+// session.Values, to be plain strings: other keys, like integers or named
+// string types, would decode as another type and lookups with the original
+// key would silently miss, so Serialize returns an error instead.
+type MsgpackSerializer struct{}
+
+// msgpackMaxDepth bounds the nesting of decoded values.
+const msgpackMaxDepth = 100
+
+// msgpackTimestamp is the MessagePack extension type of timestamps.
+const msgpackTimestamp = -1
+
+var errMsgpackShort = errors.New("sessions: truncated msgpack data")
+
+var stringType = reflect.TypeOf("")
+
+// Serialize encodes the session values as a MessagePack map.
+func (MsgpackSerializer) Serialize(s *Session) ([]byte, error) {
+	if s.Values == nil {
+		return appendMsgpackHeader(nil, 0, 0x80, 16, 0xde), nil
+	}
+	return appendMsgpack(nil, reflect.ValueOf(s.Values))
+}
+
+// Deserialize decodes a MessagePack map into the session values.
+func (MsgpackSerializer) Deserialize(d []byte, s *Session) error {
+	dec := msgpackDecoder{data: d}
+	v, err := dec.decode(0)
+	if err != nil {
+		return err
+	}
+	if dec.pos != len(d) {
+		return errors.New("sessions: trailing msgpack data")
+	}
+	if s.Values == nil {
+		s.Values = make(map[interface{}]interface{})
+	}
+	switch m := v.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			s.Values[k] = v
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			s.Values[k] = v
+		}
+	default:
+		return fmt.Errorf("sessions: msgpack session is a %T, not a map", v)
+	}
+	return nil
+}
+
+// appendMsgpack appends the MessagePack encoding of v to b.
+func appendMsgpack(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, 0xc0), nil
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return appendMsgpackTime(b, t), nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		if v.Kind() == reflect.Ptr {
+			break
+		}
+		return appendMsgpack(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(b, v.Uint()), nil
+	case reflect.Float32:
+		b = append(b, 0xca)
+		return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		s := v.String()
+		b = appendMsgpackHeader(b, len(s), 0xa0, 32, 0xd9)
+		return append(b, s...), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				return append(b, 0xc0), nil
+			}
+			b = appendMsgpackHeader(b, v.Len(), 0, 0, 0xc4)
+			for i := 0; i < v.Len(); i++ {
+				b = append(b, byte(v.Index(i).Uint()))
+			}
+			return b, nil
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackHeader(b, v.Len(), 0x90, 16, 0xdc)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendMsgpack(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackHeader(b, v.Len(), 0x80, 16, 0xde)
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key()
+			if k.Kind() == reflect.Interface {
+				k = k.Elem()
+			}
+			if !k.IsValid() || k.Type() != stringType {
+				return nil, fmt.Errorf("sessions: non-string key %#v of type %T, cannot serialize session to msgpack",
+					iter.Key().Interface(), iter.Key().Interface())
+			}
+			var err error
+			if b, err = appendMsgpack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("sessions: msgpack cannot serialize value of type %s", v.Type())
+}
+
+// appendMsgpackHeader appends the header of a string, binary, array or map
+// of n elements. Fix formats hold up to fixMax elements starting at fix;
+// the 8 (strings and binaries only), 16 and 32 bits formats follow first.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, first byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case first == 0xd9 || first == 0xc4:
+		if n <= math.MaxUint8 {
+			return append(b, first, byte(n))
+		}
+		first++
+		fallthrough
+	default:
+		if n <= math.MaxUint16 {
+			return binary.BigEndian.AppendUint16(append(b, first), uint16(n))
+		}
+		return binary.BigEndian.AppendUint32(append(b, first+1), uint32(n))
+	}
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(b, uint64(i))
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
+
+func appendMsgpackUint(b []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), u)
+}
+
+// appendMsgpackTime appends t as a timestamp 96 extension.
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, byte(msgpackTimestamp&0xff))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
+
+// msgpackDecoder decodes MessagePack values from data.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// length reads a length of n bytes. Every element takes at least a byte,
+// so lengths beyond the remaining data are rejected before allocating.
+func (d *msgpackDecoder) length(n int) (int, error) {
+	u, err := d.uint(n)
+	if err != nil {
+		return 0, err
+	}
+	if u > uint64(len(d.data)-d.pos) {
+		return 0, errMsgpackShort
+	}
+	return int(u), nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("sessions: msgpack data nested too deeply")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.next(n)
+		return append([]byte(nil), data...), err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		u, err := d.uint(4)
+		return math.Float32frombits(uint32(u)), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		if err != nil || u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		u, err := d.uint(n)
+		// Sign-extend the n bytes integer.
+		shift := 64 - 8*n
+		return int64(u<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+	return nil, fmt.Errorf("sessions: unsupported msgpack format 0x%02x", c)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	m := make(map[interface{}]interface{}, n)
+	stringKeys := true
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}, []byte:
+			return nil, fmt.Errorf("sessions: msgpack map key of type %T is not comparable", k)
+		case string:
+		default:
+			stringKeys = false
+		}
+		if m[k], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	if !stringKeys || depth == 0 {
+		return m, nil
+	}
+	sm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		sm[k.(string)] = v
+	}
+	return sm, nil
+}
+
+// decodeExt decodes an extension with n bytes of data. Only timestamps
+// are supported.
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	b, err := d.next(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	if int8(b[0]) != msgpackTimestamp {
+		return nil, fmt.Errorf("sessions: unsupported msgpack extension type %d", int8(b[0]))
+	}
+	b = b[1:]
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(b)
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(nsec)), nil
+	}
+	return nil, fmt.Errorf("sessions: invalid msgpack timestamp of %d bytes", n)
+}
@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackSerializer(t *testing.T) {
+	created := time.Unix(1700000000, 123456789)
+	blob := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)
+	values := map[interface{}]interface{}{
+		"nil":      nil,
+		"bool":     true,
+		"small":    1,
+		"negative": -33,
+		"big":      int64(1) << 40,
+		"huge":     uint64(1) << 63,
+		"float":    1.5,
+		"float32":  float32(0.25),
+		"string":   "hello",
+		"long":     strings.Repeat("x", 70000),
+		"blob":     blob,
+		"created":  created,
+		"list":     []string{"a", "b"},
+		"nested": map[string]interface{}{
+			"bytes": []byte("raw"),
+			"deep":  map[string]interface{}{"n": -1},
+		},
+	}
+	want := map[interface{}]interface{}{
+		"nil":      nil,
+		"bool":     true,
+		"small":    int64(1),
+		"negative": int64(-33),
+		"big":      int64(1) << 40,
+		"huge":     uint64(1) << 63,
+		"float":    1.5,
+		"float32":  float32(0.25),
+		"string":   "hello",
+		"long":     strings.Repeat("x", 70000),
+		"blob":     blob,
+		"created":  created,
+		"list":     []interface{}{"a", "b"},
+		"nested": map[string]interface{}{
+			"bytes": []byte("raw"),
+			"deep":  map[string]interface{}{"n": int64(-1)},
+		},
+	}
+
+	serializer := MsgpackSerializer{}
+	session := NewSession(nil, "hello")
+	session.Values = values
+	data, err := serializer.Serialize(session)
+	if err != nil {
+		t.Fatal("failed to serialize", err)
+	}
+	decoded := NewSession(nil, "hello")
+	if err = serializer.Deserialize(data, decoded); err != nil {
+		t.Fatal("failed to deserialize", err)
+	}
+	for k, v := range want {
+		got := decoded.Values[k]
+		if tm, ok := v.(time.Time); ok {
+			if gt, ok := got.(time.Time); !ok || !gt.Equal(tm) {
+				t.Errorf("%v: expected %v, got %v", k, tm, got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("%v: expected %#v, got %#v", k, v, got)
+		}
+	}
+	if len(decoded.Values) != len(want) {
+		t.Errorf("expected %d values, got %d", len(want), len(decoded.Values))
+	}
+
+	// Truncated data fails cleanly.
+	for i := 0; i < len(data); i += len(data)/50 + 1 {
+		if err := serializer.Deserialize(data[:i], NewSession(nil, "hello")); err == nil {
+			t.Fatalf("expected an error for data truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestMsgpackSerializerUnsupported(t *testing.T) {
+	session := NewSession(nil, "hello")
+	session.Values["user"] = struct{ Name string }{"alice"}
+	_, err := MsgpackSerializer{}.Serialize(session)
+	if err == nil || !strings.Contains(err.Error(), "struct") {
+		t.Errorf("expected an error naming the unsupported type, got %v", err)
+	}
+}
+
+func TestMsgpackSerializerKeys(t *testing.T) {
+	type userKey string
+	for _, values := range []map[interface{}]interface{}{
+		{42: "int key"},
+		{userKey("user"): "named key"},
+		{"nested": map[userKey]string{"user": "named key"}},
+		{"nested": map[int]string{1: "int key"}},
+	} {
+		session := NewSession(nil, "hello")
+		session.Values = values
+		_, err := MsgpackSerializer{}.Serialize(session)
+		if err == nil || !strings.Contains(err.Error(), "non-string key") {
+			t.Errorf("%v: expected an error for a non-string key, got %v", values, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewMultiplexedCookieStore returns a MultiplexedCookieStore packing its
+// sessions into the cookie called cookieName.
+//
+// See NewCookieStore() for a description of the key pairs.
+func NewMultiplexedCookieStore(cookieName string, keyPairs ...[]byte) *MultiplexedCookieStore {
+	ms := &MultiplexedCookieStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		cookieName: cookieName,
+	}
+	setCodecsMaxAge(ms.Codecs, ms.Options.MaxAge)
+	setCodecsMaxLength(ms.Codecs, 4096)
+	return ms
+}
+
+// MultiplexedCookieStore stores several sessions in a single signed, and
+// optionally encrypted, cookie holding the values of each session by name,
+// so requests using many sessions don't send a cookie for each of them.
+//
+// Save writes the cookie with the current values of all the sessions of
+// the store registered for the request, and keeps the sessions of the
+// cookie that weren't loaded. Saving one session thus rewrites them all,
+// and the latest Set-Cookie header of the response replaces earlier ones.
+//
+// This trades isolation for smaller headers: the sessions share the
+// store Options and the size limit of one cookie, and a cookie that can't
+// be decoded loses all of them. The Options of the sessions are ignored,
+// except for a MaxAge < 0 which removes the session from the cookie; the
+// cookie is expired once no session is left.
+type MultiplexedCookieStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // configuration of the cookie
+	cookieName string
+}
+
+// multiplexedValues are the values of the sessions of a
+// MultiplexedCookieStore, by session name.
+type multiplexedValues map[string]map[interface{}]interface{}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *MultiplexedCookieStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns the session packed under name in the cookie sent with r,
+// without adding it to the registry.
+//
+// It returns a new session and an error wrapping ErrInvalidCookie if the
+// cookie can't be decoded.
+func (s *MultiplexedCookieStore) New(r *http.Request, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.Options = s.Options.Clone()
+	session.IsNew = true
+	packed, err := s.decode(r)
+	if values, ok := packed[name]; ok && err == nil {
+		session.Values = values
+		session.IsNew = false
+	}
+	return session, err
+}
+
+// Save writes the cookie holding the session and the other sessions of the
+// store.
+func (s *MultiplexedCookieStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return s.SaveAll(r, w, []*Session{session})
+}
+
+// SaveAll writes the cookie holding the sessions and the other sessions of
+// the store once. It implements BatchSaver.
+func (s *MultiplexedCookieStore) SaveAll(r *http.Request, w http.ResponseWriter,
+	sessions []*Session) error {
+	return s.write(r, w, sessions, "")
+}
+
+// Delete removes the session from the cookie, expiring the cookie if no
+// session is left.
+func (s *MultiplexedCookieStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return s.write(r, w, nil, session.Name())
+}
+
+// decode returns the sessions packed in the cookie sent with r.
+func (s *MultiplexedCookieStore) decode(r *http.Request) (multiplexedValues, error) {
+	c, errCookie := r.Cookie(s.cookieName)
+	if errCookie != nil {
+		return nil, nil
+	}
+	if err := checkCookieValue(s.cookieName, c.Value); err != nil {
+		return nil, err
+	}
+	RegisterGobTypes()
+	var packed multiplexedValues
+	if err := securecookie.DecodeMulti(s.cookieName, c.Value, &packed,
+		s.Codecs...); err != nil {
+		return nil, invalidCookie(err)
+	}
+	return packed, nil
+}
+
+// packed returns the sessions of the cookie last written for r, or the ones
+// sent with r if none was written yet, so sessions deleted earlier in the
+// response stay deleted.
+func (s *MultiplexedCookieStore) packed(r *http.Request) multiplexedValues {
+	packed := make(multiplexedValues)
+	last, _ := s.decode(r)
+	if registry, ok := r.Context().Value(registryKey).(*Registry); ok {
+		registry.mu.RLock()
+		if written, ok := registry.multiplexed[s]; ok {
+			last = written
+		}
+		registry.mu.RUnlock()
+	}
+	for name, values := range last {
+		packed[name] = values
+	}
+	return packed
+}
+
+// setPacked records the sessions of the cookie written for r.
+func (s *MultiplexedCookieStore) setPacked(r *http.Request, packed multiplexedValues) {
+	registry, ok := r.Context().Value(registryKey).(*Registry)
+	if !ok {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.multiplexed == nil {
+		registry.multiplexed = make(map[*MultiplexedCookieStore]multiplexedValues)
+	}
+	registry.multiplexed[s] = packed
+}
+
+// write emits the cookie holding the sessions of the store: those of the
+// cookie last written for r, or sent with r, updated with the ones
+// registered for r and with sessions, and without the one called deleted.
+func (s *MultiplexedCookieStore) write(r *http.Request, w http.ResponseWriter,
+	sessions []*Session, deleted string) error {
+	opts := s.Options.Clone()
+	if err := checkCookie(s.cookieName, opts); err != nil {
+		return err
+	}
+	packed := s.packed(r)
+	registered := sessionsOf(r, s)
+	for _, session := range append(registered, sessions...) {
+		if session.Options != nil && session.Options.MaxAge < 0 {
+			delete(packed, session.Name())
+			continue
+		}
+		packed[session.Name()] = session.Values
+	}
+	delete(packed, deleted)
+
+	var encoded string
+	if len(packed) == 0 || opts.MaxAge < 0 {
+		opts.MaxAge = -1
+	} else {
+		RegisterGobTypes()
+		var err error
+		if encoded, err = encodeCookie(s.cookieName, packed, s.Codecs); err != nil {
+			return err
+		}
+	}
+	s.setPacked(r, packed)
+	writeCookie(w, NewCookie(s.cookieName, encoded, opts), opts)
+	for _, session := range sessions {
+		session.IsNew = false
+		session.cookieValue = encoded
+	}
+	dedupeSetCookies(w.Header(), s.cookieName)
+	return nil
+}
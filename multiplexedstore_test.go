@@ -0,0 +1,101 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMultiplexedCookieStore(t *testing.T) {
+	store := NewMultiplexedCookieStore("sessions", []byte("some key"))
+	names := []string{"auth", "cart", "prefs"}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	for _, name := range names {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["name"] = name
+	}
+	w := httptest.NewRecorder()
+	if err := Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sessions" {
+		t.Fatalf("expected a single cookie, got %v", w.Header()["Set-Cookie"])
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(cookies[0])
+	for _, name := range names {
+		session, err := store.Get(req, name)
+		if err != nil || session.IsNew || session.Values["name"] != name {
+			t.Fatalf("failed to unpack session %q: %v %v", name, err, session.Values)
+		}
+	}
+
+	// Deleting a session keeps the others in the cookie.
+	w = httptest.NewRecorder()
+	if err := Delete(req, w, "cart"); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	for _, name := range names {
+		session, _ := store.New(req, name)
+		if session.IsNew != (name == "cart") {
+			t.Errorf("unexpected IsNew %v for session %q", session.IsNew, name)
+		}
+	}
+
+	other := NewMultiplexedCookieStore("sessions", []byte("other key"))
+	if session, err := other.New(req, "auth"); !errors.Is(err, ErrInvalidCookie) || !session.IsNew {
+		t.Errorf("expected ErrInvalidCookie and a new session, got %v", err)
+	}
+}
+
+func TestMultiplexedCookieStoreDeleteThenSave(t *testing.T) {
+	store := NewMultiplexedCookieStore("sessions", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	for _, name := range []string{"a", "b"} {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["name"] = name
+	}
+	w := httptest.NewRecorder()
+	if err := Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	if _, err := store.Get(req, "a"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	w = httptest.NewRecorder()
+	if err := Delete(req, w, "a"); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	session, err := store.Get(req, "b")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.Values["name"] = "b2"
+	if err = GetRegistry(req).Save(w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	cookies := w.Result().Cookies()
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if session, _ = store.New(req, "a"); !session.IsNew {
+		t.Errorf("expected the deleted session to stay deleted, got %v", session.Values)
+	}
+	if session, _ = store.New(req, "b"); session.IsNew || session.Values["name"] != "b2" {
+		t.Errorf("expected the saved session, got %v", session.Values)
+	}
+}
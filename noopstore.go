@@ -0,0 +1,56 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"net/http"
+)
+
+// NewNoopStore returns a new NoopStore.
+func NewNoopStore() *NoopStore {
+	return &NoopStore{
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+// NoopStore is a Store that doesn't keep sessions.
+//
+// New always returns a new empty session, and Save and Delete do nothing
+// and emit no cookies. Use it to disable sessions, e.g. behind a feature
+// flag, while handlers keep running unchanged.
+type NoopStore struct {
+	Options *Options // default configuration
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *NoopStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a new empty session for the given name without adding it to
+// the registry.
+func (s *NoopStore) New(r *http.Request, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.Options = s.Options.Clone()
+	session.IsNew = true
+	return session, nil
+}
+
+// Save does nothing.
+func (s *NoopStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return nil
+}
+
+// Delete does nothing.
+func (s *NoopStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNoopStore(t *testing.T) {
+	store := NewNoopStore()
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "hello", Value: "world"})
+	session, err := store.Get(req, "hello")
+	if err != nil {
+		t.Fatal("failed to get session", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("expected a new empty session, got %+v", session)
+	}
+	session.Values["foo"] = "bar"
+	if _, err = store.Get(req, "other"); err != nil {
+		t.Fatal("failed to get session", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err = Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if err = Delete(req, w, "other"); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if err = Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if headers := w.Header()["Set-Cookie"]; len(headers) != 0 {
+		t.Errorf("expected no Set-Cookie headers, got %v", headers)
+	}
+}
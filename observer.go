@@ -0,0 +1,65 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"time"
+)
+
+// Observer is notified by stores of every session load and save, e.g. to
+// record metrics.
+//
+// Stores call it synchronously from New and Save, so implementations must
+// be fast and safe for concurrent use. Stores without an Observer don't
+// measure anything.
+type Observer interface {
+	// Loaded is called after New.
+	Loaded(e Event)
+	// Saved is called after Save.
+	Saved(e Event)
+}
+
+// Event describes a session load or save reported to an Observer.
+type Event struct {
+	// Name is the session name.
+	Name string
+	// Size is the size of the encoded session in bytes: the cookie value
+	// for CookieStore, the stored data for server-side stores. It is 0 if
+	// nothing was loaded or saved.
+	Size     int
+	Duration time.Duration
+	Err      error
+}
+
+// startObserving returns the start time of an operation reported to o.
+func startObserving(o Observer) time.Time {
+	if o == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observeLoaded reports a load started at start to o, if set.
+func observeLoaded(o Observer, start time.Time, session *Session, err error) {
+	if o != nil {
+		o.Loaded(newEvent(start, session, err))
+	}
+}
+
+// observeSaved reports a save started at start to o, if set.
+func observeSaved(o Observer, start time.Time, session *Session, err error) {
+	if o != nil {
+		o.Saved(newEvent(start, session, err))
+	}
+}
+
+func newEvent(start time.Time, session *Session, err error) Event {
+	return Event{
+		Name:     session.Name(),
+		Size:     session.size,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+}
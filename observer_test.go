@@ -0,0 +1,92 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the events it receives.
+type recordingObserver struct {
+	mu     sync.Mutex
+	loaded []Event
+	saved  []Event
+}
+
+func (o *recordingObserver) Loaded(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.loaded = append(o.loaded, e)
+}
+
+func (o *recordingObserver) Saved(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.saved = append(o.saved, e)
+}
+
+// slowSerializer makes every Serialize take some time.
+var slowSerializer = HookSerializer{
+	BeforeSave: func(data []byte) ([]byte, error) {
+		time.Sleep(time.Millisecond)
+		return data, nil
+	},
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	store := NewCookieStore([]byte("some key"))
+	store.Serializer = slowSerializer
+	store.Observer = observer
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(cookie)
+	if _, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	if len(observer.loaded) != 2 || len(observer.saved) != 1 {
+		t.Fatalf("expected 2 loads and 1 save, got %d and %d", len(observer.loaded), len(observer.saved))
+	}
+	if e := observer.loaded[0]; e.Name != "hello" || e.Size != 0 || e.Err != nil {
+		t.Errorf("bad event for a new session: %+v", e)
+	}
+	if e := observer.saved[0]; e.Size != len(cookie.Value) || e.Duration < time.Millisecond || e.Err != nil {
+		t.Errorf("bad save event: %+v, cookie size %d", e, len(cookie.Value))
+	}
+	if e := observer.loaded[1]; e.Size != len(cookie.Value) || e.Duration <= 0 {
+		t.Errorf("bad load event: %+v, cookie size %d", e, len(cookie.Value))
+	}
+}
+
+func TestObserverServerSide(t *testing.T) {
+	observer := &recordingObserver{}
+	redis := newFakeRedis()
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	store.Observer = observer
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	session.Values["foo"] = "bar"
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	stored := len(redis.data["session:"+session.ID])
+	if len(observer.saved) != 1 || observer.saved[0].Size != stored || stored == 0 {
+		t.Errorf("expected a save event of %d bytes, got %+v", stored, observer.saved)
+	}
+}
@@ -0,0 +1,582 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// RedisConn is the subset of a Redis connection used by RedisStore.
+//
+// It matches the Do method of redigo's redis.Conn; other clients can be
+// adapted with a small wrapper.
+type RedisConn interface {
+	Do(commandName string, args ...interface{}) (reply interface{}, err error)
+	Close() error
+}
+
+// RedisPipeline is implemented by connections that can pipeline commands,
+// like redigo's redis.Conn. RedisStore.SaveAll uses it to send the commands
+// for several sessions in a single round-trip.
+type RedisPipeline interface {
+	Send(commandName string, args ...interface{}) error
+	Flush() error
+	Receive() (reply interface{}, err error)
+}
+
+// RedisContextConn is implemented by connections that accept a context,
+// like redigo's redis.ConnWithContext. RedisStore then runs the commands
+// with the context of the request. Otherwise the context is only checked
+// before each command.
+type RedisContextConn interface {
+	DoContext(ctx context.Context, commandName string,
+		args ...interface{}) (reply interface{}, err error)
+}
+
+// NewRedisStore returns a new RedisStore.
+//
+// The pool argument is called to obtain a connection for every command, and
+// the connection is closed afterwards. With redigo this is typically:
+//
+//	func() sessions.RedisConn { return pool.Get() }
+//
+// Sessions are stored under keyPrefix + session ID. If keyPrefix is empty
+// "session:" is used. Use distinct prefixes for apps sharing one Redis.
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewRedisStore(pool func() RedisConn, keyPrefix string,
+	keyPairs ...[]byte) *RedisStore {
+	if keyPrefix == "" {
+		keyPrefix = "session:"
+	}
+	rs := &RedisStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Serializer: GobSerializer{},
+		pool:       pool,
+		keyPrefix:  keyPrefix,
+	}
+
+	rs.MaxAge(rs.Options.MaxAge)
+	return rs
+}
+
+// RedisStore stores sessions in Redis.
+//
+// Only the session ID is sent to the client, in a signed cookie. The
+// serialized session values are stored with a TTL matching Options.MaxAge.
+type RedisStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // default configuration
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default the
+	// session is written to Redis but its cookie is skipped when the
+	// client already has an identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer Observer
+	// UserID indexes sessions by user on Save for DeleteByUserID. The
+	// index of a user is a set stored under keyPrefix + "user:" + user ID.
+	UserID    UserIDFunc
+	pool      func() RedisConn
+	keyPrefix string
+	// mu guards Serializer during Reencrypt.
+	mu sync.RWMutex
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *RedisStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// A session ID that is unknown to Redis, e.g. because it expired, results
+// in a new session. IDs with an invalid signature are rejected without
+// querying Redis.
+//
+// See CookieStore.New().
+func (s *RedisStore) New(r *http.Request, name string) (*Session, error) {
+	return newBackendSession(s, s, r, name)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL,
+// then the session is deleted from Redis and the cookie is expired.
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return saveBackendSession(r.Context(), s, w, session)
+}
+
+// SaveAll saves several sessions over a single connection. It implements
+// BatchSaver.
+//
+// If the connection implements RedisPipeline, the commands are sent in a
+// single round-trip. The cookies are added to the response before the
+// commands run, so a session whose write fails is new on the next request.
+func (s *RedisStore) SaveAll(r *http.Request, w http.ResponseWriter,
+	sessions []*Session) error {
+	cfg := s.config()
+	start := startObserving(cfg.observer)
+	batch := &redisBatch{RedisStore: s}
+	errs := make([]error, len(sessions))
+	var errMulti MultiError
+	for i, session := range sessions {
+		if errs[i] = storeBackendSession(r.Context(), batch, w, session, cfg); errs[i] != nil {
+			errMulti = append(errMulti,
+				fmt.Errorf("sessions: error saving session %q -- %w", session.Name(), errs[i]))
+		}
+	}
+	var errExec error
+	if len(batch.cmds) > 0 {
+		if errExec = unavailable(batch.exec(r.Context(), s.pool())); errExec != nil {
+			errMulti = append(errMulti, errExec)
+		}
+	}
+	if cfg.observer != nil {
+		for i, session := range sessions {
+			if errs[i] == nil {
+				errs[i] = errExec
+			}
+			observeSaved(cfg.observer, start, session, errs[i])
+		}
+	}
+	if errMulti != nil {
+		return errMulti
+	}
+	return nil
+}
+
+// Delete removes the session from Redis and expires the session cookie.
+func (s *RedisStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *RedisStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// config returns the settings used by the backend helpers.
+func (s *RedisStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
+	}
+}
+
+// do runs a single command on a connection from the pool.
+func (s *RedisStore) do(ctx context.Context, cmd string,
+	args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn := s.pool()
+	defer conn.Close()
+	reply, err := redisDo(ctx, conn, cmd, args...)
+	return reply, unavailable(err)
+}
+
+// redisDo runs a command on conn, with ctx if conn implements
+// RedisContextConn.
+func redisDo(ctx context.Context, conn RedisConn, cmd string,
+	args ...interface{}) (interface{}, error) {
+	if c, ok := conn.(RedisContextConn); ok {
+		return c.DoContext(ctx, cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// save writes the serialized session.Values with SETEX.
+func (s *RedisStore) save(ctx context.Context, session *Session) error {
+	data, err := s.serializer().Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	if _, err = s.do(ctx, "SETEX", s.keyPrefix+session.ID, session.Options.storeTTL(), data); err != nil {
+		return err
+	}
+	for _, cmd := range s.indexCmds(session) {
+		if _, err := s.do(ctx, cmd[0].(string), cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexCmds returns the commands adding the session to the index of its
+// user, if any. The index expires with the last session added to it.
+func (s *RedisStore) indexCmds(session *Session) [][]interface{} {
+	if s.UserID == nil {
+		return nil
+	}
+	userID := s.UserID(session)
+	if userID == "" {
+		return nil
+	}
+	key := s.userKey(userID)
+	return [][]interface{}{
+		{"SADD", key, session.ID},
+		{"EXPIRE", key, session.Options.storeTTL()},
+	}
+}
+
+// userKey returns the key of the session index of a user. Session IDs
+// can't contain ':', so it doesn't clash with session keys.
+func (s *RedisStore) userKey(userID string) string {
+	return s.keyPrefix + "user:" + userID
+}
+
+// load reads the session from Redis and decodes it into session.Values.
+//
+// It returns false if there is no session stored for the ID.
+func (s *RedisStore) load(ctx context.Context, session *Session) (bool, error) {
+	reply, err := s.do(ctx, "GET", s.keyPrefix+session.ID)
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	switch reply := reply.(type) {
+	case nil:
+		return false, nil
+	case []byte:
+		data = reply
+	case string:
+		data = []byte(reply)
+	default:
+		return false, fmt.Errorf("sessions: unexpected redis reply type %T", reply)
+	}
+	session.size = len(data)
+	return true, s.serializer().Deserialize(data, session)
+}
+
+// erase deletes the session from Redis.
+func (s *RedisStore) erase(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	_, err := s.do(ctx, "DEL", s.keyPrefix+session.ID)
+	return err
+}
+
+// Touch sets the TTL of the session stored under id with EXPIRE. It
+// implements Toucher.
+func (s *RedisStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	_, err := s.expire(ctx, id, ttl)
+	return err
+}
+
+// expire sets the TTL of the session stored under id, reporting whether
+// the key exists.
+func (s *RedisStore) expire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	reply, err := s.do(ctx, "EXPIRE", s.keyPrefix+id, int(ttl/time.Second))
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// touch extends the TTL of the session and of the index of its user.
+func (s *RedisStore) touch(ctx context.Context, session *Session) (bool, error) {
+	ttl := time.Duration(session.Options.storeTTL()) * time.Second
+	if ok, err := s.expire(ctx, session.ID, ttl); err != nil || !ok {
+		return false, err
+	}
+	for _, cmd := range s.indexCmds(session) {
+		if _, err := s.do(ctx, cmd[0].(string), cmd[1:]...); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// redisBatch is a backend queuing the writes of RedisStore.SaveAll.
+type redisBatch struct {
+	*RedisStore
+	cmds [][]interface{}
+}
+
+// save queues a SETEX of the serialized session.Values.
+func (b *redisBatch) save(ctx context.Context, session *Session) error {
+	data, err := b.serializer().Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	b.cmds = append(b.cmds, []interface{}{"SETEX", b.keyPrefix + session.ID, session.Options.storeTTL(), data})
+	b.cmds = append(b.cmds, b.indexCmds(session)...)
+	return nil
+}
+
+// touch makes SaveAll rewrite the sessions, since whether they are still
+// stored is only known once the queued commands ran.
+func (b *redisBatch) touch(ctx context.Context, session *Session) (bool, error) {
+	return false, nil
+}
+
+// erase queues a DEL of the session.
+func (b *redisBatch) erase(ctx context.Context, session *Session) error {
+	if session.ID != "" {
+		b.cmds = append(b.cmds, []interface{}{"DEL", b.keyPrefix + session.ID})
+	}
+	return nil
+}
+
+// exec runs the queued commands on conn and closes it.
+func (b *redisBatch) exec(ctx context.Context, conn RedisConn) error {
+	defer conn.Close()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, ok := conn.(RedisPipeline)
+	if !ok {
+		for _, cmd := range b.cmds {
+			if _, err := redisDo(ctx, conn, cmd[0].(string), cmd[1:]...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, cmd := range b.cmds {
+		if err := p.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	var first error
+	for range b.cmds {
+		if _, err := p.Receive(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// List returns the sessions stored under the key prefix, iterating with
+// SCAN. The creation time of the sessions is not recorded.
+func (s *RedisStore) List(ctx context.Context) ([]SessionMeta, error) {
+	now := clock(s.now)
+	var metas []SessionMeta
+	err := s.scan(ctx, func(key string) error {
+		id := strings.TrimPrefix(key, s.keyPrefix)
+		if strings.Contains(id, ":") {
+			// A user index.
+			return nil
+		}
+		ttl, err := s.do(ctx, "TTL", key)
+		if err != nil {
+			return err
+		}
+		secs, _ := ttl.(int64)
+		if secs == -2 {
+			// The key expired since it was scanned.
+			return nil
+		}
+		meta := SessionMeta{ID: id}
+		if secs > 0 {
+			meta.Expires = now.Add(time.Duration(secs) * time.Second)
+		}
+		metas = append(metas, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// DeleteAll deletes all the keys under the key prefix, iterating with
+// SCAN.
+func (s *RedisStore) DeleteAll(ctx context.Context) error {
+	return s.scan(ctx, func(key string) error {
+		_, err := s.do(ctx, "DEL", key)
+		return err
+	})
+}
+
+// DeleteByUserID deletes the sessions in the index of a user, and the
+// index.
+func (s *RedisStore) DeleteByUserID(ctx context.Context, userID string) error {
+	key := s.userKey(userID)
+	reply, err := s.do(ctx, "SMEMBERS", key)
+	if err != nil {
+		return err
+	}
+	members, _ := reply.([]interface{})
+	for _, m := range members {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, err := redisString(m)
+		if err != nil {
+			return err
+		}
+		if _, err := s.do(ctx, "DEL", s.keyPrefix+id); err != nil {
+			return err
+		}
+	}
+	_, err = s.do(ctx, "DEL", key)
+	return err
+}
+
+// scan calls fn for each key under the key prefix.
+func (s *RedisStore) scan(ctx context.Context, fn func(key string) error) error {
+	match := redisGlobEscaper.Replace(s.keyPrefix) + "*"
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", match, "COUNT", 100)
+		if err != nil {
+			return err
+		}
+		var keys []interface{}
+		if parts, ok := reply.([]interface{}); ok && len(parts) == 2 {
+			keys, _ = parts[1].([]interface{})
+			cursor, err = redisString(parts[0])
+		} else {
+			err = fmt.Errorf("sessions: unexpected redis SCAN reply %T", reply)
+		}
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			key, err := redisString(k)
+			if err != nil {
+				return err
+			}
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// DeleteByID deletes the session stored under id.
+func (s *RedisStore) DeleteByID(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.do(ctx, "DEL", s.keyPrefix+id)
+	return err
+}
+
+// Reencrypt rewrites the stored sessions with serializer, keeping their
+// TTL, and then makes it the Serializer of the store. It implements
+// Reencrypter.
+//
+// Meanwhile sessions are saved with serializer and loaded with serializer
+// or the former Serializer, so requests can keep using the store. Sessions
+// saved during the rewrite are left as is. Other instances sharing the
+// Redis need serializer too. Session cookies only hold signed IDs and
+// aren't affected.
+func (s *RedisStore) Reencrypt(ctx context.Context, serializer Serializer) error {
+	if err := checkReencryption(serializer); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	re := reencrypt(s.Serializer, serializer)
+	s.Serializer = re
+	s.mu.Unlock()
+	err := s.scan(ctx, func(key string) error {
+		if strings.Contains(strings.TrimPrefix(key, s.keyPrefix), ":") {
+			// A user index.
+			return nil
+		}
+		reply, err := s.do(ctx, "GET", key)
+		if err != nil || reply == nil {
+			return err
+		}
+		data, err := redisString(reply)
+		if err != nil {
+			return err
+		}
+		encrypted, err := reencryptData(re, []byte(data))
+		if err != nil {
+			return fmt.Errorf("sessions: error reencrypting %q -- %w", key, err)
+		}
+		_, err = s.do(ctx, "EVAL", redisReplaceScript, 1, key, []byte(data), encrypted)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.Serializer = serializer
+	s.mu.Unlock()
+	return nil
+}
+
+// redisReplaceScript replaces the value of a key, keeping its TTL, unless
+// it was changed or expired since it was read.
+const redisReplaceScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	local ttl = redis.call("PTTL", KEYS[1])
+	if ttl > 0 then
+		return redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+	end
+end
+return false`
+
+// serializer returns the Serializer of the store.
+func (s *RedisStore) serializer() Serializer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Serializer
+}
+
+// redisGlobEscaper escapes the characters special to SCAN MATCH patterns.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// redisString converts a bulk string reply.
+func redisString(reply interface{}) (string, error) {
+	switch reply := reply.(type) {
+	case []byte:
+		return string(reply), nil
+	case string:
+		return reply, nil
+	}
+	return "", fmt.Errorf("sessions: unexpected redis reply type %T", reply)
+}
@@ -0,0 +1,750 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// fakeRedis is an in-memory stand-in for a Redis server.
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttl  map[string]int
+	sets map[string]map[string]bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		data: make(map[string][]byte),
+		ttl:  make(map[string]int),
+		sets: make(map[string]map[string]bool),
+	}
+}
+
+func (f *fakeRedis) pool() RedisConn { return f }
+
+func (f *fakeRedis) Close() error { return nil }
+
+func (f *fakeRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := args[0].(string)
+	switch cmd {
+	case "GET":
+		if v, ok := f.data[key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SETEX":
+		f.ttl[key] = args[1].(int)
+		f.data[key] = args[2].([]byte)
+		return "OK", nil
+	case "DEL":
+		delete(f.data, key)
+		delete(f.ttl, key)
+		delete(f.sets, key)
+		return int64(1), nil
+	case "SADD":
+		if f.sets[key] == nil {
+			f.sets[key] = make(map[string]bool)
+		}
+		f.sets[key][args[1].(string)] = true
+		return int64(1), nil
+	case "SMEMBERS":
+		var members []interface{}
+		for m := range f.sets[key] {
+			members = append(members, []byte(m))
+		}
+		return members, nil
+	case "EXPIRE":
+		if _, ok := f.data[key]; !ok && f.sets[key] == nil {
+			return int64(0), nil
+		}
+		f.ttl[key] = args[1].(int)
+		return int64(1), nil
+	case "TTL":
+		if ttl, ok := f.ttl[key]; ok {
+			return int64(ttl), nil
+		}
+		return int64(-2), nil
+	case "EVAL":
+		// redisReplaceScript.
+		key = args[2].(string)
+		if v, ok := f.data[key]; !ok || string(v) != string(args[3].([]byte)) || f.ttl[key] <= 0 {
+			return nil, nil
+		}
+		f.data[key] = args[4].([]byte)
+		return "OK", nil
+	case "SCAN":
+		// All keys are returned in a single iteration.
+		prefix := strings.TrimSuffix(strings.Replace(args[2].(string), `\`, "", -1), "*")
+		var keys []interface{}
+		for k := range f.data {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		for k := range f.sets {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	}
+	return nil, fmt.Errorf("unsupported command %s", cmd)
+}
+
+// pipelinedRedis is a fakeRedis connection supporting pipelining. Every
+// Do or Flush counts as a round-trip and waits for latency.
+type pipelinedRedis struct {
+	*fakeRedis
+	latency    time.Duration
+	roundTrips int
+	queue      [][]interface{}
+	replies    []interface{}
+}
+
+func (p *pipelinedRedis) pool() RedisConn { return p }
+
+func (p *pipelinedRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	p.roundTrips++
+	time.Sleep(p.latency)
+	return p.fakeRedis.Do(cmd, args...)
+}
+
+func (p *pipelinedRedis) Send(cmd string, args ...interface{}) error {
+	p.queue = append(p.queue, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (p *pipelinedRedis) Flush() error {
+	p.roundTrips++
+	time.Sleep(p.latency)
+	for _, cmd := range p.queue {
+		reply, _ := p.fakeRedis.Do(cmd[0].(string), cmd[1:]...)
+		p.replies = append(p.replies, reply)
+	}
+	p.queue = nil
+	return nil
+}
+
+func (p *pipelinedRedis) Receive() (interface{}, error) {
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	return reply, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisStore(redis.pool, "app:", []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	session.Options.MaxAge = 3600
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	key := "app:" + session.ID
+	if _, ok := redis.data[key]; !ok {
+		t.Fatalf("expected session stored under %q", key)
+	}
+	if redis.ttl[key] != 3600 {
+		t.Errorf("bad ttl: got %d, want 3600", redis.ttl[key])
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.ID != session.ID || loaded.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved session, got %#v", loaded)
+	}
+
+	loaded.Options.MaxAge = -1
+	if err = loaded.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, ok := redis.data[key]; ok {
+		t.Fatal("expected session to be deleted")
+	}
+
+	// A cache miss results in a fresh session.
+	loaded, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !loaded.IsNew || loaded.ID != "" || len(loaded.Values) != 0 {
+		t.Fatalf("expected a fresh session, got %#v", loaded)
+	}
+}
+
+func TestRedisStoreReencrypt(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	var _ Reencrypter = store
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	store.Serializer = FieldEncryptionSerializer{Codecs: CodecsFromPairs(nil, oldKey)}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetEncrypted("card", fmt.Sprint("card ", i))
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		serializer := FieldEncryptionSerializer{Codecs: CodecsFromPairs(nil, newKey)}
+		if err := store.Reencrypt(ctx, serializer); err != nil {
+			t.Fatal("failed to reencrypt sessions", err)
+		}
+	}
+	decode := func(key []byte) []*Session {
+		f := FieldEncryptionSerializer{Codecs: CodecsFromPairs(nil, key)}
+		var sessions []*Session
+		for key, data := range redis.data {
+			session := NewSession(nil, "hello")
+			if err := f.Deserialize(data, session); err != nil {
+				t.Fatalf("failed to deserialize %q: %v", key, err)
+			}
+			sessions = append(sessions, session)
+		}
+		return sessions
+	}
+	for _, session := range decode(newKey) {
+		if err := session.FieldError("card"); err != nil {
+			t.Fatal("failed to decrypt with the new key", err)
+		}
+		if card, _ := session.Values["card"].(string); !strings.HasPrefix(card, "card ") {
+			t.Errorf("bad value: got %q", card)
+		}
+	}
+	for _, session := range decode(oldKey) {
+		if session.FieldError("card") == nil {
+			t.Error("expected the old key to fail")
+		}
+	}
+	for key, ttl := range redis.ttl {
+		if ttl != 86400*30 {
+			t.Errorf("bad ttl of %q: got %d", key, ttl)
+		}
+	}
+}
+
+func TestRedisStoreReencryptData(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["card"] = "secret card"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	key := []byte("fedcba9876543210")
+	if err = store.Reencrypt(context.Background(), EncryptionSerializer{Codecs: CodecsFromPairs(nil, key)}); err != nil {
+		t.Fatal("failed to reencrypt sessions", err)
+	}
+	data := redis.data["session:"+session.ID]
+	if bytes.Contains(data, []byte("secret card")) {
+		t.Error("expected the session data to be encrypted")
+	}
+	decoded := NewSession(nil, "hello")
+	if err = (EncryptionSerializer{Codecs: CodecsFromPairs(nil, key)}).Deserialize(data, decoded); err != nil {
+		t.Fatal("failed to decrypt with the new key", err)
+	}
+	if decoded.Values["card"] != "secret card" {
+		t.Errorf("bad value: got %v", decoded.Values["card"])
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil || loaded.IsNew || loaded.Values["card"] != "secret card" {
+		t.Errorf("failed to load the reencrypted session: %v %v", loaded.Values, err)
+	}
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	store.Options.StoreTTL = 86400 * 30
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options.MaxAge = 60
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if ttl := redis.ttl["session:"+session.ID]; ttl != 86400*30 {
+		t.Errorf("bad record ttl: got %d, want %d", ttl, 86400*30)
+	}
+	if c := w.Result().Cookies()[0]; c.MaxAge != 60 {
+		t.Errorf("bad cookie max age: got %d, want 60", c.MaxAge)
+	}
+
+	// Without StoreTTL the record expires with the cookie.
+	session.Options.StoreTTL = 0
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if ttl := redis.ttl["session:"+session.ID]; ttl != 60 {
+		t.Errorf("bad record ttl: got %d, want 60", ttl)
+	}
+
+	// A browser-session cookie keeps the record for the StoreTTL.
+	session.Options.MaxAge = 0
+	session.Options.StoreTTL = 86400 * 30
+	w = httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if ttl := redis.ttl["session:"+session.ID]; session.ID == "" || ttl != 86400*30 {
+		t.Errorf("bad record ttl: got %d, want %d", ttl, 86400*30)
+	}
+	if c := w.Result().Cookies()[0]; c.MaxAge != 0 || !c.Expires.IsZero() {
+		t.Errorf("expected a browser-session cookie, got %v", c)
+	}
+
+	// Without StoreTTL it is deleted.
+	session.Options.StoreTTL = 0
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(redis.data) != 0 {
+		t.Errorf("expected the record to be deleted, got %v", redis.data)
+	}
+
+	session.Options.StoreTTL = -1
+	if err = session.Save(req, httptest.NewRecorder()); err == nil {
+		t.Error("expected an error for a negative StoreTTL")
+	}
+}
+
+// contextRedis is a fakeRedis whose commands run with a context. It calls
+// cancel when the command cmd starts and waits for the context.
+type contextRedis struct {
+	*fakeRedis
+	cmd    string
+	cancel context.CancelFunc
+}
+
+func (c *contextRedis) pool() RedisConn { return c }
+
+func (c *contextRedis) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == c.cmd {
+		c.cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return c.fakeRedis.Do(cmd, args...)
+}
+
+func TestRedisStoreContext(t *testing.T) {
+	redis := &contextRedis{fakeRedis: newFakeRedis(), cmd: "SETEX"}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redis.cancel = cancel
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://www.example.com", nil)
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	err = session.Save(req, w)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(redis.data) != 0 {
+		t.Fatalf("expected nothing stored, got %v", redis.data)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("expected no cookie, got %q", c)
+	}
+
+	// Connections without DoContext don't run commands once the context
+	// is done.
+	plain := newFakeRedis()
+	store = NewRedisStore(plain.pool, "", []byte("some key"))
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, httptest.NewRecorder()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(plain.data) != 0 {
+		t.Fatalf("expected nothing stored, got %v", plain.data)
+	}
+}
+
+func TestRedisStoreSaveAll(t *testing.T) {
+	redis := &pipelinedRedis{fakeRedis: newFakeRedis()}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["name"] = name
+	}
+	w := httptest.NewRecorder()
+	if err := Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if redis.roundTrips != 1 {
+		t.Errorf("expected a single round-trip, got %d", redis.roundTrips)
+	}
+	if len(redis.data) != len(names) || len(w.Result().Cookies()) != len(names) {
+		t.Errorf("expected %d stored sessions and cookies, got %d and %d",
+			len(names), len(redis.data), len(w.Result().Cookies()))
+	}
+
+	// Without pipelining the commands share a connection.
+	plain := newFakeRedis()
+	store = NewRedisStore(plain.pool, "", []byte("some key"))
+	var sessions []*Session
+	for _, name := range names {
+		session, _ := store.New(req, name)
+		sessions = append(sessions, session)
+	}
+	if err := store.SaveAll(req, httptest.NewRecorder(), sessions); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if len(plain.data) != len(names) {
+		t.Errorf("expected %d stored sessions, got %d", len(names), len(plain.data))
+	}
+}
+
+func BenchmarkRedisStoreSave(b *testing.B) {
+	redis := &pipelinedRedis{fakeRedis: newFakeRedis(), latency: 50 * time.Microsecond}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	var sessions []*Session
+	for i := 0; i < 4; i++ {
+		session, _ := store.New(req, fmt.Sprintf("session%d", i))
+		session.Values["i"] = i
+		sessions = append(sessions, session)
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, session := range sessions {
+				if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := store.SaveAll(req, httptest.NewRecorder(), sessions); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRedisStoreEnumerator(t *testing.T) {
+	redis := newFakeRedis()
+	redis.data["other:1"] = []byte("unrelated")
+	store := NewRedisStore(redis.pool, "session:", []byte("some key"))
+	var _ Enumerator = store
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	ctx := context.Background()
+	metas, err := store.List(ctx)
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	var listed []string
+	for _, meta := range metas {
+		listed = append(listed, meta.ID)
+		if meta.Expires.IsZero() {
+			t.Errorf("expected an expiry for session %s", meta.ID)
+		}
+	}
+	sort.Strings(ids)
+	sort.Strings(listed)
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Fatalf("expected sessions %v, got %v", ids, listed)
+	}
+
+	if err = store.DeleteByID(ctx, ids[0]); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if metas, _ = store.List(ctx); len(metas) != 2 {
+		t.Errorf("expected 2 sessions after DeleteByID, got %d", len(metas))
+	}
+}
+
+func TestRedisStorePurger(t *testing.T) {
+	redis := newFakeRedis()
+	redis.data["other:1"] = []byte("unrelated")
+	store := NewRedisStore(redis.pool, "session:", []byte("some key"))
+	var _ Purger = store
+	store.UserID = UserIDFromValue("user")
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	for _, user := range []string{"alice", "alice", "alice", "bob", ""} {
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if user != "" {
+			session.Values["user"] = user
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+	ctx := context.Background()
+	metas, err := store.List(ctx)
+	if err != nil || len(metas) != 5 {
+		t.Fatalf("expected 5 sessions listed without the user indexes, got %d, %v", len(metas), err)
+	}
+
+	if err = store.DeleteByUserID(ctx, "alice"); err != nil {
+		t.Fatal("failed to delete the sessions of a user", err)
+	}
+	if metas, _ = store.List(ctx); len(metas) != 2 {
+		t.Fatalf("expected the sessions of bob and the anonymous one to be left, got %d", len(metas))
+	}
+	if _, ok := redis.sets["session:user:alice"]; ok {
+		t.Error("expected the user index to be deleted")
+	}
+	if err = store.DeleteAll(ctx); err != nil {
+		t.Fatal("failed to delete all sessions", err)
+	}
+	if len(redis.data) != 1 || len(redis.sets) != 0 {
+		t.Errorf("expected only the unrelated key left, got %d keys and %d sets", len(redis.data), len(redis.sets))
+	}
+}
+
+// recordingRedis is a fakeRedis recording the commands it runs.
+type recordingRedis struct {
+	*fakeRedis
+	cmds []string
+}
+
+func (r *recordingRedis) pool() RedisConn { return r }
+
+func (r *recordingRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	r.cmds = append(r.cmds, cmd)
+	return r.fakeRedis.Do(cmd, args...)
+}
+
+// saveSliding saves a sliding session of store and returns a request
+// loading it again.
+func saveSliding(tb testing.TB, store *RedisStore) *http.Request {
+	store.Options.SkipUnmodified = true
+	store.Options.SlidingExpiration = true
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		tb.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = strings.Repeat("bar", 100)
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		tb.Fatal("failed to save session", err)
+	}
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	return req
+}
+
+func TestRedisStoreTouch(t *testing.T) {
+	redis := &recordingRedis{fakeRedis: newFakeRedis()}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	var _ Toucher = store
+	req := saveSliding(t, store)
+
+	session, err := store.Get(req, "hello")
+	if err != nil || session.IsNew {
+		t.Fatal("failed to load session", err)
+	}
+	redis.cmds = nil
+	w := httptest.NewRecorder()
+	if err = Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if strings.Join(redis.cmds, " ") != "EXPIRE" {
+		t.Errorf("expected only EXPIRE for a clean sliding session, got %v", redis.cmds)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("expected the cookie to be re-emitted")
+	}
+
+	session.Values["foo"] = "baz"
+	session.MarkDirty()
+	redis.cmds = nil
+	if err = Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if strings.Join(redis.cmds, " ") != "SETEX" {
+		t.Errorf("expected SETEX for a dirty session, got %v", redis.cmds)
+	}
+
+	// A session expired since it was loaded is written again.
+	delete(redis.data, "session:"+session.ID)
+	redis.cmds = nil
+	if err = Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if strings.Join(redis.cmds, " ") != "EXPIRE SETEX" {
+		t.Errorf("expected EXPIRE then SETEX for a missing session, got %v", redis.cmds)
+	}
+}
+
+func TestRedisStoreForgedID(t *testing.T) {
+	redis := &recordingRedis{fakeRedis: newFakeRedis()}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	req := saveSliding(t, store)
+	id := ""
+	for key := range redis.data {
+		id = strings.TrimPrefix(key, "session:")
+	}
+	forged, err := securecookie.EncodeMulti("hello", id,
+		securecookie.CodecsFromPairs([]byte("other key"))...)
+	if err != nil {
+		t.Fatal("failed to encode forged ID", err)
+	}
+
+	for _, value := range []string{id, forged, "session:" + id} {
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.AddCookie(&http.Cookie{Name: "hello", Value: value})
+		redis.cmds = nil
+		session, err := store.New(req, "hello")
+		if !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("expected ErrInvalidCookie for %q, got %v", value, err)
+		}
+		if !session.IsNew || session.ID != "" || len(session.Values) != 0 {
+			t.Errorf("expected a new session for %q, got %#v", value, session)
+		}
+		if len(redis.cmds) != 0 {
+			t.Errorf("expected no Redis command for %q, got %v", value, redis.cmds)
+		}
+	}
+}
+
+func BenchmarkRedisStoreSliding(b *testing.B) {
+	for _, clean := range []bool{true, false} {
+		name := "touch"
+		if !clean {
+			name = "save"
+		}
+		b.Run(name, func(b *testing.B) {
+			store := NewRedisStore(newFakeRedis().pool, "", []byte("some key"))
+			req := saveSliding(b, store)
+			session, err := store.New(req, "hello")
+			if err != nil {
+				b.Fatal("failed to load session", err)
+			}
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				session.dirty = !clean
+				if err := store.Save(req, w, session); err != nil {
+					b.Fatal("failed to save session", err)
+				}
+				w.Header().Del("Set-Cookie")
+			}
+		})
+	}
+}
+
+// racingRedis is a fakeRedis calling onGet once, after the next GET.
+type racingRedis struct {
+	*fakeRedis
+	onGet func(key string)
+}
+
+func (r *racingRedis) pool() RedisConn { return r }
+
+func (r *racingRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := r.fakeRedis.Do(cmd, args...)
+	if onGet := r.onGet; cmd == "GET" && onGet != nil {
+		r.onGet = nil
+		onGet(args[0].(string))
+	}
+	return reply, err
+}
+
+func TestRedisStoreReencryptConcurrentSave(t *testing.T) {
+	redis := &racingRedis{fakeRedis: newFakeRedis()}
+	store := NewRedisStore(redis.pool, "", []byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	redis.onGet = func(key string) {
+		redis.mu.Lock()
+		redis.data[key] = []byte("saved meanwhile")
+		redis.mu.Unlock()
+	}
+	serializer := EncryptionSerializer{Codecs: CodecsFromPairs(nil, []byte("fedcba9876543210"))}
+	if err = store.Reencrypt(context.Background(), serializer); err != nil {
+		t.Fatal("failed to reencrypt sessions", err)
+	}
+	if data := string(redis.data["session:"+session.ID]); data != "saved meanwhile" {
+		t.Errorf("expected the concurrent save to be kept, got %q", data)
+	}
+}
@@ -0,0 +1,522 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Serializer encodes and decodes the Values of a session.
+//
+// Stores use a Serializer to turn session.Values into the bytes they sign,
+// encrypt or persist.
+type Serializer interface {
+	Serialize(s *Session) ([]byte, error)
+	Deserialize(d []byte, s *Session) error
+}
+
+var registerGobOnce sync.Once
+
+// RegisterGobTypes registers the types the package stores in sessions,
+// like the []interface{} holding flashes, with encoding/gob.
+//
+// It is called the first time values are gob-encoded or decoded, so it
+// only needs to be called by applications decoding session data
+// themselves. Calling it more than once is harmless.
+func RegisterGobTypes() {
+	registerGobOnce.Do(func() {
+		gob.Register([]interface{}{})
+		gob.Register(map[string]string{})
+	})
+}
+
+// GobSerializer encodes session values using encoding/gob.
+//
+// Custom types stored in a session must be registered with gob.Register.
+type GobSerializer struct{}
+
+// Serialize encodes the session values using gob.
+func (GobSerializer) Serialize(s *Session) ([]byte, error) {
+	RegisterGobTypes()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.Values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decodes gob data into the session values.
+func (GobSerializer) Deserialize(d []byte, s *Session) error {
+	RegisterGobTypes()
+	return gob.NewDecoder(bytes.NewReader(d)).Decode(&s.Values)
+}
+
+// JSONSerializer encodes session values using encoding/json.
+//
+// JSON objects only have string keys, so every key in session.Values must be
+// a string: Serialize returns an error naming the first other key instead of
+// dropping it. This includes typed keys like named string types and
+// fmt.Stringer values, which aren't coerced since they would come back as
+// plain strings, and lookups with the typed key would silently miss.
+//
+// Values are decoded using the generic JSON types, e.g. numbers are
+// returned as float64.
+type JSONSerializer struct{}
+
+// Serialize encodes the session values as a JSON object.
+func (JSONSerializer) Serialize(s *Session) ([]byte, error) {
+	m := make(map[string]interface{}, len(s.Values))
+	for k, v := range s.Values {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("sessions: non-string key %#v of type %T, cannot serialize session to JSON", k, k)
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize decodes a JSON object into the session values.
+func (JSONSerializer) Deserialize(d []byte, s *Session) error {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(d, &m); err != nil {
+		return err
+	}
+	if s.Values == nil {
+		s.Values = make(map[interface{}]interface{}, len(m))
+	}
+	for k, v := range m {
+		s.Values[k] = v
+	}
+	return nil
+}
+
+// HookSerializer wraps a Serializer with hooks transforming the serialized
+// bytes, e.g. to compress large sessions.
+//
+// BeforeSave runs after the values are serialized and AfterLoad before they
+// are deserialized. Stores sign and encrypt the output of the serializer,
+// so the hooks always see plaintext: compression happens before encryption
+// on save, and decompression after decryption on load.
+type HookSerializer struct {
+	// Serializer encodes the session values. When nil GobSerializer is
+	// used.
+	Serializer Serializer
+	BeforeSave func(data []byte) ([]byte, error)
+	AfterLoad  func(data []byte) ([]byte, error)
+}
+
+func (h HookSerializer) serializer() Serializer {
+	if h.Serializer == nil {
+		return GobSerializer{}
+	}
+	return h.Serializer
+}
+
+// Serialize serializes the session values and applies BeforeSave.
+func (h HookSerializer) Serialize(s *Session) ([]byte, error) {
+	data, err := h.serializer().Serialize(s)
+	if err != nil || h.BeforeSave == nil {
+		return data, err
+	}
+	return h.BeforeSave(data)
+}
+
+// Deserialize applies AfterLoad and deserializes the session values.
+func (h HookSerializer) Deserialize(d []byte, s *Session) error {
+	if h.AfterLoad != nil {
+		var err error
+		if d, err = h.AfterLoad(d); err != nil {
+			return err
+		}
+	}
+	return h.serializer().Deserialize(d, s)
+}
+
+// DefaultCompressionThreshold is the MinSize used by CompressionSerializer
+// when it is not set.
+const DefaultCompressionThreshold = 512
+
+// DefaultMaxDecompressedSize is the MaxSize used by CompressionSerializer
+// when it is not set.
+const DefaultMaxDecompressedSize = 1 << 20
+
+// Flags prefixing the data written by CompressionSerializer.
+const (
+	compressionNone    byte = 0
+	compressionDeflate byte = 1
+)
+
+// CompressionSerializer wraps a Serializer to deflate large sessions.
+//
+// Only serialized values of at least MinSize bytes are compressed, since
+// compressing small ones wastes CPU and often enlarges them. The output
+// starts with a byte telling whether the rest is compressed; data that
+// doesn't shrink is stored as is.
+type CompressionSerializer struct {
+	// Serializer encodes the session values. When nil GobSerializer is
+	// used.
+	Serializer Serializer
+	// MinSize is the size from which values are compressed. When <= 0
+	// DefaultCompressionThreshold is used.
+	MinSize int
+	// MaxSize limits the size of the serialized values, so small but
+	// highly compressed data can't make Deserialize allocate without
+	// bounds. When <= 0 DefaultMaxDecompressedSize is used.
+	MaxSize int
+}
+
+func (c CompressionSerializer) serializer() Serializer {
+	if c.Serializer == nil {
+		return GobSerializer{}
+	}
+	return c.Serializer
+}
+
+func (c CompressionSerializer) maxSize() int {
+	if c.MaxSize <= 0 {
+		return DefaultMaxDecompressedSize
+	}
+	return c.MaxSize
+}
+
+// Serialize serializes the session values, compressing them if they are
+// large enough.
+func (c CompressionSerializer) Serialize(s *Session) ([]byte, error) {
+	data, err := c.serializer().Serialize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > c.maxSize() {
+		return nil, fmt.Errorf("sessions: serialized session is %d bytes, exceeding the maximum of %d",
+			len(data), c.maxSize())
+	}
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressionThreshold
+	}
+	if len(data) >= minSize {
+		var buf bytes.Buffer
+		buf.WriteByte(compressionDeflate)
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(data)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+	return append([]byte{compressionNone}, data...), nil
+}
+
+// Deserialize decompresses the data if needed and deserializes the session
+// values.
+func (c CompressionSerializer) Deserialize(d []byte, s *Session) error {
+	if len(d) == 0 {
+		return errors.New("sessions: missing compression flag")
+	}
+	switch d[0] {
+	case compressionNone:
+		d = d[1:]
+	case compressionDeflate:
+		zr := flate.NewReader(bytes.NewReader(d[1:]))
+		defer zr.Close()
+		var err error
+		if d, err = io.ReadAll(io.LimitReader(zr, int64(c.maxSize())+1)); err != nil {
+			return err
+		}
+		if len(d) > c.maxSize() {
+			return fmt.Errorf("sessions: decompressed session exceeds the maximum of %d bytes", c.maxSize())
+		}
+	default:
+		return fmt.Errorf("sessions: unknown compression flag %d", d[0])
+	}
+	return c.serializer().Deserialize(d, s)
+}
+
+// FallbackSerializer migrates sessions between serialization formats.
+//
+// Sessions are always serialized with Serializer. Deserialization tries
+// Serializer, then each of Fallbacks in order; a session decoded by a
+// fallback is marked dirty so the next Save rewrites it with Serializer,
+// e.g. moving from GobSerializer to JSONSerializer without logging users
+// out.
+type FallbackSerializer struct {
+	// Serializer is the current format. When nil GobSerializer is used.
+	Serializer Serializer
+	Fallbacks  []Serializer
+}
+
+func (f FallbackSerializer) serializer() Serializer {
+	if f.Serializer == nil {
+		return GobSerializer{}
+	}
+	return f.Serializer
+}
+
+// Serialize serializes the session values with Serializer.
+func (f FallbackSerializer) Serialize(s *Session) ([]byte, error) {
+	return f.serializer().Serialize(s)
+}
+
+// Deserialize deserializes the session values with the first serializer
+// that accepts d. It returns the error of Serializer if none does.
+func (f FallbackSerializer) Deserialize(d []byte, s *Session) error {
+	err := f.serializer().Deserialize(d, s)
+	if err == nil {
+		return nil
+	}
+	for _, fallback := range f.Fallbacks {
+		// Don't keep values partially decoded by a failed attempt.
+		s.Values = make(map[interface{}]interface{})
+		if fallback.Deserialize(d, s) == nil {
+			s.dirty = true
+			s.stale = true
+			return nil
+		}
+	}
+	s.Values = make(map[interface{}]interface{})
+	return err
+}
+
+// encryptedFieldsKey holds the values encrypted by FieldEncryptionSerializer.
+const encryptedFieldsKey = "_encrypted"
+
+// FieldEncryptionSerializer wraps a Serializer to encrypt the values set
+// with Session.SetEncrypted individually.
+//
+// Each value is encrypted with the first codec, and decrypted by trying
+// each codec in order, so keys can be rotated by prepending a new codec.
+// The codecs must encrypt, e.g.:
+//
+//	store.Serializer = sessions.FieldEncryptionSerializer{
+//		Codecs: []securecookie.Codec{sessions.NewGCMCodec(key)},
+//	}
+//
+// A value that fails to decrypt is left out of Values and reported by
+// Session.FieldError, without failing the rest of the session.
+type FieldEncryptionSerializer struct {
+	// Serializer encodes the session values. When nil GobSerializer is
+	// used.
+	Serializer Serializer
+	Codecs     []securecookie.Codec
+}
+
+// encryptedField wraps an encrypted value so it keeps its dynamic type.
+type encryptedField struct {
+	V interface{}
+}
+
+func (f FieldEncryptionSerializer) serializer() Serializer {
+	if f.Serializer == nil {
+		return GobSerializer{}
+	}
+	return f.Serializer
+}
+
+// Serialize encrypts the fields set with SetEncrypted and serializes the
+// session values.
+func (f FieldEncryptionSerializer) Serialize(s *Session) ([]byte, error) {
+	if len(s.encrypted) == 0 {
+		return f.serializer().Serialize(s)
+	}
+	RegisterGobTypes()
+	values := make(map[interface{}]interface{}, len(s.Values))
+	fields := make(map[string]string, len(s.encrypted))
+	for k, v := range s.Values {
+		if key, ok := k.(string); ok && s.encrypted[key] {
+			encoded, err := encodeCookie(key, encryptedField{v}, f.Codecs)
+			if err != nil {
+				return nil, fmt.Errorf("sessions: error encrypting %q -- %w", key, err)
+			}
+			fields[key] = encoded
+			continue
+		}
+		values[k] = v
+	}
+	values[encryptedFieldsKey] = fields
+	plain := *s
+	plain.Values = values
+	return f.serializer().Serialize(&plain)
+}
+
+// Deserialize deserializes the session values and decrypts the encrypted
+// fields.
+func (f FieldEncryptionSerializer) Deserialize(d []byte, s *Session) error {
+	RegisterGobTypes()
+	if err := f.serializer().Deserialize(d, s); err != nil {
+		return err
+	}
+	fields := make(map[string]string)
+	switch v := s.Values[encryptedFieldsKey].(type) {
+	case map[string]string:
+		fields = v
+	case map[string]interface{}:
+		// The JSONSerializer decodes objects this way.
+		for key, encoded := range v {
+			fields[key], _ = encoded.(string)
+		}
+	}
+	delete(s.Values, encryptedFieldsKey)
+	for key, encoded := range fields {
+		if s.encrypted == nil {
+			s.encrypted = make(map[string]bool)
+		}
+		s.encrypted[key] = true
+		var field encryptedField
+		if err := securecookie.DecodeMulti(key, encoded, &field, f.Codecs...); err != nil {
+			if s.fieldErrors == nil {
+				s.fieldErrors = make(map[string]error)
+			}
+			s.fieldErrors[key] = fmt.Errorf("sessions: error decrypting %q -- %w", key, err)
+			continue
+		}
+		s.Values[key] = field.V
+	}
+	return nil
+}
+
+// encryptedDataName is the name the data of EncryptionSerializer is
+// encrypted under.
+const encryptedDataName = "_data"
+
+// EncryptionSerializer wraps a Serializer to encrypt the serialized session
+// values as a whole, so server-side stores keep them encrypted at rest. It
+// is set as the Serializer of a store; NewEncryptedStore wraps any store
+// instead.
+//
+// The data is encrypted with the first codec and decrypted by trying each
+// codec in order. The codecs must encrypt, and should neither expire
+// values nor limit their length, since the data can outlive and outgrow
+// a cookie.
+type EncryptionSerializer struct {
+	// Serializer encodes the session values. When nil GobSerializer is
+	// used.
+	Serializer Serializer
+	Codecs     []securecookie.Codec
+}
+
+func (e EncryptionSerializer) serializer() Serializer {
+	if e.Serializer == nil {
+		return GobSerializer{}
+	}
+	return e.Serializer
+}
+
+// Serialize serializes and encrypts the session values.
+func (e EncryptionSerializer) Serialize(s *Session) ([]byte, error) {
+	data, err := e.serializer().Serialize(s)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := encodeCookie(encryptedDataName, data, e.Codecs)
+	if err != nil {
+		return nil, fmt.Errorf("sessions: error encrypting session data -- %w", err)
+	}
+	return []byte(encoded), nil
+}
+
+// Deserialize decrypts and deserializes the session values.
+func (e EncryptionSerializer) Deserialize(d []byte, s *Session) error {
+	var data []byte
+	if err := securecookie.DecodeMulti(encryptedDataName, string(d), &data, e.Codecs...); err != nil {
+		return fmt.Errorf("sessions: error decrypting session data -- %w", err)
+	}
+	return e.serializer().Deserialize(data, s)
+}
+
+// checkReencryption returns an error unless serializer is an
+// EncryptionSerializer or FieldEncryptionSerializer whose codecs all
+// encrypt. It is used by the Reencrypt method of stores.
+func checkReencryption(serializer Serializer) error {
+	var codecs []securecookie.Codec
+	switch serializer := serializer.(type) {
+	case EncryptionSerializer:
+		codecs = serializer.Codecs
+	case FieldEncryptionSerializer:
+		codecs = serializer.Codecs
+	default:
+		return fmt.Errorf("sessions: cannot reencrypt sessions with %T, an EncryptionSerializer or FieldEncryptionSerializer is required", serializer)
+	}
+	if len(codecs) == 0 {
+		return ErrNoKeys
+	}
+	if !codecsEncrypt(codecs) {
+		return errors.New("sessions: Reencrypt requires an encryption key in every key pair")
+	}
+	return nil
+}
+
+// codecsEncrypt reports whether codecs is not empty and all its codecs are
+// known to encrypt.
+func codecsEncrypt(codecs []securecookie.Codec) bool {
+	for _, codec := range codecs {
+		switch c := codec.(type) {
+		case *GCMCodec, legacyCodec:
+		case *KeyProviderCodec:
+			if !codecsEncrypt(c.current()) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return len(codecs) > 0
+}
+
+// reencryption is the Serializer of a store while its sessions are
+// re-encrypted: data is serialized with the new Serializer, and
+// deserialized with the new or the former one.
+type reencryption struct {
+	Serializer
+	former Serializer
+}
+
+// Deserialize deserializes d with the new Serializer, or with the former
+// one if the data or one of its fields can't be decrypted.
+func (r reencryption) Deserialize(d []byte, s *Session) error {
+	if err := r.Serializer.Deserialize(d, s); err == nil && len(s.fieldErrors) == 0 {
+		return nil
+	}
+	s.Values = make(map[interface{}]interface{})
+	s.encrypted = nil
+	s.fieldErrors = nil
+	return r.former.Deserialize(d, s)
+}
+
+// reencrypt returns the Serializer of a store during Reencrypt, serializing
+// with serializer and deserializing with serializer or current. If a former
+// Reencrypt failed midway, current still deserializes its data.
+func reencrypt(current, serializer Serializer) reencryption {
+	if current == nil {
+		current = GobSerializer{}
+	}
+	return reencryption{Serializer: serializer, former: current}
+}
+
+// reencryptData deserializes data with r and serializes it again with the
+// new Serializer.
+func reencryptData(r reencryption, data []byte) ([]byte, error) {
+	session := NewSession(nil, "")
+	if err := r.Deserialize(data, session); err != nil {
+		return nil, err
+	}
+	for _, err := range session.fieldErrors {
+		return nil, err
+	}
+	return r.Serializer.Serialize(session)
+}
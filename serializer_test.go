@@ -0,0 +1,358 @@
+package sessions
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestSerializerRoundTrip(t *testing.T) {
+	serializers := map[string]Serializer{
+		"gob":  GobSerializer{},
+		"json": JSONSerializer{},
+	}
+	for kind, serializer := range serializers {
+		session := NewSession(nil, "hello")
+		session.Values["foo"] = "bar"
+		session.Values["baz"] = "qux"
+
+		data, err := serializer.Serialize(session)
+		if err != nil {
+			t.Fatalf("%s: failed to serialize: %v", kind, err)
+		}
+		decoded := NewSession(nil, "hello")
+		if err = serializer.Deserialize(data, decoded); err != nil {
+			t.Fatalf("%s: failed to deserialize: %v", kind, err)
+		}
+		if len(decoded.Values) != 2 || decoded.Values["foo"] != "bar" ||
+			decoded.Values["baz"] != "qux" {
+			t.Errorf("%s: bad values: %v", kind, decoded.Values)
+		}
+	}
+}
+
+func TestGobSerializerFlashes(t *testing.T) {
+	RegisterGobTypes()
+	RegisterGobTypes()
+
+	session := NewSession(nil, "hello")
+	session.AddFlash("foo")
+	data, err := GobSerializer{}.Serialize(session)
+	if err != nil {
+		t.Fatal("failed to serialize flashes:", err)
+	}
+	decoded := NewSession(nil, "hello")
+	if err = (GobSerializer{}).Deserialize(data, decoded); err != nil {
+		t.Fatal("failed to deserialize flashes:", err)
+	}
+	if flashes := decoded.Flashes(); len(flashes) != 1 || flashes[0] != "foo" {
+		t.Errorf("bad flashes: %v", flashes)
+	}
+}
+
+func TestJSONSerializerNonStringKey(t *testing.T) {
+	session := NewSession(nil, "hello")
+	session.Values[42] = 43
+	_, err := JSONSerializer{}.Serialize(session)
+	if err == nil {
+		t.Fatal("expected an error for a non-string key, got nil")
+	}
+	if !strings.Contains(err.Error(), "non-string key 42") {
+		t.Errorf("expected the error to name the key, got %q", err)
+	}
+}
+
+// typedKey is a named string type used as a session key.
+type typedKey string
+
+func TestJSONSerializerTypedKey(t *testing.T) {
+	session := NewSession(nil, "hello")
+	session.Values["plain"] = "ok"
+	session.Values[typedKey("user")] = "alice"
+	_, err := JSONSerializer{}.Serialize(session)
+	if err == nil || !strings.Contains(err.Error(), `"user" of type sessions.typedKey`) {
+		t.Errorf("expected an error naming the typed key, got %v", err)
+	}
+}
+
+func TestCookieStoreJSONSerializer(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	store.Serializer = JSONSerializer{}
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("expected the saved values, got %v", session.Values)
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+func TestHookSerializerGzip(t *testing.T) {
+	store := NewCookieStore([]byte("some key"), []byte("0123456789abcdef"))
+	store.Serializer = HookSerializer{BeforeSave: gzipBytes, AfterLoad: gunzipBytes}
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	big := strings.Repeat("compressible ", 1000)
+	session.Values["big"] = big
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if n := len(w.Header().Get("Set-Cookie")); n >= len(big) {
+		t.Errorf("expected a compressed cookie, got %d bytes", n)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.Values["big"] != big {
+		t.Error("expected the payload to round-trip")
+	}
+}
+
+func TestFieldEncryptionSerializer(t *testing.T) {
+	serializer := FieldEncryptionSerializer{
+		Codecs: []securecookie.Codec{NewGCMCodec(testEncKey)},
+	}
+	session := NewSession(nil, "hello")
+	session.Values["user"] = "alice"
+	session.SetEncrypted("refresh_token", "s3cr3t-token")
+
+	data, err := serializer.Serialize(session)
+	if err != nil {
+		t.Fatal("failed to serialize:", err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t-token")) {
+		t.Error("expected the encrypted field not to appear in plaintext")
+	}
+	if !bytes.Contains(data, []byte("alice")) {
+		t.Error("expected other values to be stored normally")
+	}
+
+	decoded := NewSession(nil, "hello")
+	if err = serializer.Deserialize(data, decoded); err != nil {
+		t.Fatal("failed to deserialize:", err)
+	}
+	if decoded.Values["refresh_token"] != "s3cr3t-token" || decoded.Values["user"] != "alice" {
+		t.Errorf("bad values: %v", decoded.Values)
+	}
+	if _, ok := decoded.Values[encryptedFieldsKey]; ok {
+		t.Error("expected the encrypted fields to be hidden from Values")
+	}
+
+	// The field stays encrypted when the session is saved again.
+	if data, err = serializer.Serialize(decoded); err != nil {
+		t.Fatal("failed to serialize:", err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t-token")) {
+		t.Error("expected the field to stay encrypted")
+	}
+
+	// A field that doesn't decrypt doesn't spoil the rest of the session.
+	other := FieldEncryptionSerializer{
+		Codecs: []securecookie.Codec{NewGCMCodec(testEncKey2)},
+	}
+	decoded = NewSession(nil, "hello")
+	if err = other.Deserialize(data, decoded); err != nil {
+		t.Fatal("failed to deserialize:", err)
+	}
+	if decoded.FieldError("refresh_token") == nil {
+		t.Error("expected a field error")
+	}
+	if _, ok := decoded.Values["refresh_token"]; ok || decoded.Values["user"] != "alice" {
+		t.Errorf("bad values: %v", decoded.Values)
+	}
+}
+
+func TestFieldEncryptionSerializerCookieStore(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	store.Serializer = FieldEncryptionSerializer{
+		Serializer: JSONSerializer{},
+		Codecs:     []securecookie.Codec{NewGCMCodec(testEncKey)},
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session:", err)
+	}
+	session.SetEncrypted("token", "s3cr3t")
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session:", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session:", err)
+	}
+	if session.Values["token"] != "s3cr3t" {
+		t.Errorf("bad values: %v", session.Values)
+	}
+}
+
+func TestCompressionSerializer(t *testing.T) {
+	random := string(securecookie.GenerateRandomKey(2048))
+	tests := []struct {
+		value      string
+		compressed bool
+	}{
+		{"small", false},
+		{strings.Repeat("compressible ", 1000), true},
+		// Random data doesn't shrink and is stored as is.
+		{random, false},
+	}
+	serializer := CompressionSerializer{}
+	for _, test := range tests {
+		session := NewSession(nil, "hello")
+		session.Values["v"] = test.value
+		data, err := serializer.Serialize(session)
+		if err != nil {
+			t.Fatal("failed to serialize", err)
+		}
+		if compressed := data[0] == compressionDeflate; compressed != test.compressed {
+			t.Errorf("%d bytes: expected compressed=%v, got flag %d", len(test.value), test.compressed, data[0])
+		}
+		if test.compressed && len(data) >= len(test.value) {
+			t.Errorf("expected the payload to shrink, got %d bytes", len(data))
+		}
+		decoded := NewSession(nil, "hello")
+		if err = serializer.Deserialize(data, decoded); err != nil {
+			t.Fatal("failed to deserialize", err)
+		}
+		if decoded.Values["v"] != test.value {
+			t.Errorf("%d bytes: expected the value to round-trip", len(test.value))
+		}
+	}
+	if err := serializer.Deserialize([]byte{9, 1, 2}, NewSession(nil, "hello")); err == nil {
+		t.Error("expected an error for an unknown flag")
+	}
+}
+
+func TestCompressionSerializerMaxSize(t *testing.T) {
+	session := NewSession(nil, "hello")
+	session.Values["v"] = strings.Repeat("compressible ", 1000)
+	data, err := CompressionSerializer{}.Serialize(session)
+	if err != nil {
+		t.Fatal("failed to serialize", err)
+	}
+	small := CompressionSerializer{MaxSize: 1000}
+	if err = small.Deserialize(data, NewSession(nil, "hello")); err == nil {
+		t.Error("expected an error for data decompressing past MaxSize")
+	}
+	if _, err = small.Serialize(session); err == nil {
+		t.Error("expected an error for values larger than MaxSize")
+	}
+
+	// A deflate bomb stops at DefaultMaxDecompressedSize.
+	var buf bytes.Buffer
+	buf.WriteByte(compressionDeflate)
+	zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	zw.Write(make([]byte, 2*DefaultMaxDecompressedSize))
+	zw.Close()
+	if err = (CompressionSerializer{}).Deserialize(buf.Bytes(), NewSession(nil, "hello")); err == nil {
+		t.Error("expected an error for a deflate bomb")
+	}
+}
+
+func TestFallbackSerializer(t *testing.T) {
+	old := NewCookieStore([]byte("some key"))
+	old.Serializer = GobSerializer{}
+	current := NewCookieStore([]byte("some key"))
+	current.Serializer = FallbackSerializer{
+		Serializer: JSONSerializer{},
+		Fallbacks:  []Serializer{GobSerializer{}},
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := old.New(req, "hello")
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err := current.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load a gob session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("expected the gob session, got %v", session.Values)
+	}
+	if !session.IsDirty() {
+		t.Error("expected a session decoded by a fallback to be dirty")
+	}
+	w = httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatal("expected the cookie to be rewritten")
+	}
+
+	// The rewritten cookie is JSON.
+	jsonOnly := NewCookieStore([]byte("some key"))
+	jsonOnly.Serializer = JSONSerializer{}
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = jsonOnly.New(req, "hello"); err != nil || session.Values["foo"] != "bar" {
+		t.Fatalf("expected a JSON session, got %v, %v", session.Values, err)
+	}
+	if session, _ = current.New(req, "hello"); session.IsDirty() {
+		t.Error("expected a session in the current format to be clean")
+	}
+}
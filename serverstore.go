@@ -0,0 +1,204 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// backend is implemented by stores keeping the session values server-side,
+// under the session ID. The cookie only holds the signed ID.
+//
+// The methods receive the context of the request, which bounds the calls to
+// the storage.
+type backend interface {
+	// load decodes the data stored for session.ID into session.Values. It
+	// returns false if nothing is stored for the ID.
+	load(ctx context.Context, session *Session) (bool, error)
+	// save stores session.Values for session.ID.
+	save(ctx context.Context, session *Session) error
+	// erase removes the data stored for session.ID, if any.
+	erase(ctx context.Context, session *Session) error
+	// config returns the settings of the store.
+	config() backendConfig
+}
+
+// toucher is implemented by backends that can extend the lifetime of a
+// stored session without rewriting it, see Toucher. touch returns false if
+// nothing is stored for the session anymore, so it is saved instead.
+type toucher interface {
+	touch(ctx context.Context, session *Session) (bool, error)
+}
+
+// backendConfig holds the settings shared by the stores of a backend.
+type backendConfig struct {
+	codecs        []securecookie.Codec
+	options       *Options
+	idGenerator   IDGenerator
+	fingerprint   FingerprintFunc
+	path          PathFunc
+	emitUnchanged bool
+	observer      Observer
+	now           func() time.Time
+}
+
+// sessionCookieBackend is implemented by backends that can keep sessions
+// without an expiry, so a MaxAge of 0 stands for a browser-session cookie
+// instead of a deletion.
+type sessionCookieBackend interface {
+	backend
+	keepsSessionCookies()
+}
+
+// newBackendSession implements Store.New for a backend.
+//
+// A session ID unknown to the backend, e.g. because it expired, results in
+// a new session. The signature of the ID is verified before the backend is
+// queried, so forged or unsigned IDs never reach it: they result in a new
+// session and an error wrapping ErrInvalidCookie.
+func newBackendSession(store Store, b backend, r *http.Request,
+	name string) (*Session, error) {
+	cfg := b.config()
+	start := startObserving(cfg.observer)
+	session, err := loadBackendSession(store, b, r, name, cfg)
+	if errFingerprint := session.checkFingerprint(r, cfg.fingerprint); err == nil {
+		err = errFingerprint
+	}
+	observeLoaded(cfg.observer, start, session, err)
+	return session, err
+}
+
+// loadBackendSession decodes the session ID sent with r and loads the
+// session from the backend.
+func loadBackendSession(store Store, b backend, r *http.Request, name string,
+	cfg backendConfig) (*Session, error) {
+	codecs := cfg.codecs
+	session := NewSession(store, name)
+	session.Options = cfg.options.Clone()
+	session.now = cfg.now
+	session.scopePath(r, cfg.path)
+	session.IsNew = true
+	c, errCookie := r.Cookie(name)
+	if errCookie != nil {
+		return session, nil
+	}
+	if err := checkCookieValue(name, c.Value); err != nil {
+		return session, err
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID,
+		codecs...); err != nil {
+		session.ID = ""
+		return session, invalidCookie(err)
+	}
+	ok, err := b.load(r.Context(), session)
+	if err != nil && !errors.Is(err, ErrStoreUnavailable) {
+		// Anything but a backend failure means the stored data is bad.
+		err = invalidCookie(err)
+	}
+	if err != nil || !ok {
+		// Don't hand out partially decoded values.
+		session.ID = ""
+		session.Values = make(map[interface{}]interface{})
+		return session, err
+	}
+	session.IsNew = false
+	if signedWithNewestKey(name, c.Value, codecs) {
+		session.setLoaded(nil)
+	}
+	return session, session.expireAbsolute(clock(cfg.now))
+}
+
+// saveBackendSession implements Store.Save for a backend.
+//
+// If the Options.MaxAge of the session is < 0 the session is deleted. A
+// MaxAge of 0 emits a browser-session cookie, and the session is kept for
+// the StoreTTL, or without an expiry by a sessionCookieBackend; it is
+// deleted otherwise.
+func saveBackendSession(ctx context.Context, b backend, w http.ResponseWriter,
+	session *Session) error {
+	cfg := b.config()
+	start := startObserving(cfg.observer)
+	err := storeBackendSession(ctx, b, w, session, cfg)
+	observeSaved(cfg.observer, start, session, err)
+	return err
+}
+
+// storeBackendSession saves the session to the backend and sets its cookie.
+//
+// It returns the error of ctx without touching the backend if ctx is done.
+func storeBackendSession(ctx context.Context, b backend, w http.ResponseWriter,
+	session *Session, cfg backendConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkCookie(session.Name(), session.Options); err != nil {
+		return err
+	}
+	now := clock(cfg.now)
+	session.stampCreated(now)
+	unchanged := !cfg.emitUnchanged && session.cookieUnchanged()
+	_, keepsSessionCookies := b.(sessionCookieBackend)
+	if session.Options.deletesRecord(keepsSessionCookies) {
+		return deleteBackendSession(ctx, b, w, session)
+	}
+
+	if session.renew && session.ID != "" {
+		// Drop the old data so the previous ID can't be used anymore.
+		if err := b.erase(ctx, session); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	session.renew = false
+
+	if session.ID == "" {
+		id, err := newSessionID(cfg.idGenerator)
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	touched := false
+	if t, ok := b.(toucher); ok && session.touchable() {
+		var err error
+		if touched, err = t.touch(ctx, session); err != nil {
+			return err
+		}
+	}
+	if !touched {
+		if err := b.save(ctx, session); err != nil {
+			return err
+		}
+	}
+	encoded, err := encodeCookie(session.Name(), session.ID, cfg.codecs)
+	if err != nil {
+		return err
+	}
+	session.IsNew = false
+	if unchanged {
+		return nil
+	}
+	session.loaded = nil
+	setCookie(w, session, encoded, now)
+	return nil
+}
+
+// deleteBackendSession implements Store.Delete for a backend.
+func deleteBackendSession(ctx context.Context, b backend, w http.ResponseWriter,
+	session *Session) error {
+	if session.ID != "" {
+		if err := b.erase(ctx, session); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	expireCookie(w, session)
+	return nil
+}
@@ -5,41 +5,193 @@
 package sessions
 
 import (
-	"encoding/gob"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"context"
+
+	"github.com/gorilla/securecookie"
 )
 
 // Default flashes key.
 const flashesKey = "_flash"
 
+// createdKey holds the creation time of sessions with an AbsoluteTimeout,
+// in Unix seconds.
+const createdKey = "_created"
+
+// expiresKey holds the expiry time set with SetExpiry, in Unix seconds.
+const expiresKey = "_expires"
+
+// csrfKey holds the CSRF token returned by Session.CSRFToken.
+const csrfKey = "_csrf"
+
+// fingerprintKey holds the client fingerprint of stores with a
+// FingerprintFunc.
+const fingerprintKey = "_fingerprint"
+
+// MaxNameLength is the maximum length of a session name accepted by
+// Registry.Get. Some proxies reject long cookie names, so Get fails early
+// instead. Set it to 0 to disable the check.
+var MaxNameLength = 256
+
+// MaxSessionsPerRequest is the default maximum number of sessions a
+// Registry tracks, see Registry.SetMaxSessions. New registries copy it, so
+// set it before serving requests. It is unlimited when 0.
+var MaxSessionsPerRequest = 0
+
+// VaryCookie makes Registry.Save add "Cookie" to the Vary header of
+// responses to requests with sessions, so shared caches don't serve them to
+// other users. Set it to false if the app handles caching itself.
+var VaryCookie = true
+
+// DomainCheckMode tells what Save does with a session whose Options.Domain
+// is neither the host of the request nor a parent domain of it, see
+// Options.DomainCheck.
+type DomainCheckMode int
+
+const (
+	// DomainCheckOff doesn't check the Domain.
+	DomainCheckOff DomainCheckMode = iota
+	// DomainCheckWarn logs a warning to Options.DomainCheckLogger and
+	// saves the session.
+	DomainCheckWarn
+	// DomainCheckError doesn't save the session and returns an error
+	// wrapping ErrDomainMismatch.
+	DomainCheckError
+)
+
 // Options --------------------------------------------------------------------
 
 // Options stores configuration for a session or session store.
 //
-// Fields are a subset of http.Cookie fields.
+// Fields are a subset of http.Cookie fields. Stores read the session
+// Options when writing the cookie in Save.
 type Options struct {
+	// Path defaults to "/" for sessions created by NewSession.
 	Path   string
 	Domain string
-	// MaxAge=0 means no 'Max-Age' attribute specified.
+	// MaxAge=0 means no 'Max-Age' attribute specified, resulting in a
+	// session cookie that lasts until the browser is closed.
 	// MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'.
 	// MaxAge>0 means Max-Age attribute present and given in seconds.
 	MaxAge   int
 	Secure   bool
 	HttpOnly bool
+	// SameSite restricts the cookie to first-party or same-site contexts.
+	// The zero value leaves the attribute unset. Browsers reject cookies
+	// with SameSite=None that are not Secure, so Save returns an error for
+	// that combination unless AutoSecure is set.
+	SameSite http.SameSite
+	// Partitioned sets the Partitioned attribute (CHIPS), keeping the cookie
+	// of a third-party embed in a separate jar per top-level site. It
+	// requires Secure, so Save returns an error without it unless AutoSecure
+	// is set.
+	Partitioned bool
+	// AutoSecure makes Save set Secure when SameSite is http.SameSiteNoneMode,
+	// Partitioned is set, or the session name has a __Secure- or __Host-
+	// prefix, instead of returning an error.
+	AutoSecure bool
+	// SkipUnmodified makes Registry.Save skip the session unless it is
+	// dirty, avoiding writes for requests that only read session data.
+	// Only changes made through the Session methods are tracked, see
+	// Session.IsDirty.
+	SkipUnmodified bool
+	// SlidingExpiration makes Registry.Save save the session on every
+	// request, even if it is clean and SkipUnmodified is set, so the cookie
+	// and any server-side record get a fresh MaxAge while the user is
+	// active. The price is a write per request for each such session.
+	SlidingExpiration bool
+	// AbsoluteTimeout limits the lifetime of a session, in seconds since it
+	// was first saved, regardless of activity. 0 means no limit.
+	//
+	// It is checked when the session is decoded, independently of MaxAge:
+	// the session is discarded as soon as either is exceeded, so
+	// SlidingExpiration can extend MaxAge but never past AbsoluteTimeout.
+	// The creation time is kept in the session Values, and sessions saved
+	// before the option was enabled count from their next Save.
+	AbsoluteTimeout int
+	// MaxClockSkew is how far ahead of now, in seconds, the creation time
+	// of a session with an AbsoluteTimeout may be. Sessions created further
+	// in the future, because of a skewed clock or a forged timestamp, are
+	// discarded with an error wrapping ErrInvalidCookie. 0 means
+	// DefaultMaxClockSkew and a negative value disables the check.
+	MaxClockSkew int
+	// StoreTTL is the lifetime, in seconds, of the data kept by server-side
+	// stores, when it should differ from the cookie MaxAge: e.g. a short
+	// or browser-session cookie with a record kept for 30 days. 0 means
+	// MaxAge, and it can't be negative: set MaxAge to -1 to delete the
+	// session.
+	//
+	// Cookies are only re-emitted and records only refreshed when the
+	// session is saved, so with SlidingExpiration both are extended on
+	// every request, each by its own lifetime.
+	StoreTTL int
+	// DomainCheck makes Registry.Save and Session.Save check that Domain
+	// matches the host of the request, since browsers silently drop
+	// cookies for another domain. It is off by default, as some setups
+	// deliberately share cookies across hosts.
+	DomainCheck DomainCheckMode
+	// DomainCheckLogger receives the warnings of DomainCheckWarn, e.g. the
+	// Logger of the LogObserver of the store. Nothing is logged when nil.
+	DomainCheckLogger *slog.Logger
+}
+
+// DefaultMaxClockSkew is the default Options.MaxClockSkew, in seconds.
+const DefaultMaxClockSkew = 300
+
+// Clone returns a copy of o that can be changed without affecting o.
+//
+// Stores use it to give each new session its own copy of their default
+// Options. A nil o yields the defaults of NewSession.
+func (o *Options) Clone() *Options {
+	if o == nil {
+		return &Options{Path: "/"}
+	}
+	opts := *o
+	return &opts
+}
+
+// storeTTL returns the lifetime of the server-side data of a session, in
+// seconds.
+func (o *Options) storeTTL() int {
+	if o.StoreTTL != 0 {
+		return o.StoreTTL
+	}
+	return o.MaxAge
+}
+
+// deletesRecord reports whether saving a session with o deletes its
+// server-side data: with a MaxAge < 0, or without a lifetime unless the
+// store keeps sessions without an expiry.
+func (o *Options) deletesRecord(keepsSessionCookies bool) bool {
+	return o.MaxAge < 0 || o.storeTTL() == 0 && !keepsSessionCookies
 }
 
 // Session --------------------------------------------------------------------
 
 // NewSession is called by session stores to create a new session instance.
+//
+// It allocates the session Values and records the name and store, so
+// stores implemented outside this package should always use it instead of
+// building a Session literal. The session Options default to a cookie with
+// Path "/" and no MaxAge.
 func NewSession(store Store, name string) *Session {
 	return &Session{
-		Values: make(map[interface{}]interface{}),
-		store:  store,
-		name:   name,
+		Values:  make(map[interface{}]interface{}),
+		Options: &Options{Path: "/"},
+		store:   store,
+		name:    name,
 	}
 }
 
@@ -48,12 +200,117 @@ type Session struct {
 	// The ID of the session, generated by stores. It should not be used for
 	// user data.
 	ID string
-	// Values contains the user-data for the session.
+	// Values contains the user-data for the session. Keys and values must
+	// be gob-encodable; custom types need to be registered with gob.Register.
 	Values  map[interface{}]interface{}
 	Options *Options
-	IsNew   bool
-	store   Store
-	name    string
+	// IsNew is true when the store found no existing session for the
+	// request. Stores reset it to false once the session is saved.
+	IsNew bool
+	store Store
+	name  string
+	renew bool
+	dirty bool
+	// loaded is the cookie state sent by the client, if known.
+	loaded *loadedCookie
+	// encrypted holds the keys set with SetEncrypted and fieldErrors the
+	// errors decrypting them, see FieldEncryptionSerializer.
+	encrypted   map[string]bool
+	fieldErrors map[string]error
+	// size is the size of the encoded session when it was last loaded or
+	// saved, see Event.
+	size int
+	// stale is set when the session was decoded from an outdated format,
+	// so its cookie must be rewritten, see FallbackSerializer.
+	stale bool
+	// snapshot holds a copy of Values taken by Snapshot.
+	snapshot map[interface{}]interface{}
+	// cookieValue is the value of the cookie last set by Save, see
+	// RawCookieValue.
+	cookieValue string
+	// now is the clock of the store, which overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns the session value for the given key.
+//
+// It is the same as reading s.Values[key].
+func (s *Session) Get(key interface{}) interface{} {
+	return s.Values[key]
+}
+
+// Set sets the session value for the given key and marks the session dirty.
+func (s *Session) Set(key, value interface{}) {
+	s.Values[key] = value
+	s.dirty = true
+}
+
+// IsDirty reports whether the session was modified since it was loaded or
+// last saved.
+//
+// Set, AddFlash, Flashes and Renew mark the session dirty, but writing to
+// s.Values directly doesn't: call MarkDirty after doing so.
+func (s *Session) IsDirty() bool {
+	return s.dirty
+}
+
+// needsSave reports whether Registry.Save should save the session.
+func (s *Session) needsSave() bool {
+	opts := s.Options
+	return opts == nil || !opts.SkipUnmodified || opts.SlidingExpiration || s.dirty
+}
+
+// touchable reports whether Save only needs to extend the lifetime of the
+// stored session, see Toucher: it was loaded, isn't modified and slides.
+// Without SkipUnmodified Values may have been changed directly, so the
+// session is always rewritten.
+func (s *Session) touchable() bool {
+	opts := s.Options
+	return s.ID != "" && !s.IsNew && !s.dirty && !s.stale &&
+		opts.SkipUnmodified && opts.SlidingExpiration
+}
+
+// MarkDirty marks the session dirty, forcing Registry.Save to save it even
+// if its Options.SkipUnmodified is set.
+func (s *Session) MarkDirty() {
+	s.dirty = true
+}
+
+// Snapshot records a copy of the current Values, which Changes compares
+// against. Call it right after loading the session, e.g. for audit logging.
+//
+// The copy is shallow: values are compared with reflect.DeepEqual, so maps,
+// slices or pointers held in Values must be replaced rather than modified
+// in place for their changes to be reported.
+func (s *Session) Snapshot() {
+	s.snapshot = make(map[interface{}]interface{}, len(s.Values))
+	for k, v := range s.Values {
+		s.snapshot[k] = v
+	}
+}
+
+// Changes returns the keys whose values differ from the last Snapshot,
+// mapped to their values before and after. A nil value stands for a key
+// added or removed since.
+//
+// It returns nil if Snapshot wasn't called.
+func (s *Session) Changes() map[interface{}][2]interface{} {
+	if s.snapshot == nil {
+		return nil
+	}
+	changes := make(map[interface{}][2]interface{})
+	for k, before := range s.snapshot {
+		after, ok := s.Values[k]
+		if !ok || !reflect.DeepEqual(before, after) {
+			changes[k] = [2]interface{}{before, after}
+		}
+	}
+	for k, after := range s.Values {
+		if _, ok := s.snapshot[k]; !ok {
+			changes[k] = [2]interface{}{nil, after}
+		}
+	}
+	return changes
 }
 
 // Flashes returns a slice of flash messages from the session.
@@ -69,7 +326,8 @@ func (s *Session) Flashes(vars ...string) []interface{} {
 	if v, ok := s.Values[key]; ok {
 		// Drop the flashes and return it.
 		delete(s.Values, key)
-		flashes = v.([]interface{})
+		flashes, _ = v.([]interface{})
+		s.dirty = true
 	}
 	return flashes
 }
@@ -85,16 +343,277 @@ func (s *Session) AddFlash(value interface{}, vars ...string) {
 	}
 	var flashes []interface{}
 	if v, ok := s.Values[key]; ok {
-		flashes = v.([]interface{})
+		flashes, _ = v.([]interface{})
 	}
 	s.Values[key] = append(flashes, value)
+	s.dirty = true
+}
+
+// SetEncrypted sets a session value that is encrypted on its own when the
+// session is serialized, while other values are stored normally.
+//
+// The key stays encrypted for the lifetime of the session. It requires the
+// store to use a FieldEncryptionSerializer: other serializers store the
+// value like any other.
+func (s *Session) SetEncrypted(key string, value interface{}) {
+	if s.encrypted == nil {
+		s.encrypted = make(map[string]bool)
+	}
+	s.encrypted[key] = true
+	delete(s.fieldErrors, key)
+	s.Set(key, value)
+}
+
+// FieldError returns the error decrypting the value of key, which is then
+// missing from Values, or nil.
+func (s *Session) FieldError(key string) error {
+	return s.fieldErrors[key]
+}
+
+// CSRFToken returns the CSRF token of the session.
+//
+// The token is generated from a cryptographically secure source on first
+// use, which marks the session dirty, and stays the same for the lifetime
+// of the session. Embed it in forms and check submissions with VerifyCSRF.
+func (s *Session) CSRFToken() string {
+	if token, ok := s.Values[csrfKey].(string); ok && token != "" {
+		return token
+	}
+	token := base64.RawURLEncoding.EncodeToString(
+		securecookie.GenerateRandomKey(32))
+	s.Set(csrfKey, token)
+	return token
+}
+
+// VerifyCSRF reports whether candidate matches the CSRF token of the
+// session, in constant time. It is always false if no token was generated.
+func (s *Session) VerifyCSRF(candidate string) bool {
+	token, ok := s.Values[csrfKey].(string)
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1
+}
+
+// scopePath sets Options.Path to the path returned by f for r, if any.
+// Stores call it on New.
+func (s *Session) scopePath(r *http.Request, f PathFunc) {
+	if f == nil {
+		return
+	}
+	if path := f(r); path != "" {
+		s.Options.Path = path
+	}
+}
+
+// checkFingerprint compares the fingerprint stored in a decoded session
+// with the one of r. On a mismatch the session is reset like an expired
+// one and ErrFingerprintMismatch is returned. Stores call it on New.
+//
+// New sessions, and sessions saved before fp was set, get the fingerprint
+// of r.
+func (s *Session) checkFingerprint(r *http.Request, fp FingerprintFunc) error {
+	if fp == nil {
+		return nil
+	}
+	want := fp(r)
+	got, ok := s.Values[fingerprintKey].(string)
+	if ok && got == want {
+		return nil
+	}
+	if ok && !s.IsNew {
+		s.Values = map[interface{}]interface{}{fingerprintKey: want}
+		s.IsNew = true
+		s.renew = true
+		s.loaded = nil
+		return ErrFingerprintMismatch
+	}
+	s.Values[fingerprintKey] = want
+	return nil
+}
+
+// Clear removes all values from the session and marks it dirty, keeping
+// its ID, name, store and Options.
+//
+// Unlike Delete, the session lives on, and unlike Renew its ID doesn't
+// change. Reserved values like flashes, the CSRF token and the creation
+// time are removed too.
+func (s *Session) Clear() {
+	s.Values = make(map[interface{}]interface{})
+	s.encrypted = nil
+	s.fieldErrors = nil
+	s.dirty = true
+}
+
+// Expire marks the session for deletion, which is how to log a user out.
+//
+// It clears the values and sets Options.MaxAge to -1, so the next Save
+// emits a cookie that expires immediately and removes the session from
+// server-side stores.
+func (s *Session) Expire() {
+	s.Clear()
+	s.Options = s.Options.Clone()
+	s.Options.MaxAge = -1
+}
+
+// Renew marks the session for a new ID, keeping its values.
+//
+// The next Save discards the data stored under the previous ID and persists
+// the session under a freshly generated one. Call it after a login or any
+// other privilege change to prevent session fixation. Stores that don't use
+// IDs, like CookieStore, simply re-sign the session.
+func (s *Session) Renew() {
+	s.renew = true
+	s.dirty = true
+	// The renewed session starts a new AbsoluteTimeout period.
+	delete(s.Values, createdKey)
+}
+
+// RawCookieValue returns the encoded value of the cookie set for the session
+// by the last Save, e.g. to echo it in a header for double-submit CSRF
+// protection. It is the value the client sends back.
+//
+// It is empty before Save, after the session was deleted, and when Save
+// didn't emit the cookie because the client already has it; the value sent
+// by the client is then available with r.Cookie.
+func (s *Session) RawCookieValue() string {
+	return s.cookieValue
+}
+
+// Created returns the time the session was first saved. It is only
+// recorded for sessions with an AbsoluteTimeout.
+func (s *Session) Created() (time.Time, bool) {
+	return unixValue(s.Values[createdKey])
+}
+
+// SetExpiry makes the session expire at t, e.g. along with an OAuth token,
+// by setting Options.MaxAge to the seconds left until t. A t that is not in
+// the future expires the session right away, see Expire.
+//
+// The expiry is kept in the session values, and every Save sets MaxAge from
+// it again, so the cookie and the server-side data expire at t however
+// late the session is saved. SlidingExpiration then can't extend the
+// session anymore, and it is turned off for it. Stores reject a session
+// loaded past its expiry.
+func (s *Session) SetExpiry(t time.Time) {
+	now := clock(s.now)
+	if !t.After(now) {
+		s.Expire()
+		return
+	}
+	s.Values[expiresKey] = t.Unix()
+	s.Options = s.Options.Clone()
+	s.Options.SlidingExpiration = false
+	s.applyExpiry(now)
+	s.dirty = true
+}
+
+// Expiry returns the expiry time set with SetExpiry.
+func (s *Session) Expiry() (time.Time, bool) {
+	return unixValue(s.Values[expiresKey])
+}
+
+// applyExpiry sets Options.MaxAge to the seconds left until the expiry set
+// with SetExpiry, if any, or to -1 once it passed.
+func (s *Session) applyExpiry(now time.Time) {
+	expires, ok := s.Expiry()
+	if !ok {
+		return
+	}
+	maxAge := -1
+	if d := expires.Sub(now); d > 0 {
+		maxAge = int((d + time.Second - 1) / time.Second)
+	}
+	if s.Options == nil || s.Options.MaxAge != maxAge {
+		s.Options = s.Options.Clone()
+		s.Options.MaxAge = maxAge
+	}
+}
+
+// unixValue returns the time stored in a session value in Unix seconds.
+func unixValue(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case int64:
+		return time.Unix(v, 0), true
+	case float64:
+		// Numbers come back as float64 from the JSONSerializer.
+		return time.Unix(int64(v), 0), true
+	}
+	return time.Time{}, false
+}
+
+// stampCreated records the creation time of a session with an
+// AbsoluteTimeout, and sets its MaxAge from the expiry set with SetExpiry.
+// Stores call it on Save.
+func (s *Session) stampCreated(now time.Time) {
+	s.applyExpiry(now)
+	if s.Options == nil || s.Options.AbsoluteTimeout <= 0 {
+		return
+	}
+	if _, ok := s.Created(); !ok {
+		s.Values[createdKey] = now.Unix()
+	}
+}
+
+// expireAbsolute resets a decoded session that outlived its
+// AbsoluteTimeout or the expiry set with SetExpiry, so it is handed out as a
+// new one. Stores call it on New.
+//
+// Sessions created more than Options.MaxClockSkew in the future are reset
+// too, and an error is returned. The session is marked for renewal so
+// stores with IDs drop the old data on Save.
+func (s *Session) expireAbsolute(now time.Time) error {
+	if expires, ok := s.Expiry(); ok && !now.Before(expires) {
+		s.discard()
+		return nil
+	}
+	if s.Options == nil || s.Options.AbsoluteTimeout <= 0 {
+		return nil
+	}
+	created, ok := s.Created()
+	if !ok {
+		return nil
+	}
+	skew := time.Duration(s.Options.MaxClockSkew) * time.Second
+	if s.Options.MaxClockSkew == 0 {
+		skew = DefaultMaxClockSkew * time.Second
+	}
+	var err error
+	timeout := time.Duration(s.Options.AbsoluteTimeout) * time.Second
+	switch {
+	case skew >= 0 && created.Sub(now) > skew:
+		err = invalidCookie(fmt.Errorf("sessions: session %q was created %v in the future",
+			s.name, created.Sub(now)))
+	case now.Sub(created) <= timeout:
+		return nil
+	}
+	s.discard()
+	return err
+}
+
+// discard resets an expired session decoded by a store.
+func (s *Session) discard() {
+	s.Values = make(map[interface{}]interface{})
+	s.IsNew = true
+	s.renew = true
+	s.loaded = nil
 }
 
 // Save is a convenience method to save this session. It is the same as calling
 // store.Save(request, response, session). You should call Save before writing to
 // the response or returning from the handler.
 func (s *Session) Save(r *http.Request, w http.ResponseWriter) error {
-	return s.store.Save(r, w, s)
+	if headersWritten(w) {
+		return ErrHeadersWritten
+	}
+	if err := checkDomain(r, s); err != nil {
+		return err
+	}
+	if err := s.store.Save(r, w, s); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
 }
 
 // Name returns the name used to register the session.
@@ -107,92 +626,837 @@ func (s *Session) Store() Store {
 	return s.store
 }
 
+// GetValue returns the session value for the given key as a T.
+//
+// It returns false if the value is missing or isn't a T.
+func GetValue[T any](s *Session, key string) (T, bool) {
+	v, ok := s.Values[key].(T)
+	return v, ok
+}
+
+// SetValue sets the session value for the given key and marks the session
+// dirty.
+func SetValue[T any](s *Session, key string, v T) {
+	s.Set(key, v)
+}
+
 // Registry -------------------------------------------------------------------
 
 // sessionInfo stores a session tracked by the registry.
 type sessionInfo struct {
 	s *Session
 	e error
+	// seq is the registration order of the session.
+	seq uint64
+}
+
+// sessionKey identifies a session in the registry. Stores with different
+// identities get sessions of their own, even under the same name.
+type sessionKey struct {
+	store Store
+	name  string
 }
 
 // contextKey is the type used to store the registry in the context.
-type contextKey int
+type contextKey struct {
+	name string
+}
 
 // registryKey is the key used to store the registry in the context.
-const registryKey contextKey = 0
+//
+// It is a pointer, so it only equals itself: even vendored copies of this
+// package, or any other package using a zero value of some key type, can't
+// shadow or read the registry.
+var registryKey = &contextKey{"sessions registry"}
 
 // GetRegistry returns a registry instance for the current request.
+//
+// Requests derived from r, e.g. with r.WithContext, share its registry,
+// which keeps saving sessions with the request it was attached to. Use
+// ContextWithRegistry to point it at a request replacing r.
 func GetRegistry(r *http.Request) *Registry {
-	registry := r.Context().Value(registryKey)
-	if registry != nil {
-		return registry.(*Registry)
+	if registry, ok := r.Context().Value(registryKey).(*Registry); ok {
+		return registry
 	}
-	newRegistry := &Registry{
-		request:  r,
-		sessions: make(map[string]sessionInfo),
+	registry := newRegistry()
+	*r = *r.WithContext(context.WithValue(r.Context(), registryKey, registry))
+	registry.request = r
+	return registry
+}
+
+// ContextWithRegistry returns r with a registry attached to its context.
+//
+// If r already carries a registry, e.g. because r was derived from the
+// request the Middleware received, r is returned and the registry is
+// pointed at it: middleware replacing the request, e.g. with a new context
+// or body, calls it so sessions are saved with the current request rather
+// than a stale one.
+func ContextWithRegistry(r *http.Request) *http.Request {
+	if registry, ok := r.Context().Value(registryKey).(*Registry); ok {
+		registry.mu.Lock()
+		registry.request = r
+		registry.mu.Unlock()
+		return r
+	}
+	registry := newRegistry()
+	r = r.WithContext(context.WithValue(r.Context(), registryKey, registry))
+	registry.request = r
+	return r
+}
+
+// newRegistry returns an empty registry with the default limits.
+func newRegistry() *Registry {
+	return &Registry{
+		sessions:    make(map[sessionKey]sessionInfo),
+		maxSessions: MaxSessionsPerRequest,
 	}
-	*r = *r.WithContext(context.WithValue(r.Context(), registryKey, newRegistry))
-	return newRegistry
 }
 
 // Registry stores sessions used during a request.
+//
+// A Registry is safe for concurrent use, so goroutines spawned by a handler
+// can share the sessions of their request. Call GetRegistry once before
+// spawning them, since attaching the registry replaces the request context.
 type Registry struct {
 	request  *http.Request
-	sessions map[string]sessionInfo
+	mu       sync.RWMutex
+	sessions map[sessionKey]sessionInfo
+	seq      uint64
+	deleted  []*Session
+	// maxAge is the MaxAge set with SetMaxAge, if any.
+	maxAge *int
+	// maxSessions is the limit set with SetMaxSessions.
+	maxSessions int
+	// beforeSave holds the hooks added with BeforeSave.
+	beforeSave []func(name string, session *Session)
+	// multiplexed holds the sessions of the MultiplexedCookieStores as
+	// last written in the response.
+	multiplexed map[*MultiplexedCookieStore]multiplexedValues
+}
+
+// SessionOption configures a session loaded by Registry.Get.
+type SessionOption func(*sessionConfig)
+
+// sessionConfig holds the settings of SessionOptions.
+type sessionConfig struct {
+	options  *Options
+	forceNew bool
+	// loadOnly makes get skip registering a session the client doesn't
+	// have, see GetOrNil.
+	loadOnly bool
+}
+
+// WithOptions makes Get use a copy of options for the session instead of
+// the store defaults.
+func WithOptions(options *Options) SessionOption {
+	return func(c *sessionConfig) {
+		c.options = options
+	}
+}
+
+// WithForceNew makes Get ignore the cookie sent by the client, returning a
+// new session without decoding or loading it.
+func WithForceNew() SessionOption {
+	return func(c *sessionConfig) {
+		c.forceNew = true
+	}
 }
 
 // Get registers and returns a session for the given name and session store.
 //
-// It returns a new session if there are no sessions registered for the name.
-func (s *Registry) Get(store Store, name string) (session *Session, err error) {
+// It returns a new session if there are no sessions registered for the name
+// and store. Sessions are registered per store, so stores sharing a name
+// each get their own session; their cookies overwrite each other unless
+// their Path or Domain differ. It returns an error if the store is nil.
+//
+// The opts only apply when the session is loaded, and are ignored when it
+// was already registered by a previous call.
+func (s *Registry) Get(store Store, name string, opts ...SessionOption) (session *Session, err error) {
+	session, _, err = s.get(store, name, opts)
+	return
+}
+
+// GetExisting is like Get, but also reports whether the session was
+// already registered for the request, as opposed to loaded by this call.
+//
+// Unlike IsNew, which tells if the client sent the session, it is meant
+// for code that must initialize a session only once per request.
+func (s *Registry) GetExisting(store Store, name string, opts ...SessionOption) (*Session, bool, error) {
+	return s.get(store, name, opts)
+}
+
+// get implements Get and GetExisting.
+func (s *Registry) get(store Store, name string, opts []SessionOption) (session *Session, existed bool, err error) {
+	if store == nil {
+		return nil, false, fmt.Errorf("sessions: nil store for session %q", name)
+	}
 	if !isCookieNameValid(name) {
-		return nil, fmt.Errorf("sessions: invalid character in cookie name: %s", name)
+		return nil, false, fmt.Errorf("sessions: invalid character in cookie name: %s", name)
+	}
+	if MaxNameLength > 0 && len(name) > MaxNameLength {
+		return nil, false, fmt.Errorf("sessions: cookie name too long: %d bytes, the maximum is %d",
+			len(name), MaxNameLength)
+	}
+	if !reflect.TypeOf(store).Comparable() {
+		return nil, false, fmt.Errorf("sessions: store %T of session %q is not comparable, use a pointer", store, name)
+	}
+	key := sessionKey{store, name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := s.sessions[key]; ok {
+		return info.s, true, info.e
+	}
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return nil, false, fmt.Errorf("sessions: cannot register session %q, the maximum of %d sessions per request is reached",
+			name, s.maxSessions)
 	}
-	if info, ok := s.sessions[name]; ok {
-		session, err = info.s, info.e
+	var cfg sessionConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	r := s.request
+	if cfg.forceNew {
+		// Hide the cookies from the store so nothing is decoded.
+		clone := *r
+		clone.Header = r.Header.Clone()
+		clone.Header.Del("Cookie")
+		r = &clone
+	}
+	if cfg.loadOnly {
+		var ok bool
+		if loader, isLoader := store.(Loader); isLoader {
+			session, ok, err = loader.Load(r, name)
+		} else {
+			session, err = store.New(r, name)
+			ok = session != nil && !session.IsNew
+		}
+		if !ok || session == nil {
+			return nil, false, err
+		}
 	} else {
-		session, err = store.New(s.request, name)
-		session.name = name
-		s.sessions[name] = sessionInfo{s: session, e: err}
+		session, err = store.New(r, name)
+		if session == nil {
+			// Hand out an empty session rather than let a broken store
+			// crash the handler.
+			session = NewSession(store, name)
+			session.IsNew = true
+			if err == nil {
+				err = fmt.Errorf("sessions: store %T returned a nil session for %q", store, name)
+			}
+		}
 	}
+	session.name = name
+	// Stores wrapping others, like CachingStore or ShardedStore, get the
+	// session from the wrapped store, but it must be saved through them.
 	session.store = store
-	return
+	if cfg.options != nil {
+		session.Options = cfg.options.Clone()
+	}
+	if s.maxAge != nil {
+		session.Options = session.Options.Clone()
+		session.Options.MaxAge = *s.maxAge
+		session.dirty = true
+	}
+	s.seq++
+	s.sessions[key] = sessionInfo{s: session, e: err, seq: s.seq}
+	return session, false, err
+}
+
+// GetOrNil returns the session of the client for the given name and store,
+// registering it like Get. If the client has no valid session it returns
+// nil without registering anything, so nothing is saved for it.
+//
+// Stores implementing Loader are asked with Load, the others with New,
+// treating a new session as missing. An invalid cookie yields nil and the
+// error of the store.
+func (s *Registry) GetOrNil(store Store, name string) (*Session, error) {
+	session, _, err := s.get(store, name, []SessionOption{func(c *sessionConfig) {
+		c.loadOnly = true
+	}})
+	return session, err
+}
+
+// registered returns the registered sessions in name order, and in
+// registration order for sessions of different stores sharing a name. The
+// caller must hold s.mu.
+func (s *Registry) registered() []sessionInfo {
+	infos := make([]sessionInfo, 0, len(s.sessions))
+	for _, info := range s.sessions {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if a, b := infos[i].s.name, infos[j].s.name; a != b {
+			return a < b
+		}
+		return infos[i].seq < infos[j].seq
+	})
+	return infos
+}
+
+// sessionsOf returns the sessions of store registered for r, if r carries
+// a registry.
+func sessionsOf(r *http.Request, store Store) []*Session {
+	registry, ok := r.Context().Value(registryKey).(*Registry)
+	if !ok {
+		return nil
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	var sessions []*Session
+	for _, info := range registry.registered() {
+		if info.s.store == store {
+			sessions = append(sessions, info.s)
+		}
+	}
+	return sessions
+}
+
+// SetMaxSessions sets the maximum number of sessions the registry tracks.
+// Get fails for new names once it is reached, guarding against runaway
+// session creation bloating the response headers. It is unlimited when 0,
+// and defaults to MaxSessionsPerRequest.
+//
+// Sessions already registered are kept when n is lower than their number.
+func (s *Registry) SetMaxSessions(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSessions = n
+}
+
+// SetMaxAge sets the Options.MaxAge of all the sessions registered for the
+// current request, and of the sessions registered later in the request,
+// e.g. to shorten every session during a security event. The sessions are
+// marked dirty so the next Save applies it even with SkipUnmodified.
+//
+// The default Options of the stores are left untouched.
+func (s *Registry) SetMaxAge(age int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxAge = &age
+	for _, info := range s.sessions {
+		info.s.Options = info.s.Options.Clone()
+		info.s.Options.MaxAge = age
+		info.s.dirty = true
+	}
+}
+
+// BeforeSave adds a hook called with each session right before Save or
+// SaveOne persists it, to apply a policy to every session in one place,
+// e.g. stamping a last-seen time. The changes made by the hook are saved.
+//
+// Hooks run in the order they were added, and only for the sessions being
+// saved: sessions skipped by SkipUnmodified and deleted sessions are not
+// passed to them. Session.Save bypasses the registry and its hooks.
+func (s *Registry) BeforeSave(hook func(name string, session *Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeSave = append(s.beforeSave, hook)
+}
+
+// Sessions returns a snapshot of the sessions registered for the current
+// request, keyed by name. If several stores registered a name, the first
+// session registered under it is returned.
+//
+// Changing the returned map doesn't affect the registry, but the sessions
+// are the registered instances.
+func (s *Registry) Sessions() map[string]*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := make(map[string]*Session, len(s.sessions))
+	for _, info := range s.registered() {
+		if _, ok := sessions[info.s.name]; !ok {
+			sessions[info.s.name] = info.s
+		}
+	}
+	return sessions
+}
+
+// Delete removes the session registered for the given name.
+//
+// The next Save calls the Delete method of the session store, which expires
+// the cookie on the client and removes any server-side data. Calling Delete for a name
+// that isn't registered is a no-op. The sessions of all the stores sharing
+// the name are removed.
+func (s *Registry) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, info := range s.registered() {
+		if info.s.name == name {
+			delete(s.sessions, sessionKey{info.s.store, name})
+			s.deleted = append(s.deleted, info.s)
+		}
+	}
 }
 
 // Save saves all sessions registered for the current request.
+//
+// Sessions removed with Delete are saved first, so a new session registered
+// under the same name afterwards takes precedence on the client.
+//
+// The errors are collected in a MultiError, except when a single session is
+// registered: its error is then returned as is.
 func (s *Registry) Save(w http.ResponseWriter) error {
-	var errMulti MultiError
-	for name, info := range s.sessions {
-		session := info.s
-		if session.store == nil {
-			errMulti = append(errMulti, fmt.Errorf(
-				"sessions: missing store for session %q", name))
-		} else if err := session.store.Save(s.request, w, session); err != nil {
-			errMulti = append(errMulti, fmt.Errorf(
-				"sessions: error saving session %q -- %v", name, err))
+	if headersWritten(w) {
+		return ErrHeadersWritten
+	}
+	errMulti := s.saveDeleted(w)
+
+	// The Set-Cookie headers of the sessions are sorted by name so they are
+	// stable, even though two-phase and batch saves run after the others.
+	s.mu.RLock()
+	r := s.request
+	hooks := s.beforeSave
+	if len(s.sessions) == 1 && errMulti == nil {
+		var session *Session
+		for _, info := range s.sessions {
+			session = info.s
+		}
+		s.mu.RUnlock()
+		return saveSingle(r, w, session, hooks)
+	}
+	infos := s.registered()
+	s.mu.RUnlock()
+	if len(infos) > 0 {
+		varyCookie(w.Header())
+	}
+
+	first := len(w.Header()["Set-Cookie"])
+	names := make([]string, 0, len(infos))
+	var twoPhase []*Session
+	var savers []BatchSaver
+	batches := make(map[BatchSaver][]*Session)
+	for _, info := range infos {
+		name := info.s.name
+		names = append(names, name)
+		if !info.s.needsSave() {
+			continue
+		}
+		runBeforeSave(hooks, info.s)
+		if _, ok := info.s.store.(TwoPhaseSaver); ok {
+			twoPhase = append(twoPhase, info.s)
+			continue
+		}
+		if saver, ok := info.s.store.(BatchSaver); ok {
+			if _, ok := batches[saver]; !ok {
+				savers = append(savers, saver)
+			}
+			batches[saver] = append(batches[saver], info.s)
+			continue
+		}
+		if err := save(r, w, name, info.s); err != nil {
+			errMulti = append(errMulti, err)
+		}
+	}
+	errMulti = append(errMulti, saveTwoPhase(r, w, twoPhase)...)
+	for _, saver := range savers {
+		batch := batches[saver]
+		var err error
+		if len(batch) == 1 {
+			err = save(r, w, batch[0].name, batch[0])
+		} else {
+			err = saveBatch(r, w, saver, batch)
+		}
+		if errs, ok := err.(MultiError); ok {
+			errMulti = append(errMulti, errs...)
+		} else if err != nil {
+			errMulti = append(errMulti, err)
 		}
 	}
+	sortSetCookies(w.Header(), first)
+	dedupeSetCookies(w.Header(), names...)
 	if errMulti != nil {
 		return errMulti
 	}
 	return nil
 }
 
-// Helpers --------------------------------------------------------------------
+// SaveOne saves only the sessions registered under name, leaving the others
+// to a later Save. It returns an error if no session is registered under
+// name.
+func (s *Registry) SaveOne(w http.ResponseWriter, name string) error {
+	if headersWritten(w) {
+		return ErrHeadersWritten
+	}
+	s.mu.RLock()
+	r := s.request
+	hooks := s.beforeSave
+	var sessions []*Session
+	for _, info := range s.registered() {
+		if info.s.name == name {
+			sessions = append(sessions, info.s)
+		}
+	}
+	s.mu.RUnlock()
+	if len(sessions) == 0 {
+		return fmt.Errorf("sessions: no session registered under %q", name)
+	}
+	varyCookie(w.Header())
+	var err error
+	for _, session := range sessions {
+		runBeforeSave(hooks, session)
+		if errSave := save(r, w, name, session); err == nil {
+			err = errSave
+		}
+	}
+	dedupeSetCookies(w.Header(), name)
+	return err
+}
+
+// varyCookie adds "Cookie" to the Vary header of h if VaryCookie is set,
+// unless it is already listed.
+func varyCookie(h http.Header) {
+	if !VaryCookie {
+		return
+	}
+	values := h["Vary"]
+	for _, v := range values {
+		// Cut rather than Split so the common case doesn't allocate.
+		for v != "" {
+			var field string
+			field, v, _ = strings.Cut(v, ",")
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, "Cookie") {
+				return
+			}
+		}
+	}
+	if len(values) == 0 {
+		h.Set("Vary", "Cookie")
+		return
+	}
+	values[len(values)-1] += ", Cookie"
+}
+
+// dedupeSetCookies drops the Set-Cookie headers of the named cookies that
+// are overridden by a later header for the same cookie, so saving sessions
+// more than once in a request doesn't send duplicates. Cookies with the
+// same name but another Path or Domain are distinct and kept.
+func dedupeSetCookies(h http.Header, names ...string) {
+	headers := h["Set-Cookie"]
+	if len(headers) < 2 {
+		return
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	seen := make(map[setCookieKey]bool)
+	kept := make([]string, 0, len(headers))
+	// Walk backwards so the last header of each cookie wins.
+	for i := len(headers) - 1; i >= 0; i-- {
+		key, ok := parseSetCookieKey(headers[i])
+		if ok && wanted[key.name] {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		kept = append(kept, headers[i])
+	}
+	if len(kept) == len(headers) {
+		return
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	h["Set-Cookie"] = kept
+}
+
+// sortSetCookies sorts the Set-Cookie headers from index first on by
+// cookie name, keeping the order of the headers of each cookie.
+func sortSetCookies(h http.Header, first int) {
+	headers := h["Set-Cookie"]
+	if len(headers)-first < 2 {
+		return
+	}
+	type named struct{ name, header string }
+	sorted := make([]named, 0, len(headers)-first)
+	for _, header := range headers[first:] {
+		key, _ := parseSetCookieKey(header)
+		sorted = append(sorted, named{key.name, header})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	for i, n := range sorted {
+		headers[first+i] = n.header
+	}
+}
+
+// setCookieKey identifies the cookie set by a Set-Cookie header.
+type setCookieKey struct {
+	name, path, domain string
+}
+
+// parseSetCookieKey returns the name, Path and Domain of a Set-Cookie
+// header.
+func parseSetCookieKey(header string) (setCookieKey, bool) {
+	parts := strings.Split(header, ";")
+	name, _, ok := strings.Cut(parts[0], "=")
+	if !ok {
+		return setCookieKey{}, false
+	}
+	key := setCookieKey{name: strings.TrimSpace(name)}
+	for _, attr := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch strings.ToLower(k) {
+		case "path":
+			key.path = v
+		case "domain":
+			key.domain = strings.ToLower(strings.TrimPrefix(v, "."))
+		}
+	}
+	return key, true
+}
+
+// saveDeleted deletes the sessions removed with Delete from their stores.
+func (s *Registry) saveDeleted(w http.ResponseWriter) MultiError {
+	s.mu.Lock()
+	r := s.request
+	deleted := s.deleted
+	s.deleted = nil
+	s.mu.Unlock()
+
+	if len(deleted) > 0 {
+		varyCookie(w.Header())
+	}
+	var errMulti MultiError
+	for _, session := range deleted {
+		if err := deleteSession(r, w, session.name, session); err != nil {
+			errMulti = append(errMulti, err)
+		}
+	}
+	return errMulti
+}
 
-func init() {
-	gob.Register([]interface{}{})
+// save saves a single session registered under name.
+//
+// A panic in the store is recovered and returned as an error, so it doesn't
+// prevent the remaining sessions from being saved.
+func save(r *http.Request, w http.ResponseWriter, name string, session *Session) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("sessions: panic saving session %q -- %v", name, p)
+		}
+	}()
+	if session.store == nil {
+		return fmt.Errorf("sessions: missing store for session %q", name)
+	}
+	if err := checkDomain(r, session); err != nil {
+		return fmt.Errorf("sessions: error saving session %q -- %w", name, err)
+	}
+	if err := session.store.Save(r, w, session); err != nil {
+		return fmt.Errorf("sessions: error saving session %q -- %w", name, err)
+	}
+	session.dirty = false
+	return nil
 }
 
+// saveSingle implements Registry.Save for the common case of a request with
+// a single session, skipping the ordering and batching of several sessions.
+func saveSingle(r *http.Request, w http.ResponseWriter, session *Session,
+	hooks []func(string, *Session)) error {
+	varyCookie(w.Header())
+	var err error
+	if session.needsSave() {
+		runBeforeSave(hooks, session)
+		if _, ok := session.store.(TwoPhaseSaver); ok {
+			if errs := saveTwoPhase(r, w, []*Session{session}); errs != nil {
+				err = errs[0]
+			}
+		} else {
+			err = save(r, w, session.name, session)
+		}
+	}
+	dedupeSetCookies(w.Header(), session.name)
+	return err
+}
+
+// runBeforeSave calls the BeforeSave hooks with a session about to be
+// saved.
+func runBeforeSave(hooks []func(string, *Session), session *Session) {
+	for _, hook := range hooks {
+		hook(session.name, session)
+	}
+}
+
+// saveTwoPhase saves the sessions of TwoPhaseSaver stores, committing them
+// only if all of them were prepared.
+func saveTwoPhase(r *http.Request, w http.ResponseWriter, sessions []*Session) MultiError {
+	var errMulti MultiError
+	commits := make([]func(http.ResponseWriter) error, len(sessions))
+	for i, session := range sessions {
+		commit, err := prepare(r, session)
+		if err != nil {
+			errMulti = append(errMulti, err)
+		}
+		commits[i] = commit
+	}
+	if errMulti != nil {
+		return errMulti
+	}
+	for i, session := range sessions {
+		if err := commits[i](w); err != nil {
+			errMulti = append(errMulti,
+				fmt.Errorf("sessions: error saving session %q -- %w", session.name, err))
+			continue
+		}
+		session.dirty = false
+	}
+	return errMulti
+}
+
+// prepare prepares the save of a session of a TwoPhaseSaver, recovering
+// panics like save.
+func prepare(r *http.Request, session *Session) (commit func(http.ResponseWriter) error, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("sessions: panic preparing session %q -- %v", session.name, p)
+		}
+	}()
+	if err := checkDomain(r, session); err != nil {
+		return nil, fmt.Errorf("sessions: error preparing session %q -- %w", session.name, err)
+	}
+	commit, err = session.store.(TwoPhaseSaver).Prepare(r, session)
+	if err != nil {
+		return nil, fmt.Errorf("sessions: error preparing session %q -- %w", session.name, err)
+	}
+	return commit, nil
+}
+
+// saveBatch saves several sessions of the same store with SaveAll.
+//
+// The sessions stay dirty if SaveAll fails, since it can't tell which of
+// them were saved.
+func saveBatch(r *http.Request, w http.ResponseWriter, saver BatchSaver, sessions []*Session) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("sessions: panic saving %d sessions -- %v", len(sessions), p)
+		}
+	}()
+	for _, session := range sessions {
+		if err := checkDomain(r, session); err != nil {
+			return fmt.Errorf("sessions: error saving session %q -- %w", session.name, err)
+		}
+	}
+	if err := saver.SaveAll(r, w, sessions); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		session.dirty = false
+	}
+	return nil
+}
+
+// deleteSession deletes a single session registered under name.
+func deleteSession(r *http.Request, w http.ResponseWriter, name string, session *Session) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("sessions: panic deleting session %q -- %v", name, p)
+		}
+	}()
+	if session.store == nil {
+		return fmt.Errorf("sessions: missing store for session %q", name)
+	}
+	if err := session.store.Delete(r, w, session); err != nil {
+		return fmt.Errorf("sessions: error deleting session %q -- %w", name, err)
+	}
+	return nil
+}
+
+// Helpers --------------------------------------------------------------------
+
 // Save saves all sessions used during the current request.
+//
+// It returns ErrNoRegistry if the request doesn't carry a registry, which
+// means no session was retrieved with it and Middleware isn't installed.
 func Save(r *http.Request, w http.ResponseWriter) error {
+	if _, ok := r.Context().Value(registryKey).(*Registry); !ok {
+		return ErrNoRegistry
+	}
 	return GetRegistry(r).Save(w)
 }
 
+// SaveOne saves only the session named name used during the current
+// request, see Registry.SaveOne.
+func SaveOne(r *http.Request, w http.ResponseWriter, name string) error {
+	if _, ok := r.Context().Value(registryKey).(*Registry); !ok {
+		return ErrNoRegistry
+	}
+	return GetRegistry(r).SaveOne(w, name)
+}
+
+// FromContext returns the session for the given name and store from the
+// registry stored in ctx, which is usually a request context.
+//
+// It returns ErrNoRegistry if ctx doesn't carry a registry, e.g. because
+// the request didn't go through Middleware.
+func FromContext(ctx context.Context, store Store, name string) (*Session, error) {
+	registry, ok := ctx.Value(registryKey).(*Registry)
+	if !ok {
+		return nil, ErrNoRegistry
+	}
+	return registry.Get(store, name)
+}
+
+// Delete deletes the session registered for the given name during the
+// current request from its store, which expires the cookie on the client
+// and removes any server-side data.
+//
+// It is a no-op if there is no session registered for the name.
+func Delete(r *http.Request, w http.ResponseWriter, name string) error {
+	if headersWritten(w) {
+		return ErrHeadersWritten
+	}
+	registry := GetRegistry(r)
+	registry.Delete(name)
+	if errMulti := registry.saveDeleted(w); errMulti != nil {
+		return errMulti
+	}
+	return nil
+}
+
+// expireCookie emits a cookie deleting the session on the client.
+func expireCookie(w http.ResponseWriter, session *Session) {
+	opts := *session.Options
+	opts.MaxAge = -1
+	session.cookieValue = ""
+	writeCookie(w, NewCookie(session.Name(), "", &opts), &opts)
+}
+
+// setCookie emits the cookie of session holding value.
+func setCookie(w http.ResponseWriter, session *Session, value string, now time.Time) {
+	session.cookieValue = value
+	writeCookie(w, newCookie(session.Name(), value, session.Options, now), session.Options)
+}
+
+// writeCookie adds the Set-Cookie header of cookie to w, like
+// http.SetCookie, with the Partitioned attribute if options set it.
+//
+// The attribute is appended by hand, as http.Cookie only has it from Go
+// 1.23.
+func writeCookie(w http.ResponseWriter, cookie *http.Cookie, options *Options) {
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	if options.Partitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
+
 // NewCookie returns an http.Cookie with the options set. It also sets
 // the Expires field calculated based on the MaxAge value, for Internet
 // Explorer compatibility.
+//
+// Options.Partitioned isn't set on the cookie, as http.Cookie only supports
+// it from Go 1.23: stores append the attribute to the Set-Cookie header.
 func NewCookie(name, value string, options *Options) *http.Cookie {
+	return newCookie(name, value, options, time.Now())
+}
+
+// newCookie is NewCookie computing Expires from now.
+func newCookie(name, value string, options *Options, now time.Time) *http.Cookie {
 	cookie := &http.Cookie{
 		Name:     name,
 		Value:    value,
@@ -201,10 +1465,11 @@ func NewCookie(name, value string, options *Options) *http.Cookie {
 		MaxAge:   options.MaxAge,
 		Secure:   options.Secure,
 		HttpOnly: options.HttpOnly,
+		SameSite: options.SameSite,
 	}
 	if options.MaxAge > 0 {
 		d := time.Duration(options.MaxAge) * time.Second
-		cookie.Expires = time.Now().Add(d)
+		cookie.Expires = now.Add(d)
 	} else if options.MaxAge < 0 {
 		// Set it to the past to expire now.
 		cookie.Expires = time.Unix(1, 0)
@@ -212,8 +1477,135 @@ func NewCookie(name, value string, options *Options) *http.Cookie {
 	return cookie
 }
 
+// clock returns the current time from now, or time.Now if now is nil.
+//
+// Stores and codecs keep an unexported now field, nil outside of tests, so
+// tests can move time forward to check expiry.
+func clock(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
+
+// checkCookie validates the cookie options of a session before it is saved.
+//
+// Cookies named with a __Secure- or __Host- prefix must be Secure, and
+// __Host- cookies must also have Path=/ and no Domain, or browsers reject
+// them.
+func checkCookie(name string, options *Options) error {
+	if options.SameSite == http.SameSiteNoneMode && !options.Secure {
+		if !options.AutoSecure {
+			return fmt.Errorf("sessions: cookie %q has SameSite=None but is not Secure", name)
+		}
+		options.Secure = true
+	}
+	if options.Partitioned && !options.Secure {
+		if !options.AutoSecure {
+			return fmt.Errorf("sessions: cookie %q is Partitioned but is not Secure", name)
+		}
+		options.Secure = true
+	}
+	if options.StoreTTL < 0 {
+		return fmt.Errorf("sessions: cookie %q has a negative StoreTTL %d", name, options.StoreTTL)
+	}
+	host := strings.HasPrefix(name, "__Host-")
+	if (host || strings.HasPrefix(name, "__Secure-")) && !options.Secure {
+		if !options.AutoSecure {
+			return fmt.Errorf("sessions: cookie %q has a secure prefix but is not Secure", name)
+		}
+		options.Secure = true
+	}
+	if host && options.Domain != "" {
+		return fmt.Errorf("sessions: cookie %q has the __Host- prefix but sets Domain %q", name, options.Domain)
+	}
+	if host && options.Path != "/" {
+		return fmt.Errorf("sessions: cookie %q has the __Host- prefix but Path %q is not /", name, options.Path)
+	}
+	return nil
+}
+
+// checkDomain checks the Options.Domain of session against the host of r,
+// as configured by Options.DomainCheck.
+func checkDomain(r *http.Request, session *Session) error {
+	opts := session.Options
+	if opts == nil || opts.DomainCheck == DomainCheckOff || opts.Domain == "" {
+		return nil
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain := strings.ToLower(strings.TrimPrefix(session.Options.Domain, "."))
+	if host == "" || host == domain || strings.HasSuffix(host, "."+domain) {
+		return nil
+	}
+	if opts.DomainCheck == DomainCheckWarn {
+		if opts.DomainCheckLogger != nil {
+			opts.DomainCheckLogger.LogAttrs(r.Context(), slog.LevelWarn, ErrDomainMismatch.Error(),
+				slog.String("session", session.name), slog.String("domain", opts.Domain),
+				slog.String("host", host))
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: session %q has Domain %q but the host is %q",
+		ErrDomainMismatch, session.name, session.Options.Domain, host)
+}
+
 // Error ----------------------------------------------------------------------
 
+// ErrHeadersWritten is returned when saving sessions after the response
+// headers were sent, which would silently drop the session cookies.
+//
+// It can only be detected for response writers wrapped by Middleware.
+var ErrHeadersWritten = errors.New(
+	"sessions: response headers already written, cookies would be lost")
+
+// ErrDomainMismatch is returned by Save when the Options.Domain of a
+// session doesn't match the host of the request, see Options.DomainCheck.
+var ErrDomainMismatch = errors.New("sessions: cookie Domain doesn't match the request host")
+
+// FingerprintFunc returns a fingerprint of the client making r, e.g. built
+// from its User-Agent and IP prefix.
+//
+// Stores with a FingerprintFunc keep the fingerprint in the session and
+// compare it on New: a session sent by a client with another fingerprint
+// is discarded and New returns a new session with ErrFingerprintMismatch.
+// This makes stolen cookies harder to use, at the price of logging out
+// users whose fingerprint changes, e.g. on a browser update or a network
+// change, so only use stable inputs.
+//
+// The fingerprint is stored in the session Values, which the client can
+// read unless the cookies are encrypted: hash it with a secret salt, e.g.
+// with HMAC-SHA256, rather than storing IP addresses and other personal
+// data in clear. Even hashed, a fingerprint derived from an IP address may
+// be personal data under privacy regulations.
+type FingerprintFunc func(r *http.Request) string
+
+// PathFunc returns the cookie Path of the sessions loaded for r, e.g. the
+// prefix of the tenant r is for in an app serving tenants under
+// "/tenant-a", "/tenant-b" and so on, so their cookies don't leak to each
+// other. Stores call it on New; the session keeps the path, so Save emits
+// the cookie with it. An empty path leaves Options.Path unchanged.
+type PathFunc func(r *http.Request) string
+
+// ErrFingerprintMismatch is returned by New when the fingerprint of a
+// session doesn't match the client, see FingerprintFunc.
+var ErrFingerprintMismatch = errors.New("sessions: session fingerprint mismatch")
+
+// ErrNoRegistry is returned when a context doesn't carry a registry.
+var ErrNoRegistry = errors.New(
+	"sessions: no registry in request context; did you install the middleware?")
+
+// headersWritten reports whether w is known to have sent its headers.
+func headersWritten(w http.ResponseWriter) bool {
+	hw, ok := w.(interface {
+		headersWritten() bool
+	})
+	return ok && hw.headersWritten()
+}
+
 // MultiError stores multiple errors.
 //
 // Borrowed from the App Engine SDK.
@@ -239,3 +1631,8 @@ func (m MultiError) Error() string {
 	}
 	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
 }
+
+// Unwrap returns the errors, so errors.Is and errors.As match any of them.
+func (m MultiError) Unwrap() []error {
+	return m
+}
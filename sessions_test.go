@@ -6,10 +6,20 @@ package sessions
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // NewRecorder returns an initialized ResponseRecorder.
@@ -158,3 +168,1436 @@ func TestFlashes(t *testing.T) {
 func init() {
 	gob.Register(FlashMessage{})
 }
+
+func TestNewSessionOptions(t *testing.T) {
+	session := NewSession(NewCookieStore(), "hello")
+	if session.Options == nil {
+		t.Fatal("expected default options, got nil")
+	}
+	if session.Options.Path != "/" {
+		t.Errorf("bad default path: got %q, want %q", session.Options.Path, "/")
+	}
+	if session.Options.MaxAge != 0 {
+		t.Errorf("bad default max age: got %d, want 0", session.Options.MaxAge)
+	}
+}
+
+func TestValuesSharedWithinRequest(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Values["user_id"] = 42
+
+	again, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if again != session {
+		t.Fatal("Expected the same session instance")
+	}
+	if v := again.Values["user_id"]; v != 42 {
+		t.Errorf("Expected user_id 42; Got %v", v)
+	}
+}
+
+func TestFlashesClearedOnSave(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := NewRecorder()
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.AddFlash("saved!")
+	if err = Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Reading the flashes and saving must persist the cleared state.
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	rsp = NewRecorder()
+	if session, err = store.Get(req, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if flashes := session.Flashes(); len(flashes) != 1 || flashes[0] != "saved!" {
+		t.Fatalf("Expected [saved!]; Got %v", flashes)
+	}
+	if err = Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	if session, err = store.Get(req, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if flashes := session.Flashes(); len(flashes) != 0 {
+		t.Errorf("Expected no flashes; Got %v", flashes)
+	}
+}
+
+func TestRegistryConcurrentGet(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	registry := GetRegistry(req)
+
+	const n = 50
+	results := make(chan *Session, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := store.Get(req, "same-name")
+			if err != nil {
+				t.Errorf("Error getting session: %v", err)
+			}
+			results <- session
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := registry.Save(NewRecorder()); err != nil {
+			t.Errorf("Error saving sessions: %v", err)
+		}
+	}()
+	wg.Wait()
+	close(results)
+
+	first := <-results
+	for session := range results {
+		if session != first {
+			t.Fatal("Expected a single shared session")
+		}
+	}
+}
+
+func TestRegistryGetStoreMismatch(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	other := NewCookieStore([]byte("other-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Same store: the cached session is returned.
+	again, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if again != session {
+		t.Error("Expected the cached session")
+	}
+
+	// Different store: it gets a session of its own.
+	otherSession, err := other.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if otherSession == session || otherSession.Store() != other {
+		t.Error("Expected a session of the other store")
+	}
+	if session.Store() != store {
+		t.Error("Expected the session to keep its original store")
+	}
+	if again, _ = other.Get(req, "session-key"); again != otherSession {
+		t.Error("Expected the cached session of the other store")
+	}
+}
+
+// testStore is a minimal Store built the way external stores are: only
+// through the exported API.
+type testStore struct {
+	saved   []string
+	deleted []string
+}
+
+func (s *testStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+func (s *testStore) New(r *http.Request, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.IsNew = true
+	return session, nil
+}
+
+func (s *testStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	s.saved = append(s.saved, session.Name())
+	return nil
+}
+
+func (s *testStore) Delete(r *http.Request, w http.ResponseWriter, session *Session) error {
+	s.deleted = append(s.deleted, session.Name())
+	return nil
+}
+
+func TestNewSessionCustomStore(t *testing.T) {
+	store := &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	session, err := store.Get(req, "custom")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if session.Name() != "custom" || session.Store() != store {
+		t.Errorf("Expected session bound to %q and the custom store", "custom")
+	}
+	session.Values["foo"] = "bar"
+	if err = Save(req, NewRecorder()); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if len(store.saved) != 1 || store.saved[0] != "custom" {
+		t.Errorf("Expected the custom session to be saved; Got %v", store.saved)
+	}
+}
+
+func TestRegistryDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFilesystemStore(dir, []byte("secret-key"))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := NewRecorder()
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if err = Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	filename := filepath.Join(dir, "session_"+session.ID)
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	rsp = NewRecorder()
+	if _, err = store.Get(req, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	registry := GetRegistry(req)
+	registry.Delete("session-key")
+	registry.Delete("unknown")
+	if err = registry.Save(rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+
+	cookies := rsp.Header()["Set-Cookie"]
+	if len(cookies) != 1 || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Fatalf("Expected an expiring cookie; Got %v", cookies)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("Expected the session file to be removed")
+	}
+
+	// A new session can be registered under the same name.
+	again, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if again == session || !again.IsNew {
+		t.Error("Expected a new session after Delete")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := NewRecorder()
+	if _, err := store.Get(req, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if err := Delete(req, rsp, "session-key"); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	cookies := rsp.Header()["Set-Cookie"]
+	if len(cookies) != 1 || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Fatalf("Expected an expiring cookie; Got %v", cookies)
+	}
+
+	// Nothing left to save.
+	rsp = NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if cookies := rsp.Header()["Set-Cookie"]; len(cookies) != 0 {
+		t.Errorf("Expected no cookies; Got %v", cookies)
+	}
+}
+
+func TestRegistrySessions(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	one, _ := store.Get(req, "session-one")
+	two, _ := store.Get(req, "session-two")
+
+	registry := GetRegistry(req)
+	sessions := registry.Sessions()
+	if len(sessions) != 2 || sessions["session-one"] != one || sessions["session-two"] != two {
+		t.Fatalf("Expected both sessions; Got %v", sessions)
+	}
+
+	delete(sessions, "session-one")
+	if len(registry.Sessions()) != 2 {
+		t.Error("Expected the registry to be unaffected by changes to the snapshot")
+	}
+}
+
+// panicStore is a Store whose Save panics.
+type panicStore struct {
+	testStore
+}
+
+func (s *panicStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+func (s *panicStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	panic("boom")
+}
+
+func TestRegistrySaveRecoversPanic(t *testing.T) {
+	first, broken, last := &testStore{}, &panicStore{}, &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	first.Get(req, "session-one")
+	broken.Get(req, "session-two")
+	last.Get(req, "session-three")
+
+	err := Save(req, NewRecorder())
+	errMulti, ok := err.(MultiError)
+	if !ok || len(errMulti) != 1 {
+		t.Fatalf("Expected a MultiError with one error; Got %v", err)
+	}
+	if !strings.Contains(errMulti[0].Error(), `panic saving session "session-two" -- boom`) {
+		t.Errorf("Expected the recovered panic; Got %v", errMulti[0])
+	}
+	if len(first.saved) != 1 || len(last.saved) != 1 {
+		t.Errorf("Expected the other sessions to be saved; Got %v and %v", first.saved, last.saved)
+	}
+}
+
+// storeError is an error type returned by errorStore.
+type storeError struct {
+	code int
+}
+
+func (e *storeError) Error() string { return fmt.Sprintf("store error %d", e.code) }
+
+var errStoreDown = errors.New("store down")
+
+// errorStore is a Store whose Save returns a fixed error.
+type errorStore struct {
+	testStore
+	err error
+}
+
+func (s *errorStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+func (s *errorStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	return s.err
+}
+
+func TestRegistrySaveSingleError(t *testing.T) {
+	store := &errorStore{err: errStoreDown}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	store.Get(req, "session-key")
+
+	err := Save(req, NewRecorder())
+	if _, ok := err.(MultiError); ok {
+		t.Fatalf("Expected the error of the single session; Got a MultiError %v", err)
+	}
+	if !errors.Is(err, errStoreDown) || !strings.Contains(err.Error(), `error saving session "session-key"`) {
+		t.Errorf("Expected the wrapped store error; Got %v", err)
+	}
+
+	(&testStore{}).Get(req, "session-other")
+	if _, ok := Save(req, NewRecorder()).(MultiError); !ok {
+		t.Error("Expected a MultiError with several sessions")
+	}
+}
+
+func TestMultiErrorUnwrap(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	(&errorStore{err: errStoreDown}).Get(req, "session-one")
+	(&errorStore{err: &storeError{code: 42}}).Get(req, "session-two")
+	(&testStore{}).Get(req, "session-three")
+
+	err := Save(req, NewRecorder())
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !errors.Is(err, errStoreDown) {
+		t.Errorf("Expected errors.Is to match the store error; Got %v", err)
+	}
+	var se *storeError
+	if !errors.As(err, &se) || se.code != 42 {
+		t.Errorf("Expected errors.As to find the typed store error; Got %v", err)
+	}
+	if errors.Is(err, ErrHeadersWritten) {
+		t.Error("Expected errors.Is not to match an unrelated error")
+	}
+	if !strings.HasSuffix(err.Error(), "(and 1 other error)") {
+		t.Errorf("Expected the usual error message; Got %q", err)
+	}
+}
+
+func TestContextWithRegistryRefreshesRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	req = ContextWithRegistry(req)
+	registry := GetRegistry(req)
+	if registry.request != req {
+		t.Fatal("Expected the registry to use the request")
+	}
+
+	type key struct{}
+	sub := req.WithContext(context.WithValue(req.Context(), key{}, "value"))
+	if GetRegistry(sub) != registry {
+		t.Fatal("Expected the derived request to share the registry")
+	}
+	if registry.request != req {
+		t.Error("Expected GetRegistry to keep the request of the registry")
+	}
+	if ContextWithRegistry(sub) != sub || registry.request != sub {
+		t.Error("Expected the registry to use the derived request")
+	}
+}
+
+func TestCookieNameLength(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	name := strings.Repeat("n", MaxNameLength)
+	if _, err := store.Get(req, name); err != nil {
+		t.Fatalf("Expected a name of %d bytes to be valid; Got %v", MaxNameLength, err)
+	}
+	_, err := store.Get(req, name+"n")
+	if err == nil {
+		t.Fatal("Expected an error for a long name")
+	}
+	if want := fmt.Sprintf("sessions: cookie name too long: %d bytes, the maximum is %d",
+		MaxNameLength+1, MaxNameLength); err.Error() != want {
+		t.Errorf("Expected %q; Got %q", want, err)
+	}
+}
+
+func TestMaxSessionsPerRequest(t *testing.T) {
+	defer func(max int) { MaxSessionsPerRequest = max }(MaxSessionsPerRequest)
+	MaxSessionsPerRequest = 2
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := store.Get(req, name); err != nil {
+			t.Fatalf("Error getting session %s: %v", name, err)
+		}
+	}
+	// Registered sessions are still returned.
+	if _, err := store.Get(req, "a"); err != nil {
+		t.Fatalf("Error getting registered session: %v", err)
+	}
+	_, err := store.Get(req, "c")
+	if err == nil {
+		t.Fatal("Expected an error past the limit")
+	}
+	if want := `sessions: cannot register session "c", the maximum of 2 sessions per request is reached`; err.Error() != want {
+		t.Errorf("Expected %q; Got %q", want, err)
+	}
+}
+
+func TestRegistrySetMaxSessions(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	GetRegistry(req).SetMaxSessions(1)
+	if _, err := store.Get(req, "a"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if _, err := store.Get(req, "b"); err == nil {
+		t.Fatal("Expected an error past the limit")
+	}
+
+	// Other registries keep the default.
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	for _, name := range []string{"a", "b"} {
+		if _, err := store.Get(req, name); err != nil {
+			t.Fatalf("Error getting session %s: %v", name, err)
+		}
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	if _, err := FromContext(context.Background(), store, "session-key"); err != ErrNoRegistry {
+		t.Fatalf("Expected ErrNoRegistry; Got %v", err)
+	}
+
+	var session *Session
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if session, err = FromContext(r.Context(), store, "session-key"); err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		if again, _ := store.Get(r, "session-key"); again != session {
+			t.Error("Expected FromContext to use the request registry")
+		}
+	}))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	handler.ServeHTTP(NewRecorder(), req)
+	if session == nil {
+		t.Fatal("Expected a session")
+	}
+}
+
+func TestSkipUnmodified(t *testing.T) {
+	store := &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Options.SkipUnmodified = true
+
+	if session.IsDirty() {
+		t.Fatal("Expected a clean session")
+	}
+	if err = Save(req, NewRecorder()); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if len(store.saved) != 0 {
+		t.Fatalf("Expected the clean session to be skipped; Got %v", store.saved)
+	}
+
+	session.Set("foo", "bar")
+	if !session.IsDirty() || session.Get("foo") != "bar" {
+		t.Fatal("Expected Set to mark the session dirty")
+	}
+	if err = Save(req, NewRecorder()); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if len(store.saved) != 1 || session.IsDirty() {
+		t.Fatalf("Expected the dirty session to be saved once; Got %v", store.saved)
+	}
+
+	// Direct writes aren't tracked unless marked.
+	session.Values["baz"] = "qux"
+	Save(req, NewRecorder())
+	session.MarkDirty()
+	Save(req, NewRecorder())
+	if len(store.saved) != 2 {
+		t.Fatalf("Expected MarkDirty to force a save; Got %v", store.saved)
+	}
+
+	session.AddFlash("hello")
+	if !session.IsDirty() {
+		t.Error("Expected AddFlash to mark the session dirty")
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	store := &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	fixed, _ := store.Get(req, "fixed")
+	fixed.Options.SkipUnmodified = true
+	sliding, _ := store.Get(req, "sliding")
+	sliding.Options.SkipUnmodified = true
+	sliding.Options.SlidingExpiration = true
+
+	for i := 0; i < 2; i++ {
+		if err := Save(req, NewRecorder()); err != nil {
+			t.Fatalf("Error saving sessions: %v", err)
+		}
+	}
+	if len(store.saved) != 2 || store.saved[0] != "sliding" || store.saved[1] != "sliding" {
+		t.Errorf("Expected only the sliding session to be saved on each Save; Got %v", store.saved)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	session := NewSession(nil, "hello")
+	SetValue(session, "user_id", 42)
+	if !session.IsDirty() {
+		t.Error("Expected SetValue to mark the session dirty")
+	}
+
+	if v, ok := GetValue[int](session, "user_id"); !ok || v != 42 {
+		t.Errorf("Expected 42; Got %v, %v", v, ok)
+	}
+	if v, ok := GetValue[string](session, "user_id"); ok || v != "" {
+		t.Errorf("Expected a type mismatch; Got %q, %v", v, ok)
+	}
+	if v, ok := GetValue[int](session, "missing"); ok || v != 0 {
+		t.Errorf("Expected a missing value; Got %v, %v", v, ok)
+	}
+}
+
+func TestPerSessionOptions(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rsp := NewRecorder()
+
+	app, _ := store.Get(req, "app")
+	app.Options.Domain = "example.com"
+	app.Options.SameSite = http.SameSiteStrictMode
+	widget, _ := store.Get(req, "widget")
+	widget.Options.Domain = "widget.example.com"
+	widget.Options.SameSite = http.SameSiteNoneMode
+	widget.Options.Secure = true
+
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rsp.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if c := cookies["app"]; c == nil || c.Domain != "example.com" || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Bad app cookie: %#v", c)
+	}
+	if c := cookies["widget"]; c == nil || c.Domain != "widget.example.com" || c.SameSite != http.SameSiteNoneMode {
+		t.Errorf("Bad widget cookie: %#v", c)
+	}
+	if store.Options.Domain != "" || store.Options.SameSite != 0 {
+		t.Errorf("Expected the store defaults to be unaffected; Got %#v", store.Options)
+	}
+}
+
+func TestAbsoluteTimeout(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	store.Options.AbsoluteTimeout = 3600
+	store.Options.SlidingExpiration = true
+
+	save := func(created time.Time) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		session, _ := store.New(req, "hello")
+		session.Values["foo"] = "bar"
+		if !created.IsZero() {
+			session.Values[createdKey] = created.Unix()
+		}
+		rsp := NewRecorder()
+		if err := session.Save(req, rsp); err != nil {
+			t.Fatalf("Error saving session: %v", err)
+		}
+		req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+		return req
+	}
+
+	session, err := store.New(save(time.Time{}), "hello")
+	if err != nil {
+		t.Fatalf("Error decoding session: %v", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Errorf("Expected a session within the timeout to be kept; Got %v", session.Values)
+	}
+	if _, ok := session.Created(); !ok {
+		t.Error("Expected the creation time to be recorded")
+	}
+
+	session, err = store.New(save(time.Now().Add(-2*time.Hour)), "hello")
+	if err != nil {
+		t.Fatalf("Error decoding session: %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("Expected an expired session to be discarded; Got IsNew=%v %v", session.IsNew, session.Values)
+	}
+}
+
+func TestAbsoluteTimeoutFutureCreation(t *testing.T) {
+	store := NewMemoryStore()
+	store.Options.AbsoluteTimeout = 3600
+	save := func(created time.Time) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		session, _ := store.New(req, "hello")
+		session.Values["foo"] = "bar"
+		session.Values[createdKey] = created.Unix()
+		rsp := NewRecorder()
+		if err := session.Save(req, rsp); err != nil {
+			t.Fatalf("Error saving session: %v", err)
+		}
+		req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+		return req
+	}
+
+	session, err := store.New(save(time.Now().Add(time.Minute)), "hello")
+	if err != nil {
+		t.Fatalf("Error decoding session within the allowed skew: %v", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Errorf("Expected a session within the allowed skew to be kept; Got %v", session.Values)
+	}
+
+	session, err = store.New(save(time.Now().AddDate(10, 0, 0)), "hello")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected ErrInvalidCookie; Got %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("Expected a fresh session; Got IsNew=%v %v", session.IsNew, session.Values)
+	}
+
+	store.Options.MaxClockSkew = -1
+	if _, err = store.New(save(time.Now().AddDate(10, 0, 0)), "hello"); err != nil {
+		t.Errorf("Expected no error with the check disabled; Got %v", err)
+	}
+}
+
+func TestAbsoluteTimeoutDropsServerData(t *testing.T) {
+	store := NewMemoryStore()
+	store.Options.AbsoluteTimeout = 3600
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "hello")
+	session.Values[createdKey] = time.Now().Add(-2 * time.Hour).Unix()
+	rsp := NewRecorder()
+	if err := session.Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	oldID := session.ID
+
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	session, _ = store.New(req, "hello")
+	if !session.IsNew {
+		t.Fatal("Expected an expired session to be new")
+	}
+	if err := session.Save(req, NewRecorder()); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if session.ID == oldID {
+		t.Error("Expected the expired session to get a new ID")
+	}
+	if _, ok := store.sessions[oldID]; ok {
+		t.Error("Expected the expired session data to be dropped")
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	session := NewSession(nil, "hello")
+	if session.VerifyCSRF("") {
+		t.Error("Expected verification to fail without a token")
+	}
+
+	token := session.CSRFToken()
+	if token == "" {
+		t.Fatal("Expected a token")
+	}
+	if !session.IsDirty() {
+		t.Error("Expected generating a token to mark the session dirty")
+	}
+	if again := session.CSRFToken(); again != token {
+		t.Errorf("Expected the same token; Got %q and %q", token, again)
+	}
+	if !session.VerifyCSRF(token) {
+		t.Error("Expected the token to verify")
+	}
+	if session.VerifyCSRF(token[1:]) || session.VerifyCSRF("") {
+		t.Error("Expected a wrong token to fail verification")
+	}
+	if other := NewSession(nil, "hello").CSRFToken(); other == token {
+		t.Error("Expected distinct tokens for distinct sessions")
+	}
+}
+
+// vendoredKey mimics the registry key of another copy of this package.
+type vendoredKey int
+
+func TestRegistryContextKeyIsolation(t *testing.T) {
+	store := &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	other := &Registry{sessions: make(map[sessionKey]sessionInfo)}
+	req = req.WithContext(context.WithValue(req.Context(), vendoredKey(0), other))
+
+	registry := GetRegistry(req)
+	if registry == other {
+		t.Fatal("Expected a registry of its own")
+	}
+	if _, err := registry.Get(store, "hello"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if req.Context().Value(vendoredKey(0)) != other || len(other.sessions) != 0 {
+		t.Error("Expected the other registry to be left alone")
+	}
+	if GetRegistry(req) != registry {
+		t.Error("Expected the registry to be reused")
+	}
+}
+
+func TestSaveWithoutRegistry(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	err := Save(req, NewRecorder())
+	if !errors.Is(err, ErrNoRegistry) {
+		t.Fatalf("Expected ErrNoRegistry; Got %v", err)
+	}
+	if want := "did you install the middleware?"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected the error to mention the middleware; Got %q", err)
+	}
+}
+
+func TestSessionClear(t *testing.T) {
+	store := NewMemoryStore()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "hello")
+	session.Values["foo"] = "bar"
+	session.Options.SkipUnmodified = true
+	rsp := NewRecorder()
+	if err := session.Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	id := session.ID
+
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	session, _ = store.New(req, "hello")
+	session.Clear()
+	if len(session.Values) != 0 || !session.IsDirty() {
+		t.Fatalf("Expected empty dirty values; Got %v, dirty=%v", session.Values, session.IsDirty())
+	}
+	if session.ID != id || session.Name() != "hello" || session.Store() != store {
+		t.Error("Expected Clear to keep the session identity")
+	}
+	if err := session.Save(req, NewRecorder()); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	session, _ = store.New(req, "hello")
+	if session.IsNew || session.ID != id || len(session.Values) != 0 {
+		t.Errorf("Expected the cleared session to be persisted; Got IsNew=%v %v", session.IsNew, session.Values)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	userAgent := func(r *http.Request) string { return r.UserAgent() }
+	cookies := NewCookieStore([]byte("secret-key"))
+	cookies.Fingerprint = userAgent
+	memory := NewMemoryStore()
+	memory.Fingerprint = userAgent
+
+	for kind, store := range map[string]Store{"cookie": cookies, "memory": memory} {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		req.Header.Set("User-Agent", "browser/1.0")
+		session, _ := store.New(req, "hello")
+		session.Values["user"] = "alice"
+		rsp := NewRecorder()
+		if err := session.Save(req, rsp); err != nil {
+			t.Fatalf("%s: Error saving session: %v", kind, err)
+		}
+
+		req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+		session, err := store.New(req, "hello")
+		if err != nil || session.IsNew || session.Values["user"] != "alice" {
+			t.Errorf("%s: Expected the session for the same client; Got %v, %v", kind, session.Values, err)
+		}
+
+		req.Header.Set("User-Agent", "curl/8.0")
+		session, err = store.New(req, "hello")
+		if !errors.Is(err, ErrFingerprintMismatch) {
+			t.Errorf("%s: Expected ErrFingerprintMismatch; Got %v", kind, err)
+		}
+		if !session.IsNew || session.Values["user"] != nil {
+			t.Errorf("%s: Expected a fresh session; Got IsNew=%v %v", kind, session.IsNew, session.Values)
+		}
+	}
+}
+
+func TestSaveOne(t *testing.T) {
+	store := &testStore{}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	if err := SaveOne(req, NewRecorder(), "auth"); !errors.Is(err, ErrNoRegistry) {
+		t.Fatalf("Expected ErrNoRegistry; Got %v", err)
+	}
+	store.Get(req, "auth")
+	store.Get(req, "prefs")
+
+	if err := SaveOne(req, NewRecorder(), "auth"); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if len(store.saved) != 1 || store.saved[0] != "auth" {
+		t.Errorf("Expected only the auth session to be saved; Got %v", store.saved)
+	}
+	if err := SaveOne(req, NewRecorder(), "missing"); err == nil {
+		t.Error("Expected an error for an unregistered session")
+	}
+}
+
+func TestSaveOrder(t *testing.T) {
+	store := NewCookieStore(testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	names := []string{"delta", "alpha", "echo", "charlie", "bravo"}
+	for _, name := range names {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["name"] = name
+	}
+	rsp := NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	var got []string
+	for _, cookie := range rsp.Result().Cookies() {
+		got = append(got, cookie.Name)
+	}
+	want := []string{"alpha", "bravo", "charlie", "delta", "echo"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected Set-Cookie order %v; Got %v", want, got)
+	}
+}
+
+func TestSaveOrderMixedStores(t *testing.T) {
+	// The memory store saves in two phases and the Redis one in a batch.
+	cookies := NewCookieStore(testHashKey)
+	memory := NewMemoryStore()
+	redis := NewRedisStore(newFakeRedis().pool, "", testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	for name, store := range map[string]Store{
+		"delta": redis, "alpha": cookies, "echo": memory,
+		"charlie": redis, "bravo": memory, "foxtrot": cookies,
+	} {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Values["name"] = name
+	}
+	rsp := NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	var got []string
+	for _, cookie := range rsp.Result().Cookies() {
+		got = append(got, cookie.Name)
+	}
+	want := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected Set-Cookie order %v; Got %v", want, got)
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	store := NewMemoryStore()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "session-key")
+	session.Values["user"] = "gopher"
+	rsp := NewRecorder()
+	if err := session.Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	cookie := rsp.Result().Cookies()[0]
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	session.Options.SkipUnmodified = true
+	session.Expire()
+	if len(session.Values) != 0 {
+		t.Errorf("Expected no values after Expire; Got %v", session.Values)
+	}
+	rsp = NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	header := rsp.Header().Get("Set-Cookie")
+	if !strings.Contains(header, "Max-Age=0") || !strings.Contains(header, "Expires=Thu, 01 Jan 1970") {
+		t.Errorf("Expected an expiring cookie; Got %q", header)
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.AddCookie(cookie)
+	if session, _ = store.New(req, "session-key"); !session.IsNew {
+		t.Errorf("Expected the stored session to be removed; Got %v", session.Values)
+	}
+}
+
+func TestRegistryGetExisting(t *testing.T) {
+	store := NewCookieStore(testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	registry := GetRegistry(req)
+	first, existed, err := registry.GetExisting(store, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if existed {
+		t.Error("Expected the first GetExisting to register the session")
+	}
+	second, existed, err := registry.GetExisting(store, "session-key")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !existed || second != first {
+		t.Errorf("Expected the registered session; Got existed=%v, same=%v", existed, second == first)
+	}
+	other, existed, err := registry.GetExisting(NewCookieStore(testHashKey), "session-key")
+	if err != nil || existed || other == first {
+		t.Errorf("Expected a new session for another store; Got existed=%v, err=%v", existed, err)
+	}
+}
+
+func TestRegistryGetOptions(t *testing.T) {
+	store := NewCookieStore(testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	options := &Options{Path: "/app", Domain: "example.com", MaxAge: 60, HttpOnly: true}
+	session, err := GetRegistry(req).Get(store, "session-key", WithOptions(options))
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if session.Options == options {
+		t.Error("Expected WithOptions to copy the options")
+	}
+	session.Values["foo"] = "bar"
+	rsp := NewRecorder()
+	if err = Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	header := rsp.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Path=/app", "Domain=example.com", "Max-Age=60", "HttpOnly"} {
+		if !strings.Contains(header, attr) {
+			t.Errorf("Expected %s in %q", attr, header)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", header)
+	if session, err = GetRegistry(req).Get(store, "session-key", WithForceNew()); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("Expected a new session with WithForceNew; Got %v", session.Values)
+	}
+	if _, err = req.Cookie("session-key"); err != nil {
+		t.Error("Expected WithForceNew to leave the request cookies alone")
+	}
+}
+
+func TestSaveTwoPhase(t *testing.T) {
+	store := NewMemoryStore()
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	for _, name := range []string{"a", "b", "c"} {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		session.Set("name", name)
+	}
+	// b can't be serialized, which fails its Prepare.
+	b, _ := store.Get(req, "b")
+	b.Set("bad", make(chan int))
+
+	rsp := NewRecorder()
+	if err := Save(req, rsp); err == nil {
+		t.Fatal("Expected an error saving an unserializable session")
+	}
+	if cookies := rsp.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no session to be committed; Got %v", cookies)
+	}
+	for name, session := range GetRegistry(req).Sessions() {
+		if session.ID != "" || !session.IsDirty() {
+			t.Errorf("Expected session %s to stay unsaved", name)
+		}
+	}
+
+	delete(b.Values, "bad")
+	rsp = NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if cookies := rsp.Result().Cookies(); len(cookies) != 3 {
+		t.Errorf("Expected all sessions to be committed; Got %v", cookies)
+	}
+}
+
+func TestSaveTwice(t *testing.T) {
+	store := NewCookieStore(testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.Get(req, "session-key")
+	session.Values["n"] = 1
+	other, _ := store.Get(req, "other")
+	other.Values["n"] = 1
+
+	rsp := NewRecorder()
+	// A cookie of the app sharing the name, on another path, is kept.
+	http.SetCookie(rsp, &http.Cookie{Name: "session-key", Value: "app", Path: "/app"})
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	session.Values["n"] = 2
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if err := SaveOne(req, rsp, "other"); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	counts := make(map[string]int)
+	var saved *http.Cookie
+	for _, cookie := range rsp.Result().Cookies() {
+		counts[cookie.Name+" "+cookie.Path]++
+		if cookie.Name == "session-key" && cookie.Path == "/" {
+			saved = cookie
+		}
+	}
+	want := map[string]int{"session-key /": 1, "session-key /app": 1, "other /": 1}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Fatalf("Expected one Set-Cookie per cookie %v; Got %v", want, counts)
+	}
+
+	// The last save wins.
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.AddCookie(saved)
+	if session, _ = store.New(req, "session-key"); session.Values["n"] != 2 {
+		t.Errorf("Expected the values of the last Save; Got %v", session.Values)
+	}
+}
+
+func TestSessionChanges(t *testing.T) {
+	session := NewSession(nil, "session-key")
+	session.Values["role"] = "user"
+	session.Values["name"] = "gopher"
+	if changes := session.Changes(); changes != nil {
+		t.Errorf("Expected no changes without a snapshot; Got %v", changes)
+	}
+	session.Snapshot()
+	session.Values["role"] = "admin"
+	session.Values["name"] = "gopher"
+	changes := session.Changes()
+	if len(changes) != 1 || changes["role"] != [2]interface{}{"user", "admin"} {
+		t.Errorf("Expected role to change from user to admin; Got %v", changes)
+	}
+
+	delete(session.Values, "name")
+	session.Values["lang"] = "en"
+	changes = session.Changes()
+	if len(changes) != 3 || changes["name"] != [2]interface{}{"gopher", nil} ||
+		changes["lang"] != [2]interface{}{nil, "en"} {
+		t.Errorf("Expected name removed and lang added; Got %v", changes)
+	}
+}
+
+func TestSessionRawCookieValue(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.Get(req, "session-key")
+	session.Values["foo"] = "bar"
+	if v := session.RawCookieValue(); v != "" {
+		t.Errorf("Expected no cookie value before Save; Got %q", v)
+	}
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	value := session.RawCookieValue()
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Value != value {
+		t.Fatalf("Expected the emitted cookie value %q; Got %v", value, c)
+	}
+	decoded := NewSession(store, "session-key")
+	if err := decodeValues("session-key", value, decoded, store.Serializer, store.Codecs); err != nil {
+		t.Fatalf("Error decoding cookie value: %v", err)
+	}
+	if decoded.Values["foo"] != "bar" {
+		t.Errorf("Expected the session values; Got %v", decoded.Values)
+	}
+
+	if err := store.Delete(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if v := session.RawCookieValue(); v != "" {
+		t.Errorf("Expected no cookie value after Delete; Got %q", v)
+	}
+}
+
+func TestSessionSetExpiry(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	store.Options.SlidingExpiration = true
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, _ := store.New(req, "session-key")
+	session.SetExpiry(now.Add(time.Hour))
+	if m := session.Options.MaxAge; m < 3599 || m > 3600 {
+		t.Errorf("Expected a MaxAge of about 3600; Got %d", m)
+	}
+	if session.Options.SlidingExpiration || !store.Options.SlidingExpiration {
+		t.Error("Expected sliding expiration to be turned off for the session only")
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Later saves keep the cookie aligned to the expiry.
+	now = now.Add(30 * time.Minute)
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err := store.New(req, "session-key")
+	if err != nil || session.IsNew {
+		t.Fatalf("Expected the saved session; Got %v", err)
+	}
+	w = httptest.NewRecorder()
+	if err = store.Save(req, w, session); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge < 1799 || c[0].MaxAge > 1800 {
+		t.Errorf("Expected a MaxAge of about 1800; Got %v", c)
+	}
+
+	now = now.Add(time.Hour)
+	if session, _ = store.New(req, "session-key"); !session.IsNew {
+		t.Error("Expected a new session past the expiry")
+	}
+
+	// The expiry is relative to the clock of the store.
+	session.SetExpiry(now.Add(time.Hour))
+	if m := session.Options.MaxAge; m != 3600 {
+		t.Errorf("Expected a MaxAge of 3600; Got %d", m)
+	}
+	session.Values["foo"] = "bar"
+	session.SetExpiry(now.Add(-time.Minute))
+	if session.Options.MaxAge != -1 || len(session.Values) != 0 {
+		t.Errorf("Expected an expiry in the past to expire the session; Got %d %v",
+			session.Options.MaxAge, session.Values)
+	}
+}
+
+func TestRegistryGetNilStore(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	session, err := GetRegistry(req).Get(nil, "session-key")
+	if err == nil || err.Error() != `sessions: nil store for session "session-key"` {
+		t.Errorf("Expected a nil store error; Got %v", err)
+	}
+	if session != nil {
+		t.Errorf("Expected no session; Got %v", session)
+	}
+	if n := len(GetRegistry(req).Sessions()); n != 0 {
+		t.Errorf("Expected no registered session; Got %d", n)
+	}
+}
+
+func TestRegistryBeforeSave(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	registry := GetRegistry(req)
+	stamp := time.Now().Unix()
+	var names []string
+	registry.BeforeSave(func(name string, session *Session) {
+		names = append(names, name)
+		session.Values["last_seen"] = stamp
+	})
+	if _, err := registry.Get(store, "session-key"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	clean, _ := registry.Get(store, "session-clean")
+	clean.Options.SkipUnmodified = true
+
+	w := httptest.NewRecorder()
+	if err := registry.Save(w); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if len(names) != 1 || names[0] != "session-key" {
+		t.Errorf("Expected the hook to run for the saved session only; Got %v", names)
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err := store.New(req, "session-key")
+	if err != nil || session.Values["last_seen"] != stamp {
+		t.Errorf("Expected the stamp set by the hook in the cookie; Got %v %v", err, session.Values)
+	}
+}
+
+// nilStore is a Store whose New returns no session.
+type nilStore struct {
+	testStore
+	err error
+}
+
+func (s *nilStore) New(r *http.Request, name string) (*Session, error) {
+	return nil, s.err
+}
+
+func TestRegistryGetNilSession(t *testing.T) {
+	for _, store := range []*nilStore{{err: errStoreDown}, {}} {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		session, err := GetRegistry(req).Get(store, "session-key")
+		if store.err != nil && !errors.Is(err, store.err) || err == nil {
+			t.Errorf("Expected an error for a nil session; Got %v", err)
+		}
+		if session == nil || !session.IsNew || session.Name() != "session-key" || session.Values == nil {
+			t.Fatalf("Expected an empty session; Got %#v", session)
+		}
+		session.Values["foo"] = "bar"
+
+		if session, err = GetRegistry(req).GetOrNil(store, "other-key"); session != nil || !errors.Is(err, store.err) {
+			t.Errorf("Expected no session from GetOrNil; Got %v %v", session, err)
+		}
+	}
+}
+
+func TestDomainCheck(t *testing.T) {
+	var logs bytes.Buffer
+	store := NewCookieStore([]byte("secret-key"))
+	store.Options.DomainCheckLogger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	tests := []struct {
+		mode    DomainCheckMode
+		domain  string
+		wantErr bool
+		wantLog bool
+	}{
+		{DomainCheckError, "", false, false},
+		{DomainCheckError, "example.com", false, false},
+		{DomainCheckError, ".Example.com", false, false},
+		{DomainCheckError, "staging.example.com", false, false},
+		{DomainCheckError, "exmaple.com", true, false},
+		{DomainCheckError, "ample.com", true, false},
+		{DomainCheckWarn, "exmaple.com", false, true},
+		{DomainCheckOff, "exmaple.com", false, false},
+	}
+	for _, test := range tests {
+		store.Options.DomainCheck = test.mode
+		logs.Reset()
+		req, _ := http.NewRequest("GET", "http://staging.example.com:8080/", nil)
+		session, _ := store.Get(req, "session-key")
+		session.Options.Domain = test.domain
+		w := httptest.NewRecorder()
+		err := Save(req, w)
+		if got := errors.Is(err, ErrDomainMismatch); got != test.wantErr || !test.wantErr && err != nil {
+			t.Errorf("%+v: Expected error %v; Got %v", test, test.wantErr, err)
+		}
+		if emitted := len(w.Result().Cookies()) == 1; emitted == test.wantErr {
+			t.Errorf("%+v: Expected a cookie %v; Got %v", test, !test.wantErr, emitted)
+		}
+		if logged := strings.Contains(logs.String(), "doesn't match the request host"); logged != test.wantLog {
+			t.Errorf("%+v: Expected a warning %v; Got %q", test, test.wantLog, logs.String())
+		}
+	}
+}
+
+func TestRegistrySetMaxAge(t *testing.T) {
+	store := NewCookieStore([]byte("secret-key"))
+	store.Options.SkipUnmodified = true
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	registry := GetRegistry(req)
+	for _, name := range []string{"a", "b"} {
+		if _, err := registry.Get(store, name); err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+	}
+	registry.SetMaxAge(60)
+	if _, err := registry.Get(store, "c"); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	rsp := NewRecorder()
+	if err := registry.Save(rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	cookies := rsp.Result().Cookies()
+	if len(cookies) != 3 {
+		t.Fatalf("Expected 3 cookies; Got %d", len(cookies))
+	}
+	for _, c := range cookies {
+		if c.MaxAge != 60 {
+			t.Errorf("Expected MaxAge 60 for %q; Got %d", c.Name, c.MaxAge)
+		}
+	}
+	if store.Options.MaxAge != 86400*30 {
+		t.Errorf("Expected the store defaults to be unchanged; Got %d", store.Options.MaxAge)
+	}
+}
+
+func TestRegistrySameNameStores(t *testing.T) {
+	memory := NewMemoryStore()
+	cookie := NewCookieStore(testHashKey)
+	cookie.Options.Path = "/cookie"
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	m, _ := memory.Get(req, "session-key")
+	m.Values["store"] = "memory"
+	c, _ := cookie.Get(req, "session-key")
+	c.Values["store"] = "cookie"
+
+	if m == c || m.Store() != memory || c.Store() != cookie {
+		t.Fatal("Expected a session per store")
+	}
+	if again, _ := memory.Get(req, "session-key"); again != m || again.Values["store"] != "memory" {
+		t.Errorf("Expected the session of the memory store; Got %v", again.Values)
+	}
+	if again, _ := cookie.Get(req, "session-key"); again != c || again.Values["store"] != "cookie" {
+		t.Errorf("Expected the session of the cookie store; Got %v", again.Values)
+	}
+
+	rsp := NewRecorder()
+	if err := Save(req, rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if n := len(rsp.Result().Cookies()); n != 2 {
+		t.Errorf("Expected a cookie per store; Got %d", n)
+	}
+}
+
+func TestRegistryGetOrNil(t *testing.T) {
+	store := NewCookieStore(testHashKey)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	registry := GetRegistry(req)
+	session, err := registry.GetOrNil(store, "session-key")
+	if err != nil || session != nil {
+		t.Fatalf("Expected no session; Got %v, %v", session, err)
+	}
+	rsp := NewRecorder()
+	if err = registry.Save(rsp); err != nil {
+		t.Fatalf("Error saving sessions: %v", err)
+	}
+	if c := rsp.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("Expected no cookie; Got %q", c)
+	}
+
+	session, _ = store.New(req, "session-key")
+	session.Values["user"] = "gopher"
+	if err = session.Save(req, rsp); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8080/", nil)
+	req.Header.Add("Cookie", rsp.Header().Get("Set-Cookie"))
+	session, err = GetRegistry(req).GetOrNil(store, "session-key")
+	if err != nil || session == nil || session.Values["user"] != "gopher" {
+		t.Fatalf("Expected the existing session; Got %v, %v", session, err)
+	}
+	if again, _ := store.Get(req, "session-key"); again != session {
+		t.Error("Expected the session to be registered")
+	}
+}
+
+func BenchmarkRegistrySave(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		stores []Store
+	}{
+		{"one", []Store{NewNoopStore()}},
+		{"one-error", []Store{&errorStore{err: errStoreDown}}},
+		{"two", []Store{NewNoopStore(), NewNoopStore()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			req, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+			registry := GetRegistry(req)
+			for i, store := range bench.stores {
+				if _, err := registry.Get(store, fmt.Sprintf("session-%d", i)); err != nil {
+					b.Fatalf("Error getting session: %v", err)
+				}
+			}
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				registry.Save(w)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sessiontest provides utilities for testing handlers that use
+// sessions.
+//
+// It only depends on net/http/httptest, so importing it doesn't pull the
+// testing package into a build.
+package sessiontest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/sessions"
+)
+
+// NewTestRequest returns a GET request whose registry already holds a
+// session of store for each name in values, together with a recorder for
+// the response.
+//
+// The sessions look like existing ones: IsNew is false and they are not
+// dirty. Like httptest.NewRequest, it panics if a session can't be
+// created.
+func NewTestRequest(store sessions.Store,
+	values map[string]map[interface{}]interface{}) (*http.Request, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("GET", "/", nil)
+	registry := sessions.GetRegistry(r)
+	for name, vals := range values {
+		session, err := registry.Get(store, name)
+		if err != nil {
+			panic(fmt.Sprintf("sessiontest: failed to create session %q: %v", name, err))
+		}
+		for k, v := range vals {
+			session.Values[k] = v
+		}
+		session.IsNew = false
+	}
+	return r, httptest.NewRecorder()
+}
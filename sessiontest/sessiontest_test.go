@@ -0,0 +1,34 @@
+package sessiontest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestNewTestRequest(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("secret-key"))
+	r, w := NewTestRequest(store, map[string]map[interface{}]interface{}{
+		"user": {"id": 42},
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, "user")
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		if session.IsNew || session.Values["id"] != 42 {
+			t.Errorf("Expected the seeded session; Got IsNew=%v %v", session.IsNew, session.Values)
+		}
+		session.Values["seen"] = true
+		if err := sessions.Save(r, w); err != nil {
+			t.Fatalf("Error saving sessions: %v", err)
+		}
+	}
+	handler(w, r)
+
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("Expected the session cookie to be set; Got %v", w.Header())
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// NewShardedStore returns a ShardedStore spreading sessions over shards
+// with hash. FNV-1a is used if hash is nil.
+func NewShardedStore(shards []Store, hash func(id string) int) *ShardedStore {
+	return &ShardedStore{Shards: shards, Hash: hash}
+}
+
+// ShardedStore spreads sessions over several server-side stores, e.g.
+// RedisStores backed by different servers, routing each session to a
+// shard by the hash of its ID.
+//
+// New sessions get their ID on their first Save, before it is routed, so
+// they land on the shard they are loaded from afterwards. Changing the
+// shards or the hash moves existing sessions to other shards, where they
+// are not found.
+//
+// The shards must be stores of this package keeping sessions under an ID,
+// like RedisStore, DatabaseStore or MemoryStore, and share their codecs:
+// MemoryStores must be created with the same key pairs.
+type ShardedStore struct {
+	Shards []Store
+	// Hash maps a session ID to a shard; the result is taken modulo the
+	// number of shards. FNV-1a is used if nil.
+	Hash func(id string) int
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *ShardedStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New loads the session for the given name from the shard of the ID sent
+// with r, without adding it to the registry.
+//
+// See CookieStore.New().
+func (s *ShardedStore) New(r *http.Request, name string) (*Session, error) {
+	if len(s.Shards) == 0 {
+		return nil, errors.New("sessions: ShardedStore has no shards")
+	}
+	shard := s.Shards[0]
+	id, err := shardCookieID(shard, r, name)
+	if err == nil && id != "" {
+		shard = s.shard(id)
+	}
+	// An ID that can't be decoded is handled by the first shard, which
+	// returns a new session and the error.
+	session, err := shard.New(r, name)
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+// Save saves the session to the shard of its ID, generating the ID of new
+// sessions first.
+func (s *ShardedStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	if len(s.Shards) == 0 {
+		return errors.New("sessions: ShardedStore has no shards")
+	}
+	if session.renew && session.ID != "" {
+		// The new ID may belong to another shard, so the old data is
+		// dropped here rather than by the shard.
+		if err := shardErase(r.Context(), s.shard(session.ID), session); err != nil {
+			return err
+		}
+		session.ID = ""
+		session.renew = false
+	}
+	if session.ID == "" && session.Options.MaxAge > 0 {
+		id, err := newSessionID(s.IDGenerator)
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	return s.shard(session.ID).Save(r, w, session)
+}
+
+// Delete removes the session from its shard and expires the session
+// cookie.
+func (s *ShardedStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	if len(s.Shards) == 0 {
+		return errors.New("sessions: ShardedStore has no shards")
+	}
+	return s.shard(session.ID).Delete(r, w, session)
+}
+
+// shard returns the shard of id.
+func (s *ShardedStore) shard(id string) Store {
+	var h int
+	if s.Hash != nil {
+		h = s.Hash(id)
+	} else {
+		f := fnv.New32a()
+		f.Write([]byte(id))
+		h = int(f.Sum32() & 0x7fffffff)
+	}
+	h %= len(s.Shards)
+	if h < 0 {
+		h += len(s.Shards)
+	}
+	return s.Shards[h]
+}
+
+// shardCookieID returns the session ID sent with r, decoded the way shard
+// encodes it. It is empty if r has no cookie for name.
+func shardCookieID(shard Store, r *http.Request, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", nil
+	}
+	if err := checkCookieValue(name, c.Value); err != nil {
+		return "", err
+	}
+	b, ok := shard.(backend)
+	if !ok {
+		return "", fmt.Errorf("sessions: unsupported ShardedStore shard %T", shard)
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id,
+		b.config().codecs...); err != nil {
+		return "", invalidCookie(err)
+	}
+	return id, nil
+}
+
+// shardErase removes the data stored for session.ID from shard.
+func shardErase(ctx context.Context, shard Store, session *Session) error {
+	b, ok := shard.(backend)
+	if !ok {
+		return fmt.Errorf("sessions: unsupported ShardedStore shard %T", shard)
+	}
+	return b.erase(ctx, session)
+}
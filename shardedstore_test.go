@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestShardedStore() (*ShardedStore, []*fakeRedis) {
+	var shards []Store
+	var redis []*fakeRedis
+	for i := 0; i < 3; i++ {
+		r := newFakeRedis()
+		redis = append(redis, r)
+		shards = append(shards, NewRedisStore(r.pool, "session:", []byte("some key")))
+	}
+	return NewShardedStore(shards, nil), redis
+}
+
+func TestShardedStore(t *testing.T) {
+	store, redis := newTestShardedStore()
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.Get(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["i"] = i
+		w := httptest.NewRecorder()
+		if err = Save(req, w); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+
+		// The session is stored on the shard of its ID, and only there.
+		shard := store.shard(session.ID)
+		if store.shard(session.ID) != shard {
+			t.Fatal("expected the same ID to route to the same shard")
+		}
+		for j, r := range redis {
+			_, ok := r.data["session:"+session.ID]
+			if want := store.Shards[j] == shard; ok != want {
+				t.Errorf("session %d: stored on shard %d = %v, want %v", i, j, ok, want)
+			}
+		}
+
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+		loaded, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		if loaded.IsNew || loaded.Values["i"] != i || loaded.Store() != store {
+			t.Fatalf("session %d: expected the saved session, got %v", i, loaded.Values)
+		}
+	}
+}
+
+func TestShardedStoreRenewAndDelete(t *testing.T) {
+	store, redis := newTestShardedStore()
+	count := func() (n int) {
+		for _, r := range redis {
+			n += len(r.data)
+		}
+		return n
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	old := session.ID
+	for session.ID == old || store.shard(session.ID) == store.shard(old) {
+		// Renew until the session moves to another shard.
+		session.Renew()
+		if err := session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to renew session", err)
+		}
+	}
+	if n := count(); n != 1 {
+		t.Errorf("expected only the renewed session to be stored, got %d", n)
+	}
+	if err := store.Delete(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("expected the session to be deleted, got %d stored", n)
+	}
+}
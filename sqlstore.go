@@ -0,0 +1,388 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Placeholder returns the bind parameter for the i-th (1-based) argument
+// of a query, e.g. "?" for MySQL and SQLite or "$1" for PostgreSQL.
+type Placeholder func(i int) string
+
+// QuestionPlaceholder formats bind parameters as "?".
+func QuestionPlaceholder(i int) string { return "?" }
+
+// DollarPlaceholder formats bind parameters as "$1", "$2", ...
+func DollarPlaceholder(i int) string { return "$" + strconv.Itoa(i) }
+
+var tableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// NewDatabaseStore returns a new DatabaseStore.
+//
+// The table must exist and have the following columns, or equivalent types
+// for the database in use:
+//
+//	CREATE TABLE sessions (
+//		id         VARCHAR(64) PRIMARY KEY,
+//		data       BLOB NOT NULL,
+//		created_at TIMESTAMP NOT NULL,
+//		expires_at TIMESTAMP NOT NULL
+//	);
+//
+// To index sessions by user for DeleteByUserID, set the UserID field of the
+// store and add a nullable, indexed user_id column:
+//
+//	ALTER TABLE sessions ADD COLUMN user_id VARCHAR(255);
+//	CREATE INDEX sessions_user_id ON sessions (user_id);
+//
+// The table name is used verbatim in queries, so it must be a plain,
+// optionally schema-qualified, identifier.
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewDatabaseStore(db *sql.DB, tableName string,
+	keyPairs ...[]byte) (*DatabaseStore, error) {
+	if !tableNameRe.MatchString(tableName) {
+		return nil, fmt.Errorf("sessions: invalid table name: %q", tableName)
+	}
+	ds := &DatabaseStore{
+		Codecs: CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Serializer:  GobSerializer{},
+		Placeholder: QuestionPlaceholder,
+		db:          db,
+		table:       tableName,
+	}
+
+	ds.MaxAge(ds.Options.MaxAge)
+	return ds, nil
+}
+
+// DatabaseStore stores sessions in a SQL database using database/sql.
+//
+// Only the session ID is sent to the client, in a signed cookie. Expired
+// rows are ignored when loading and removed by Cleanup.
+type DatabaseStore struct {
+	Codecs     []securecookie.Codec
+	Options    *Options // default configuration
+	Serializer Serializer
+	// Placeholder formats query parameters. The default is
+	// QuestionPlaceholder; use DollarPlaceholder for PostgreSQL.
+	Placeholder Placeholder
+	// EmitUnchanged makes Save always emit the cookie. By default the row
+	// is updated but the cookie is skipped when the client already has an
+	// identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer Observer
+	// UserID indexes sessions by user on Save for DeleteByUserID, in the
+	// user_id column. It must be nil if the table has no such column.
+	UserID UserIDFunc
+	db     *sql.DB
+	table  string
+	// mu guards Serializer during Reencrypt.
+	mu sync.RWMutex
+	// now overrides time.Now in tests.
+	now func() time.Time
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *DatabaseStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// A session ID without a matching, unexpired row results in a new session.
+//
+// See CookieStore.New().
+func (s *DatabaseStore) New(r *http.Request, name string) (*Session, error) {
+	return newBackendSession(s, s, r, name)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL,
+// then the row is deleted and the cookie is expired.
+func (s *DatabaseStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return saveBackendSession(r.Context(), s, w, session)
+}
+
+// Delete removes the session row and expires the session cookie.
+func (s *DatabaseStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *DatabaseStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// config returns the settings used by the backend helpers.
+func (s *DatabaseStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
+	}
+}
+
+// Cleanup deletes all expired sessions from the table.
+func (s *DatabaseStore) Cleanup() error {
+	_, err := s.db.Exec(s.query("DELETE FROM %s WHERE expires_at < %s"),
+		clock(s.now).UTC())
+	return err
+}
+
+// query formats the table name and placeholders into q.
+func (s *DatabaseStore) query(q string) string {
+	args := []interface{}{s.table}
+	for i := 1; i < strings.Count(q, "%s"); i++ {
+		args = append(args, s.Placeholder(i))
+	}
+	return fmt.Sprintf(q, args...)
+}
+
+// save upserts the serialized session.Values.
+//
+// The update is tried first; if no row exists it is inserted, and if a
+// concurrent Save inserted it in the meantime the update is retried.
+func (s *DatabaseStore) save(ctx context.Context, session *Session) error {
+	data, err := s.serializer().Serialize(session)
+	if err != nil {
+		return err
+	}
+	session.size = len(data)
+	now := clock(s.now).UTC()
+	expires := now.Add(time.Duration(session.Options.storeTTL()) * time.Second)
+
+	update := "UPDATE %s SET data = %s, expires_at = %s WHERE id = %s"
+	updateArgs := []interface{}{data, expires, session.ID}
+	insert := "INSERT INTO %s (id, data, created_at, expires_at) VALUES (%s, %s, %s, %s)"
+	insertArgs := []interface{}{session.ID, data, now, expires}
+	if s.UserID != nil {
+		// Anonymous sessions get a NULL user_id.
+		var userID interface{}
+		if id := s.UserID(session); id != "" {
+			userID = id
+		}
+		update = "UPDATE %s SET data = %s, expires_at = %s, user_id = %s WHERE id = %s"
+		updateArgs = []interface{}{data, expires, userID, session.ID}
+		insert = "INSERT INTO %s (id, data, created_at, expires_at, user_id) VALUES (%s, %s, %s, %s, %s)"
+		insertArgs = append(insertArgs, userID)
+	}
+	update = s.query(update)
+	res, err := s.db.ExecContext(ctx, update, updateArgs...)
+	if err != nil {
+		return unavailable(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return unavailable(err)
+	}
+	_, err = s.db.ExecContext(ctx, s.query(insert), insertArgs...)
+	if err != nil {
+		// The insert may have lost a race against a concurrent Save for
+		// the same ID; if the row exists now, update it instead.
+		var one int
+		errExists := s.db.QueryRowContext(ctx, s.query("SELECT 1 FROM %s WHERE id = %s"),
+			session.ID).Scan(&one)
+		if errExists == nil {
+			_, err = s.db.ExecContext(ctx, update, updateArgs...)
+		}
+	}
+	return unavailable(err)
+}
+
+// load reads the session row and decodes it into session.Values.
+//
+// It returns false if there is no unexpired row for the ID.
+func (s *DatabaseStore) load(ctx context.Context, session *Session) (bool, error) {
+	var data []byte
+	var expires time.Time
+	err := s.db.QueryRowContext(ctx, s.query("SELECT data, expires_at FROM %s WHERE id = %s"),
+		session.ID).Scan(&data, &expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, unavailable(err)
+	}
+	if expires.Before(clock(s.now)) {
+		return false, nil
+	}
+	session.size = len(data)
+	return true, s.serializer().Deserialize(data, session)
+}
+
+// erase deletes the session row.
+func (s *DatabaseStore) erase(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE id = %s"), session.ID)
+	return unavailable(err)
+}
+
+// List returns the unexpired sessions stored in the table.
+func (s *DatabaseStore) List(ctx context.Context) ([]SessionMeta, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.query("SELECT id, created_at, expires_at FROM %s WHERE expires_at >= %s"),
+		clock(s.now).UTC())
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+	var metas []SessionMeta
+	for rows.Next() {
+		var meta SessionMeta
+		if err := rows.Scan(&meta.ID, &meta.Created, &meta.Expires); err != nil {
+			return nil, unavailable(err)
+		}
+		metas = append(metas, meta)
+	}
+	return metas, unavailable(rows.Err())
+}
+
+// DeleteByID deletes the row of the session stored under id.
+func (s *DatabaseStore) DeleteByID(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE id = %s"), id)
+	return unavailable(err)
+}
+
+// DeleteAll deletes all the rows of the table.
+func (s *DatabaseStore) DeleteAll(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s"))
+	return unavailable(err)
+}
+
+// Reencrypt rewrites the unexpired sessions stored in the table with
+// serializer, and then makes it the Serializer of the store. It implements
+// Reencrypter.
+//
+// Meanwhile sessions are saved with serializer and loaded with serializer
+// or the former Serializer, so requests can keep using the store. Rows
+// saved during the rewrite are left as is. Other instances sharing the
+// table need serializer too. Session cookies only hold signed IDs and
+// aren't affected.
+func (s *DatabaseStore) Reencrypt(ctx context.Context, serializer Serializer) error {
+	if err := checkReencryption(serializer); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	re := reencrypt(s.Serializer, serializer)
+	s.Serializer = re
+	s.mu.Unlock()
+	rows, err := s.db.QueryContext(ctx,
+		s.query("SELECT id, data FROM %s WHERE expires_at >= %s"),
+		clock(s.now).UTC())
+	if err != nil {
+		return unavailable(err)
+	}
+	type row struct {
+		id   string
+		data []byte
+	}
+	var stored []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.data); err != nil {
+			rows.Close()
+			return unavailable(err)
+		}
+		stored = append(stored, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return unavailable(err)
+	}
+	for _, r := range stored {
+		encrypted, err := reencryptData(re, r.data)
+		if err != nil {
+			return fmt.Errorf("sessions: error reencrypting session %q -- %w", r.id, err)
+		}
+		_, err = s.db.ExecContext(ctx,
+			s.query("UPDATE %s SET data = %s WHERE data = %s AND id = %s"),
+			encrypted, r.data, r.id)
+		if err != nil {
+			return unavailable(err)
+		}
+	}
+	s.mu.Lock()
+	s.Serializer = serializer
+	s.mu.Unlock()
+	return nil
+}
+
+// serializer returns the Serializer of the store.
+func (s *DatabaseStore) serializer() Serializer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Serializer
+}
+
+// Touch sets the expiry of the row of the session stored under id, without
+// rewriting its data. It implements Toucher.
+func (s *DatabaseStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	_, err := s.expire(ctx, id, ttl)
+	return err
+}
+
+// expire sets the expiry of the row of id, reporting whether it exists.
+func (s *DatabaseStore) expire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET expires_at = %s WHERE id = %s"),
+		clock(s.now).UTC().Add(ttl), id)
+	if err != nil {
+		return false, unavailable(err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, unavailable(err)
+}
+
+// touch extends the expiry of the session row.
+func (s *DatabaseStore) touch(ctx context.Context, session *Session) (bool, error) {
+	return s.expire(ctx, session.ID, time.Duration(session.Options.storeTTL())*time.Second)
+}
+
+// DeleteByUserID deletes the rows with the given user_id.
+func (s *DatabaseStore) DeleteByUserID(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE user_id = %s"), userID)
+	return unavailable(err)
+}
@@ -0,0 +1,443 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a tiny database/sql driver understanding only the queries
+// issued by DatabaseStore.
+type fakeDB struct {
+	mu   sync.Mutex
+	rows map[string]fakeRow
+	// users holds the user_id column of the rows that have one.
+	users map[string]string
+}
+
+// setUser sets the user_id of row id from a query argument.
+func (db *fakeDB) setUser(id string, user driver.Value) {
+	if db.users == nil {
+		db.users = make(map[string]string)
+	}
+	if user, ok := user.(string); ok {
+		db.users[id] = user
+	} else {
+		delete(db.users, id)
+	}
+}
+
+type fakeRow struct {
+	data    []byte
+	created time.Time
+	expires time.Time
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	m map[string]*fakeDB
+}{m: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("fakesessions", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	db, ok := fakeDBs.m[name]
+	if !ok {
+		db = &fakeDB{rows: make(map[string]fakeRow)}
+		fakeDBs.m[name] = db
+	}
+	return fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.db, query}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("unsupported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.Contains(s.query, "WHERE data"):
+		id := args[2].(string)
+		row, ok := s.db.rows[id]
+		if !ok || string(row.data) != string(args[1].([]byte)) {
+			return driver.RowsAffected(0), nil
+		}
+		row.data = args[0].([]byte)
+		s.db.rows[id] = row
+		return driver.RowsAffected(1), nil
+	case strings.Contains(s.query, "SET expires_at"):
+		id := args[1].(string)
+		row, ok := s.db.rows[id]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row.expires = args[0].(time.Time)
+		s.db.rows[id] = row
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		id := args[len(args)-1].(string)
+		row, ok := s.db.rows[id]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row.data, row.expires = args[0].([]byte), args[1].(time.Time)
+		s.db.rows[id] = row
+		if len(args) == 4 {
+			s.db.setUser(id, args[2])
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		id := args[0].(string)
+		if _, ok := s.db.rows[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		s.db.rows[id] = fakeRow{args[1].([]byte), args[2].(time.Time), args[3].(time.Time)}
+		if len(args) == 5 {
+			s.db.setUser(id, args[4])
+		}
+		return driver.RowsAffected(1), nil
+	case strings.Contains(s.query, "WHERE user_id"):
+		var n int64
+		for id, user := range s.db.users {
+			if user == args[0].(string) {
+				delete(s.db.rows, id)
+				delete(s.db.users, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	case !strings.Contains(s.query, "WHERE"):
+		n := int64(len(s.db.rows))
+		s.db.rows = make(map[string]fakeRow)
+		s.db.users = nil
+		return driver.RowsAffected(n), nil
+	case strings.Contains(s.query, "WHERE id"):
+		delete(s.db.rows, args[0].(string))
+		return driver.RowsAffected(1), nil
+	case strings.Contains(s.query, "WHERE expires_at"):
+		var n int64
+		for id, row := range s.db.rows {
+			if row.expires.Before(args[0].(time.Time)) {
+				delete(s.db.rows, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("unsupported query %q", s.query)
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if strings.HasPrefix(s.query, "SELECT id") {
+		rows := &fakeRows{columns: []string{"id", "created_at", "expires_at"}}
+		if strings.HasPrefix(s.query, "SELECT id, data") {
+			rows.columns = []string{"id", "data"}
+		}
+		for id, row := range s.db.rows {
+			if row.expires.Before(args[0].(time.Time)) {
+				continue
+			}
+			if len(rows.columns) == 2 {
+				rows.values = append(rows.values, []driver.Value{id, row.data})
+			} else {
+				rows.values = append(rows.values, []driver.Value{id, row.created, row.expires})
+			}
+		}
+		return rows, nil
+	}
+	row, ok := s.db.rows[args[0].(string)]
+	if !ok {
+		return &fakeRows{}, nil
+	}
+	if strings.HasPrefix(s.query, "SELECT 1") {
+		return &fakeRows{values: [][]driver.Value{{int64(1)}}}, nil
+	}
+	return &fakeRows{values: [][]driver.Value{{row.data, row.expires}}}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.columns != nil {
+		return r.columns
+	}
+	return []string{"data", "expires_at"}
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newTestDatabaseStore(t *testing.T) (*DatabaseStore, *fakeDB) {
+	db, err := sql.Open("fakesessions", t.Name())
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	store, err := NewDatabaseStore(db, "sessions", []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	if _, ok := fakeDBs.m[t.Name()]; !ok {
+		fakeDBs.m[t.Name()] = &fakeDB{rows: make(map[string]fakeRow)}
+	}
+	return store, fakeDBs.m[t.Name()]
+}
+
+func TestDatabaseStore(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	// Saving again updates the existing row.
+	session.Values["foo"] = "baz"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if len(db.rows) != 1 {
+		t.Fatalf("expected a single row, got %d", len(db.rows))
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.Values["foo"] != "baz" {
+		t.Fatalf("expected the saved session, got %#v", loaded)
+	}
+
+	loaded.Options.MaxAge = -1
+	if err = loaded.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if len(db.rows) != 0 {
+		t.Fatal("expected the row to be deleted")
+	}
+}
+
+func TestDatabaseStoreConcurrentSave(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := NewSession(store, "hello")
+			session.ID = "SAMEID"
+			session.Options.MaxAge = 3600
+			if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+				t.Errorf("failed to save session: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(db.rows) != 1 {
+		t.Fatalf("expected a single row, got %d", len(db.rows))
+	}
+}
+
+func TestDatabaseStoreCleanup(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	now := time.Now().UTC()
+	db.rows["old"] = fakeRow{nil, now.Add(-2 * time.Hour), now.Add(-time.Hour)}
+	db.rows["new"] = fakeRow{nil, now, now.Add(time.Hour)}
+
+	if err := store.Cleanup(); err != nil {
+		t.Fatal("failed to clean up", err)
+	}
+	if _, ok := db.rows["old"]; ok {
+		t.Error("expected the expired row to be deleted")
+	}
+	if _, ok := db.rows["new"]; !ok {
+		t.Error("expected the live row to be kept")
+	}
+}
+
+func TestDatabaseStoreTableName(t *testing.T) {
+	db, err := sql.Open("fakesessions", t.Name())
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	if _, err = NewDatabaseStore(db, "sessions; DROP TABLE users"); err == nil {
+		t.Fatal("expected an error for an invalid table name")
+	}
+}
+
+func TestDatabaseStoreEnumerator(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	var _ Enumerator = store
+	now := time.Now().UTC()
+	db.rows["expired"] = fakeRow{nil, now.Add(-time.Hour), now.Add(-time.Minute)}
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx := context.Background()
+	metas, err := store.List(ctx)
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(metas) != 1 || metas[0].ID != session.ID {
+		t.Fatalf("expected only session %s, got %+v", session.ID, metas)
+	}
+	if metas[0].Created.IsZero() || !metas[0].Expires.After(metas[0].Created) {
+		t.Errorf("expected creation and expiry times, got %+v", metas[0])
+	}
+
+	if err = store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, ok := db.rows[session.ID]; ok {
+		t.Error("expected the row to be deleted")
+	}
+}
+
+func TestDatabaseStorePurger(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	var _ Purger = store
+	store.UserID = UserIDFromValue("user")
+	save := func(user string) {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if user != "" {
+			session.Values["user"] = user
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+	for _, user := range []string{"alice", "alice", "alice", "bob", ""} {
+		save(user)
+	}
+
+	ctx := context.Background()
+	if err := store.DeleteByUserID(ctx, "alice"); err != nil {
+		t.Fatal("failed to delete the sessions of a user", err)
+	}
+	if len(db.rows) != 2 {
+		t.Fatalf("expected the sessions of bob and the anonymous one to be left, got %d", len(db.rows))
+	}
+	if err := store.DeleteAll(ctx); err != nil {
+		t.Fatal("failed to delete all sessions", err)
+	}
+	if len(db.rows) != 0 {
+		t.Errorf("expected no session left, got %d", len(db.rows))
+	}
+}
+
+func TestDatabaseStoreReencrypt(t *testing.T) {
+	store, db := newTestDatabaseStore(t)
+	var _ Reencrypter = store
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	store.Serializer = FieldEncryptionSerializer{Codecs: CodecsFromPairs(nil, oldKey)}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.SetEncrypted("card", fmt.Sprint("card ", i))
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	f := FieldEncryptionSerializer{Codecs: CodecsFromPairs(nil, newKey)}
+	if err := store.Reencrypt(context.Background(), f); err != nil {
+		t.Fatal("failed to reencrypt sessions", err)
+	}
+	for id, row := range db.rows {
+		session := NewSession(nil, "hello")
+		if err := f.Deserialize(row.data, session); err != nil {
+			t.Fatalf("failed to deserialize %q: %v", id, err)
+		}
+		if err := session.FieldError("card"); err != nil {
+			t.Fatal("failed to decrypt with the new key", err)
+		}
+	}
+	if _, ok := store.Serializer.(FieldEncryptionSerializer); !ok {
+		t.Errorf("expected the new serializer, got %T", store.Serializer)
+	}
+
+	for _, serializer := range []Serializer{
+		GobSerializer{},
+		FieldEncryptionSerializer{},
+		FieldEncryptionSerializer{Codecs: CodecsFromPairs([]byte("some key"))},
+	} {
+		if err := store.Reencrypt(context.Background(), serializer); err == nil {
+			t.Errorf("expected an error reencrypting with %#v", serializer)
+		}
+	}
+}
@@ -5,19 +5,28 @@
 package sessions
 
 import (
-	"encoding/base32"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/securecookie"
 )
 
 // Store is an interface for custom session stores.
 //
+// Stores keeping the session values server-side pass the context of the
+// request to their backend, and fail with the error of the context once it
+// is done. CookieStore doesn't do any I/O and ignores the context.
+//
 // See CookieStore and FilesystemStore for examples.
 type Store interface {
 	// Get should return a cached session.
@@ -31,6 +40,332 @@ type Store interface {
 
 	// Save should persist session to the underlying store implementation.
 	Save(r *http.Request, w http.ResponseWriter, s *Session) error
+
+	// Delete should remove the session from the underlying store
+	// implementation and expire its cookie on the client.
+	Delete(r *http.Request, w http.ResponseWriter, s *Session) error
+}
+
+// BatchSaver is implemented by stores that can save several sessions in a
+// single round-trip to their backend.
+//
+// Registry.Save calls SaveAll instead of Save when the store holds more than
+// one of the sessions to save. Implementations must be comparable, e.g.
+// pointer types.
+type BatchSaver interface {
+	SaveAll(r *http.Request, w http.ResponseWriter, sessions []*Session) error
+}
+
+// TwoPhaseSaver is implemented by stores that can validate and prepare a
+// save before committing it.
+//
+// Registry.Save prepares all the sessions of such stores first, and only
+// commits them if every Prepare succeeded, so a failing session doesn't
+// leave the others half-saved. Sessions of other stores are saved on a
+// best-effort basis, with the errors collected in a MultiError.
+//
+// Prepare must not persist anything or write to the response; dropping the
+// returned commit without calling it rolls the save back. The commit can
+// still fail, e.g. when the backend goes down in between.
+//
+// Stores keeping the whole session in the cookie, like CookieStore, are
+// all-or-nothing per response anyway: nothing is persisted until the
+// client receives the cookies.
+type TwoPhaseSaver interface {
+	Prepare(r *http.Request, session *Session) (commit func(w http.ResponseWriter) error, err error)
+}
+
+// Enumerator is implemented by server-side stores that can list the
+// sessions they keep, e.g. for an "active sessions" page or to log a user
+// out of other devices. CookieStore can't, since its sessions only live in
+// the clients.
+type Enumerator interface {
+	// List returns the unexpired sessions of the store.
+	List(ctx context.Context) ([]SessionMeta, error)
+	// DeleteByID deletes the session stored under id. Deleting a missing
+	// session is not an error.
+	DeleteByID(ctx context.Context, id string) error
+}
+
+// Purger is implemented by server-side stores that can delete sessions in
+// bulk, e.g. when an account is deleted or to log everyone out. CookieStore
+// can't, since its sessions only live in the clients.
+type Purger interface {
+	// DeleteAll deletes all the sessions of the store.
+	DeleteAll(ctx context.Context) error
+	// DeleteByUserID deletes the sessions of a user. It only finds sessions
+	// saved while the store had a UserIDFunc.
+	DeleteByUserID(ctx context.Context, userID string) error
+}
+
+// Toucher is implemented by server-side stores that can extend the
+// lifetime of a stored session without rewriting it, a cheap operation for
+// sessions with SlidingExpiration read on every request.
+//
+// The stores of this package use it in Save, re-emitting the cookie but
+// only touching the stored data, for loaded sessions with both
+// SlidingExpiration and SkipUnmodified that weren't marked dirty.
+type Toucher interface {
+	// Touch sets the lifetime of the session stored under id to ttl.
+	Touch(ctx context.Context, id string, ttl time.Duration) error
+}
+
+// Loader is implemented by stores that can tell whether the client has a
+// session without creating one, see Registry.GetOrNil.
+type Loader interface {
+	// Load returns the session of the client for the given name, or
+	// false and a nil session if the client has none or its cookie is
+	// invalid.
+	Load(r *http.Request, name string) (*Session, bool, error)
+}
+
+// Reencrypter is implemented by server-side stores that can re-encrypt all
+// their sessions with new keys at once, e.g. after a key leaked, instead of
+// as each session is saved. CookieStore can't, since its sessions only live
+// in the clients.
+type Reencrypter interface {
+	// Reencrypt rewrites the stored sessions with serializer, which then
+	// replaces the Serializer of the store. It must be an
+	// EncryptionSerializer or FieldEncryptionSerializer whose codecs all
+	// encrypt, e.g. from CodecsFromPairs with an encryption key in every
+	// pair. It is idempotent, so it can be run again if it fails midway.
+	Reencrypt(ctx context.Context, serializer Serializer) error
+}
+
+// UserIDFunc returns the ID of the user a session belongs to, or "" for
+// anonymous sessions. Stores implementing Purger call it on Save to index
+// sessions by user for DeleteByUserID.
+//
+// Set it as the UserID field of the store, e.g. with UserIDFromValue when
+// the user ID is kept in the session values:
+//
+//	store.UserID = sessions.UserIDFromValue("user_id")
+type UserIDFunc func(session *Session) string
+
+// UserIDFromValue returns a UserIDFunc reading the user ID from the string
+// session value stored under key.
+func UserIDFromValue(key interface{}) UserIDFunc {
+	return func(session *Session) string {
+		id, _ := session.Values[key].(string)
+		return id
+	}
+}
+
+// SessionMeta describes a session listed by an Enumerator.
+type SessionMeta struct {
+	ID string
+	// Created is the time the session was first saved, or the zero time if
+	// the store doesn't record it.
+	Created time.Time
+	// Expires is the time the session expires, or the zero time if it
+	// doesn't.
+	Expires time.Time
+}
+
+// Errors returned by stores can be classified with errors.Is:
+//
+//   - ErrInvalidCookie: the session cookie, or the data it refers to, could
+//     not be decoded, e.g. because it was tampered with, signed with an
+//     unknown key or expired. The session returned along with it is new,
+//     and it is usually fine to carry on with it: failing open just logs
+//     the user out.
+//   - ErrStoreUnavailable: the backend of a server-side store failed, e.g.
+//     the database is down. The session returned along with it is new as
+//     well, but carrying on with it would overwrite the user's session
+//     once the backend recovers, so it is usually best to fail the
+//     request.
+//
+// For example:
+//
+//	session, err := store.Get(r, "session-name")
+//	if errors.Is(err, sessions.ErrStoreUnavailable) {
+//		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+//		return
+//	}
+//	// Any other error means an invalid cookie; session is a new session.
+var (
+	ErrInvalidCookie    = errors.New("sessions: invalid session cookie")
+	ErrStoreUnavailable = errors.New("sessions: session store unavailable")
+)
+
+// invalidCookie wraps a decoding error with ErrInvalidCookie.
+func invalidCookie(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidCookie, err)
+}
+
+// unavailable wraps a backend error with ErrStoreUnavailable.
+func unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+}
+
+// ErrNoKeys is returned when saving a session with a store that was created
+// without any key pairs.
+var ErrNoKeys = errors.New("sessions: no key pairs provided to the store")
+
+// encodeCookie encodes value with the first codec, so sessions saved after
+// a key rotation are always signed with the newest key pair.
+func encodeCookie(name string, value interface{},
+	codecs []securecookie.Codec) (string, error) {
+	if len(codecs) == 0 {
+		return "", ErrNoKeys
+	}
+	return securecookie.EncodeMulti(name, value, codecs...)
+}
+
+// encodeValues serializes session.Values and encodes them with the codecs.
+//
+// A nil serializer leaves the encoding of the values to the codecs.
+func encodeValues(session *Session, serializer Serializer,
+	codecs []securecookie.Codec) (string, error) {
+	if serializer == nil {
+		// The codecs gob-encode the values themselves.
+		RegisterGobTypes()
+		return encodeCookie(session.Name(), session.Values, codecs)
+	}
+	data, err := serializer.Serialize(session)
+	if err != nil {
+		return "", err
+	}
+	return encodeCookie(session.Name(), data, codecs)
+}
+
+// decodeValues decodes value with the codecs into session.Values.
+func decodeValues(name, value string, session *Session,
+	serializer Serializer, codecs []securecookie.Codec) error {
+	if serializer == nil {
+		RegisterGobTypes()
+		return securecookie.DecodeMulti(name, value, &session.Values,
+			codecs...)
+	}
+	var data []byte
+	if err := securecookie.DecodeMulti(name, value, &data,
+		codecs...); err != nil {
+		return err
+	}
+	return serializer.Deserialize(data, session)
+}
+
+// IDGenerator returns a new session ID for a server-side store.
+//
+// IDs are used in cookies, filenames and keys, so they must be non-empty
+// and only contain URL-safe characters: letters, digits, '-', '.', '_' and
+// '~'.
+type IDGenerator func() (string, error)
+
+// RandomID is the default IDGenerator. It returns 32 random bytes encoded
+// as unpadded base64url.
+func RandomID() (string, error) {
+	b := securecookie.GenerateRandomKey(32)
+	if b == nil {
+		return "", errors.New("sessions: failed to generate a random session ID")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newSessionID returns an ID from gen, or from RandomID if gen is nil.
+func newSessionID(gen IDGenerator) (string, error) {
+	if gen == nil {
+		gen = RandomID
+	}
+	id, err := gen()
+	if err != nil {
+		return "", err
+	}
+	if !validSessionID(id) {
+		return "", fmt.Errorf("sessions: invalid session ID %q, it must be non-empty and URL-safe", id)
+	}
+	return id, nil
+}
+
+// validSessionID reports whether id is non-empty and only contains
+// unreserved URL characters.
+func validSessionID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxCookieValueLength is the maximum length of a session cookie value
+// stores accept. Longer values are rejected with ErrInvalidCookie before
+// any decoding, bounding the work done for malicious clients. Set it to 0
+// to disable the check.
+//
+// CookieStore applies its own MaxLength instead, so it accepts any cookie
+// it saves.
+var MaxCookieValueLength = 4096
+
+// checkCookieValue rejects a session cookie value that is longer than
+// MaxCookieValueLength or contains invalid characters, see
+// checkCookieValueLength.
+func checkCookieValue(name, value string) error {
+	return checkCookieValueLength(name, value, MaxCookieValueLength)
+}
+
+// checkCookieValueLength rejects a session cookie value that is longer than
+// max, unless max is 0, or contains characters no codec produces, i.e.
+// anything but unreserved URL characters and base64 padding.
+func checkCookieValueLength(name, value string, max int) error {
+	if max > 0 && len(value) > max {
+		return invalidCookie(fmt.Errorf("sessions: cookie %q is %d bytes, exceeding the maximum of %d",
+			name, len(value), max))
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c != '=' && !validSessionID(value[i:i+1]) {
+			return invalidCookie(fmt.Errorf("sessions: invalid character %q in cookie %q", c, name))
+		}
+	}
+	return nil
+}
+
+// loadedCookie records the state of a session cookie sent by the client.
+type loadedCookie struct {
+	id      string
+	options Options
+	// values is only set by stores keeping the values in the cookie.
+	values map[interface{}]interface{}
+}
+
+// setLoaded records that the client holds a cookie for the session in its
+// current state. Stores storing the values in the cookie pass a copy of the
+// decoded values.
+func (s *Session) setLoaded(values map[interface{}]interface{}) {
+	s.loaded = &loadedCookie{id: s.ID, options: *s.Options, values: values}
+}
+
+// cookieUnchanged reports whether the cookie the client sent already matches
+// the session, so Save doesn't need to emit it again.
+//
+// Sessions with sliding expiration, marked for renewal or decoded from an
+// outdated format always emit their cookie.
+func (s *Session) cookieUnchanged() bool {
+	l := s.loaded
+	if l == nil || s.renew || s.stale || s.Options.SlidingExpiration ||
+		l.id != s.ID || l.options != *s.Options {
+		return false
+	}
+	return l.values == nil || reflect.DeepEqual(l.values, s.Values)
+}
+
+// signedWithNewestKey reports whether an encoded session ID validates with
+// the first codec. Cookies signed with older keys are re-emitted on Save.
+func signedWithNewestKey(name, value string, codecs []securecookie.Codec) bool {
+	var id string
+	return len(codecs) > 0 &&
+		securecookie.DecodeMulti(name, value, &id, codecs[0]) == nil
 }
 
 // CookieStore ----------------------------------------------------------------
@@ -42,17 +377,30 @@ type Store interface {
 //
 // The first key in a pair is used for authentication and the second for
 // encryption. The encryption key can be set to nil or omitted in the last
-// pair, but the authentication key is required in all pairs.
+// pair, but the authentication key is required in all pairs. At least one
+// pair is required: Save returns ErrNoKeys otherwise. NewCookieStore keeps
+// its signature for compatibility, use NewCheckedCookieStore to validate the
+// keys up front.
+//
+// Pairs without an encryption key only sign the values: the cookie can be
+// read by the client, which helps debugging, but not changed, as its
+// HMAC-SHA256 is verified in constant time when decoding. Set an encryption
+// key to keep the values secret as well.
+//
+// To rotate keys, prepend the new pair: sessions are always saved with the
+// first pair, while existing cookies are decoded by trying each pair in
+// order, so they are re-signed with the new keys on their next Save.
 //
 // It is recommended to use an authentication key with 32 or 64 bytes.
 // The encryption key, if set, must be either 16, 24, or 32 bytes to select
-// AES-128, AES-192, or AES-256 modes.
+// AES-128, AES-192, or AES-256 modes. Encrypted cookies use AES-GCM, see
+// CodecsFromPairs.
 //
 // Use the convenience function securecookie.GenerateRandomKey() to create
 // strong keys.
 func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 	cs := &CookieStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Codecs: CodecsFromPairs(keyPairs...),
 		Options: &Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
@@ -60,13 +408,54 @@ func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 	}
 
 	cs.MaxAge(cs.Options.MaxAge)
+	cs.MaxLength(4096)
 	return cs
 }
 
+// NewCheckedCookieStore returns a new CookieStore like NewCookieStore, but
+// returns ErrNoKeys if no key pair is given, and an error if a pair lacks
+// its authentication key or has an encryption key of an invalid length.
+func NewCheckedCookieStore(keyPairs ...[]byte) (*CookieStore, error) {
+	if len(keyPairs) == 0 {
+		return nil, ErrNoKeys
+	}
+	for i := 0; i < len(keyPairs); i += 2 {
+		if len(keyPairs[i]) == 0 {
+			return nil, fmt.Errorf("sessions: key pair %d has no authentication key", i/2)
+		}
+		if i+1 < len(keyPairs) {
+			switch len(keyPairs[i+1]) {
+			case 0, 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("sessions: key pair %d has an encryption key of %d bytes, want 16, 24 or 32", i/2, len(keyPairs[i+1]))
+			}
+		}
+	}
+	return NewCookieStore(keyPairs...), nil
+}
+
 // CookieStore stores sessions using secure cookies.
 type CookieStore struct {
 	Codecs  []securecookie.Codec
 	Options *Options // default configuration
+	// Serializer encodes session values before they are signed. When nil
+	// the values are encoded by the codecs directly.
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default Save skips
+	// the cookie of a session whose values and options are identical to
+	// the ones the client sent.
+	EmitUnchanged bool
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer  Observer
+	maxLength int
+	// now overrides time.Now in tests.
+	now func() time.Time
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -86,51 +475,126 @@ func (s *CookieStore) Get(r *http.Request, name string) (*Session, error) {
 // decode the session data twice, while Get() registers and reuses the same
 // decoded session after the first call.
 func (s *CookieStore) New(r *http.Request, name string) (*Session, error) {
+	start := startObserving(s.Observer)
+	session, err := s.decode(r, name)
+	observeLoaded(s.Observer, start, session, err)
+	return session, err
+}
+
+// decode decodes the session sent with r.
+func (s *CookieStore) decode(r *http.Request, name string) (*Session, error) {
 	session := NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
+	session.Options = s.Options.Clone()
+	session.now = s.now
+	session.scopePath(r, s.PathFromRequest)
 	session.IsNew = true
 	var err error
 	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.Values,
-			s.Codecs...)
+		// The limit of the store, not MaxCookieValueLength, so cookies it
+		// saved are always accepted.
+		err = checkCookieValueLength(name, c.Value, s.maxLength)
+		if err == nil {
+			err = invalidCookie(decodeValues(name, c.Value, session, s.Serializer, s.Codecs))
+		}
 		if err == nil {
 			session.IsNew = false
+			session.size = len(c.Value)
+			// Keep a pristine copy to detect changes, unless the cookie
+			// was signed with an old key and must be re-signed anyway.
+			orig := NewSession(s, name)
+			if decodeValues(name, c.Value, orig, s.Serializer, s.Codecs[:1]) == nil {
+				session.setLoaded(orig.Values)
+			}
+			err = session.expireAbsolute(clock(s.now))
+		} else {
+			// Don't hand out partially decoded values.
+			session.Values = make(map[interface{}]interface{})
 		}
 	}
+	if errFingerprint := session.checkFingerprint(r, s.Fingerprint); err == nil {
+		err = errFingerprint
+	}
 	return session, err
 }
 
 // Save adds a single session to the response.
+//
+// The cookie is not emitted if the client already has it, see EmitUnchanged.
 func (s *CookieStore) Save(r *http.Request, w http.ResponseWriter,
 	session *Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
+	start := startObserving(s.Observer)
+	err := s.encode(w, session)
+	observeSaved(s.Observer, start, session, err)
+	return err
+}
+
+// encode encodes the session into its cookie.
+func (s *CookieStore) encode(w http.ResponseWriter, session *Session) error {
+	if err := checkCookie(session.Name(), session.Options); err != nil {
+		return err
+	}
+	now := clock(s.now)
+	session.stampCreated(now)
+	if !s.EmitUnchanged && session.cookieUnchanged() {
+		return nil
+	}
+	encoded, err := encodeValues(session, s.Serializer, s.Codecs)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, NewCookie(session.Name(), encoded, session.Options))
+	if n := len(session.Name()) + len(encoded) + 1; s.maxLength > 0 && n > s.maxLength {
+		return fmt.Errorf("sessions: cookie %q is %d bytes, exceeding the maximum of %d",
+			session.Name(), n, s.maxLength)
+	}
+	session.renew = false
+	session.IsNew = false
+	session.loaded = nil
+	session.size = len(encoded)
+	setCookie(w, session, encoded, now)
+	return nil
+}
+
+// Delete expires the session cookie on the client.
+//
+// Since the whole session lives in the cookie there is nothing else to
+// remove.
+func (s *CookieStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	expireCookie(w, session)
 	return nil
 }
 
+// MaxLength restricts the maximum length of the cookie to l, counting both
+// the session name and the encoded value.
+//
+// Browsers silently drop cookies larger than about 4096 bytes, so Save
+// returns an error naming the session and its size instead. If l is 0 there
+// is no limit. The default for a new CookieStore is 4096.
+func (s *CookieStore) MaxLength(l int) {
+	s.maxLength = l
+
+	// The store enforces the limit itself to report a descriptive error.
+	setCodecsMaxLength(s.Codecs, 0)
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
 func (s *CookieStore) MaxAge(age int) {
 	s.Options.MaxAge = age
 
-	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
-		}
-	}
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
 }
 
 // FilesystemStore ------------------------------------------------------------
 
 var fileMutex sync.RWMutex
 
+// filesystemCleanupInterval is how often Save removes the expired session
+// files of a FilesystemStore.
+const filesystemCleanupInterval = time.Minute
+
 // NewFilesystemStore returns a new FilesystemStore.
 //
 // The path argument is the directory where sessions will be saved. If empty
@@ -142,7 +606,7 @@ func NewFilesystemStore(path string, keyPairs ...[]byte) *FilesystemStore {
 		path = os.TempDir()
 	}
 	fs := &FilesystemStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Codecs: CodecsFromPairs(keyPairs...),
 		Options: &Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
@@ -162,18 +626,39 @@ func NewFilesystemStore(path string, keyPairs ...[]byte) *FilesystemStore {
 type FilesystemStore struct {
 	Codecs  []securecookie.Codec
 	Options *Options // default configuration
-	path    string
+	// Serializer encodes session values before they are written to disk.
+	// When nil the values are encoded by the codecs directly.
+	Serializer Serializer
+	// EmitUnchanged makes Save always emit the cookie. By default the
+	// session is written to disk but its cookie is skipped when the client
+	// already has an identical one.
+	EmitUnchanged bool
+	// IDGenerator returns the IDs of new sessions. RandomID is used if
+	// nil.
+	IDGenerator IDGenerator
+	// Fingerprint binds sessions to the client, see FingerprintFunc. It is
+	// off when nil.
+	Fingerprint FingerprintFunc
+	// PathFromRequest scopes the cookie of each session to a path derived
+	// from the request, see PathFunc. Options.Path is used when nil.
+	PathFromRequest PathFunc
+	// Observer is notified of loads and saves. It is off when nil.
+	Observer Observer
+	path     string
+	// now overrides time.Now in tests.
+	now func() time.Time
+	mu  sync.Mutex
+	// cleaned is when Save last started Cleanup, and cleaning is set while
+	// it runs.
+	cleaned  time.Time
+	cleaning atomic.Bool
 }
 
 // MaxLength restricts the maximum length of new sessions to l.
 // If l is 0 there is no limit to the size of a session, use with caution.
 // The default for a new FilesystemStore is 4096.
 func (s *FilesystemStore) MaxLength(l int) {
-	for _, c := range s.Codecs {
-		if codec, ok := c.(*securecookie.SecureCookie); ok {
-			codec.MaxLength(l)
-		}
-	}
+	setCodecsMaxLength(s.Codecs, l)
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -185,111 +670,203 @@ func (s *FilesystemStore) Get(r *http.Request, name string) (*Session, error) {
 
 // New returns a session for the given name without adding it to the registry.
 //
+// A session whose file is gone, e.g. because it expired, results in a new
+// session.
+//
 // See CookieStore.New().
 func (s *FilesystemStore) New(r *http.Request, name string) (*Session, error) {
-	session := NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
-	session.IsNew = true
-	var err error
-	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
-		if err == nil {
-			err = s.load(session)
-			if err == nil {
-				session.IsNew = false
-			}
-		}
-	}
-	return session, err
+	return newBackendSession(s, s, r, name)
 }
 
 // Save adds a single session to the response.
 //
-// If the Options.MaxAge of the session is <= 0 then the session file will be
-// deleted from the store path. With this process it enforces the properly
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL, then
+// the session file will be deleted from the store path. With this process it enforces the properly
 // session cookie handling so no need to trust in the cookie management in the
 // web browser.
 func (s *FilesystemStore) Save(r *http.Request, w http.ResponseWriter,
 	session *Session) error {
-	// Delete if max-age is <= 0
-	if session.Options.MaxAge <= 0 {
-		if err := s.erase(session); err != nil {
-			return err
-		}
-		http.SetCookie(w, NewCookie(session.Name(), "", session.Options))
-		return nil
-	}
-
-	if session.ID == "" {
-		// Because the ID is used in the filename, encode it to
-		// use alphanumeric characters only.
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
-	}
-	if err := s.save(session); err != nil {
+	if err := saveBackendSession(r.Context(), s, w, session); err != nil {
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
-	if err != nil {
-		return err
+	// The cleanup scans the whole directory, so it doesn't hold up the
+	// request. Failures to delete stale files are retried on the next one.
+	if s.cleanupDue() {
+		go func() {
+			defer s.cleaning.Store(false)
+			s.Cleanup()
+		}()
 	}
-	http.SetCookie(w, NewCookie(session.Name(), encoded, session.Options))
 	return nil
 }
 
+// cleanupDue reports whether Save should start Cleanup, which it does at
+// most once per filesystemCleanupInterval and never while one is running.
+func (s *FilesystemStore) cleanupDue() bool {
+	now := clock(s.now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.cleaned) < filesystemCleanupInterval || !s.cleaning.CompareAndSwap(false, true) {
+		return false
+	}
+	s.cleaned = now
+	return true
+}
+
+// Delete removes the session file and expires the session cookie.
+func (s *FilesystemStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	return deleteBackendSession(r.Context(), s, w, session)
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
 func (s *FilesystemStore) MaxAge(age int) {
 	s.Options.MaxAge = age
 
-	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
-		}
+	// Set the maxAge for each codec.
+	setCodecsMaxAge(s.Codecs, age)
+}
+
+// config returns the settings used by the backend helpers.
+func (s *FilesystemStore) config() backendConfig {
+	return backendConfig{
+		codecs:        s.Codecs,
+		options:       s.Options,
+		idGenerator:   s.IDGenerator,
+		fingerprint:   s.Fingerprint,
+		path:          s.PathFromRequest,
+		emitUnchanged: s.EmitUnchanged,
+		observer:      s.Observer,
+		now:           s.now,
 	}
 }
 
 // save writes encoded session.Values to a file.
-func (s *FilesystemStore) save(session *Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
+//
+// The store directory is created if it doesn't exist yet.
+func (s *FilesystemStore) save(ctx context.Context, session *Session) error {
+	encoded, err := encodeValues(session, s.Serializer, s.Codecs)
 	if err != nil {
 		return err
 	}
+	session.size = len(encoded)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	filename := filepath.Join(s.path, "session_"+session.ID)
 	fileMutex.Lock()
 	defer fileMutex.Unlock()
-	return ioutil.WriteFile(filename, []byte(encoded), 0600)
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return unavailable(err)
+	}
+	return unavailable(ioutil.WriteFile(filename, []byte(encoded), 0600))
 }
 
 // load reads a file and decodes its content into session.Values.
-func (s *FilesystemStore) load(session *Session) error {
+//
+// It returns false if the file doesn't exist.
+func (s *FilesystemStore) load(ctx context.Context, session *Session) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	filename := filepath.Join(s.path, "session_"+session.ID)
 	fileMutex.RLock()
 	defer fileMutex.RUnlock()
 	fdata, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+	if os.IsNotExist(err) {
+		return false, nil
 	}
-	if err = securecookie.DecodeMulti(session.Name(), string(fdata),
-		&session.Values, s.Codecs...); err != nil {
-		return err
+	if err != nil {
+		return false, unavailable(err)
 	}
-	return nil
+	session.size = len(fdata)
+	return true, decodeValues(session.Name(), string(fdata), session,
+		s.Serializer, s.Codecs)
 }
 
 // delete session file
-func (s *FilesystemStore) erase(session *Session) error {
+func (s *FilesystemStore) erase(ctx context.Context, session *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	filename := filepath.Join(s.path, "session_"+session.ID)
 
 	fileMutex.RLock()
 	defer fileMutex.RUnlock()
 
-	err := os.Remove(filename)
-	return err
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return unavailable(err)
+	}
+	return nil
+}
+
+// Cleanup deletes session files older than the store MaxAge, based on
+// their modification time, which Save refreshes.
+//
+// It is safe to call while sessions are being saved: the files are locked
+// one at a time, and a file saved since the scan started is kept. Files
+// that can't be stat'ed are skipped; errors removing files are collected in
+// a MultiError. Save runs it too, in the background and at most once per
+// minute, so calling it is only needed to reclaim space of a store that
+// receives few requests, see StartGC.
+func (s *FilesystemStore) Cleanup() error {
+	if s.Options.MaxAge <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.path, "session_*"))
+	if err != nil {
+		return err
+	}
+	deadline := clock(s.now).Add(-time.Duration(s.Options.MaxAge) * time.Second)
+
+	var errs MultiError
+	for _, filename := range files {
+		if err := removeStale(filename, deadline); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// removeStale removes a session file not modified since deadline. It takes
+// fileMutex for the file only, so saves aren't held up by a whole cleanup.
+func removeStale(filename string, deadline time.Time) error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	fi, err := os.Stat(filename)
+	if err != nil || !fi.ModTime().Before(deadline) {
+		return nil
+	}
+	if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// StartGC runs Cleanup every interval in a new goroutine until the
+// returned function is called. Cleanup errors are ignored and retried on
+// the next run.
+func (s *FilesystemStore) StartGC(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Cleanup()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
 }
@@ -2,9 +2,19 @@ package sessions
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
 )
 
 // Test for GH-8 for CookieStore
@@ -127,3 +137,1115 @@ func TestGH8FilesystemStoreDelete2(t *testing.T) {
 		t.Fatal("failed to delete session", err)
 	}
 }
+
+func TestFilesystemStoreCreatesPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nested", "store")
+	store := NewFilesystemStore(path, []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("store path was not created", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		t.Fatalf("bad store path permissions: got %o, want %o", perm, 0700)
+	}
+}
+
+func TestFilesystemStoreMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err = os.Remove(filepath.Join(dir, "session_"+session.ID)); err != nil {
+		t.Fatal("failed to remove session file", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("expected a fresh session, got error", err)
+	}
+	if !session.IsNew || session.ID != "" || len(session.Values) != 0 {
+		t.Fatalf("expected a fresh session, got %#v", session)
+	}
+}
+
+func TestFilesystemStorePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	stale := filepath.Join(dir, "session_STALE")
+	if err = ioutil.WriteFile(stale, []byte("x"), 0600); err != nil {
+		t.Fatal("failed to write stale file", err)
+	}
+	old := time.Now().Add(-2 * time.Duration(store.Options.MaxAge) * time.Second)
+	if err = os.Chtimes(stale, old, old); err != nil {
+		t.Fatal("failed to age stale file", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	if !waitRemoved(stale) {
+		t.Fatal("expected stale session file to be pruned")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "session_"+session.ID)); err != nil {
+		t.Fatal("expected fresh session file to be kept", err)
+	}
+}
+
+func TestFilesystemStoreCleanup(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFilesystemStore(dir, []byte("some key"))
+	old := time.Now().Add(-2 * time.Duration(store.Options.MaxAge) * time.Second)
+	stale := filepath.Join(dir, "session_STALE")
+	fresh := filepath.Join(dir, "session_FRESH")
+	for _, filename := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(filename, []byte("x"), 0600); err != nil {
+			t.Fatal("failed to write session file", err)
+		}
+	}
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal("failed to age stale file", err)
+	}
+
+	if err := store.Cleanup(); err != nil {
+		t.Fatal("failed to clean up", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expected stale session file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("expected fresh session file to be kept", err)
+	}
+
+	if err := os.Chtimes(fresh, old, old); err != nil {
+		t.Fatal("failed to age fresh file", err)
+	}
+	stop := store.StartGC(10 * time.Millisecond)
+	defer stop()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(fresh); os.IsNotExist(err) {
+			stop()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected StartGC to remove the stale file")
+}
+
+func TestFilesystemStoreCleanupInterval(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFilesystemStore(dir, []byte("some key"))
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	old := now.Add(-2 * time.Duration(store.Options.MaxAge) * time.Second)
+	stale := func(name string) string {
+		filename := filepath.Join(dir, "session_"+name)
+		if err := ioutil.WriteFile(filename, []byte("x"), 0600); err != nil {
+			t.Fatal("failed to write stale file", err)
+		}
+		if err := os.Chtimes(filename, old, old); err != nil {
+			t.Fatal("failed to age stale file", err)
+		}
+		return filename
+	}
+	save := func() {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	first := stale("FIRST")
+	save()
+	if !waitRemoved(first) {
+		t.Fatal("expected the first Save to remove the stale file")
+	}
+	// Save cleans up at most once per filesystemCleanupInterval.
+	second := stale("SECOND")
+	save()
+	if _, err := os.Stat(second); err != nil {
+		t.Fatal("expected the stale file to be kept until the interval elapses", err)
+	}
+	now = now.Add(filesystemCleanupInterval)
+	for store.cleaning.Load() {
+		// Save doesn't start a cleanup while one is running.
+		time.Sleep(time.Millisecond)
+	}
+	save()
+	if !waitRemoved(second) {
+		t.Fatal("expected Save to remove the stale file after the interval")
+	}
+}
+
+// waitRemoved waits for a cleanup running in the background to remove
+// filename, and reports whether it did.
+func waitRemoved(filename string) bool {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCookieStoreOptions(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Options = &Options{
+		Path:     "/foo",
+		Domain:   "example.com",
+		MaxAge:   3600,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	cookie := w.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Path=/foo", "Domain=example.com",
+		"Max-Age=3600", "Secure", "HttpOnly", "SameSite=Strict"} {
+		if !strings.Contains(cookie, attr) {
+			t.Errorf("expected %q in cookie %q", attr, cookie)
+		}
+	}
+}
+
+func TestCookieStoreBadSignature(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	other := NewCookieStore([]byte("other key"))
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = other.New(req, "hello")
+	if err == nil {
+		t.Fatal("expected a decode error, got nil")
+	}
+	if session == nil || !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("expected a fresh session, got %#v", session)
+	}
+}
+
+func TestCookieStoreSigningOnly(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The value is date|value|mac, with the value readable once decoded.
+	raw, err := base64.URLEncoding.DecodeString(w.Result().Cookies()[0].Value)
+	if err != nil {
+		t.Fatal("failed to decode cookie", err)
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		t.Fatalf("unexpected cookie format %q", raw)
+	}
+	value, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil || !strings.Contains(string(value), "bar") {
+		t.Fatalf("expected a readable value, got %q (%v)", value, err)
+	}
+
+	// Changing the value without the key breaks the signature.
+	value = []byte(strings.Replace(string(value), "bar", "baz", 1))
+	parts[1] = base64.URLEncoding.EncodeToString(value)
+	tampered := base64.URLEncoding.EncodeToString([]byte(strings.Join(parts, "|")))
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "hello", Value: tampered})
+	session, err = store.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Fatalf("expected ErrInvalidCookie, got %v", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("expected a fresh session, got %#v", session)
+	}
+}
+
+func TestFilesystemStoreRenew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	oldID, oldCookie := session.ID, w.Header().Get("Set-Cookie")
+
+	session.Renew()
+	w = httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.ID == "" || session.ID == oldID {
+		t.Fatalf("expected a new session ID, got %q", session.ID)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "session_"+oldID)); !os.IsNotExist(err) {
+		t.Fatal("expected old session file to be removed")
+	}
+
+	// The old cookie no longer yields the session data.
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", oldCookie)
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("expected a fresh session for the old ID, got %#v", session)
+	}
+
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load renewed session", err)
+	}
+	if session.Values["foo"] != "bar" {
+		t.Fatalf("expected values to survive renewal, got %v", session.Values)
+	}
+}
+
+func TestIsNewResetOnSave(t *testing.T) {
+	stores := map[string]Store{
+		"cookie":     NewCookieStore([]byte("some key")),
+		"filesystem": NewFilesystemStore("", []byte("some key")),
+	}
+	for kind, store := range stores {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+
+		session, err := store.Get(req, "hello")
+		if err != nil {
+			t.Fatalf("%s: failed to get session: %v", kind, err)
+		}
+		if !session.IsNew {
+			t.Fatalf("%s: expected a new session before Save", kind)
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatalf("%s: failed to save session: %v", kind, err)
+		}
+		if session.IsNew {
+			t.Errorf("%s: expected IsNew to be false after Save", kind)
+		}
+
+		again, err := store.Get(req, "hello")
+		if err != nil {
+			t.Fatalf("%s: failed to get session: %v", kind, err)
+		}
+		if again != session || again.IsNew {
+			t.Errorf("%s: expected the saved session from the registry", kind)
+		}
+	}
+}
+
+func TestCookieStoreMaxLength(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	for i := 0; i < 200; i++ {
+		session.Values[strconv.Itoa(i)] = strings.Repeat("x", 20)
+	}
+	err = session.Save(req, w)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), `"hello"`) || !strings.Contains(err.Error(), "maximum of 4096") {
+		t.Errorf("expected a descriptive error, got %q", err)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie, got %q", c)
+	}
+
+	store.MaxLength(0)
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save without a limit:", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldStore := NewCookieStore([]byte("old key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := oldStore.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// The rotated store still reads the old cookie and re-signs it.
+	rotated := NewCookieStore([]byte("new key"), nil, []byte("old key"), nil)
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = rotated.New(req, "hello"); err != nil {
+		t.Fatal("failed to decode with an old key", err)
+	}
+	w = httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	newStore := NewCookieStore([]byte("new key"))
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if session, err = newStore.New(req, "hello"); err != nil {
+		t.Fatal("expected the session to be re-signed with the new key:", err)
+	}
+	if session.Values["foo"] != "bar" {
+		t.Errorf("bad values after rotation: %v", session.Values)
+	}
+}
+
+func TestNoKeys(t *testing.T) {
+	stores := map[string]Store{
+		"cookie":     NewCookieStore(),
+		"filesystem": NewFilesystemStore(""),
+	}
+	for kind, store := range stores {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatalf("%s: failed to create session: %v", kind, err)
+		}
+		if err = session.Save(req, httptest.NewRecorder()); err != ErrNoKeys {
+			t.Errorf("%s: expected ErrNoKeys, got %v", kind, err)
+		}
+	}
+}
+
+func TestNewCheckedCookieStore(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	tests := []struct {
+		pairs   [][]byte
+		wantErr bool
+	}{
+		{nil, true},
+		{[][]byte{nil}, true},
+		{[][]byte{{}, key}, true},
+		{[][]byte{key, []byte("short")}, true},
+		{[][]byte{key, key, nil}, true},
+		{[][]byte{key}, false},
+		{[][]byte{key, nil}, false},
+		{[][]byte{key, key, key}, false},
+	}
+	for i, test := range tests {
+		store, err := NewCheckedCookieStore(test.pairs...)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%d: expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: failed to create store: %v", i, err)
+		} else if len(store.Codecs) == 0 {
+			t.Errorf("%d: expected codecs, got none", i)
+		}
+	}
+	if _, err := NewCheckedCookieStore(); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys, got %v", err)
+	}
+}
+
+func TestSameSiteModes(t *testing.T) {
+	tests := []struct {
+		mode       http.SameSite
+		secure     bool
+		autoSecure bool
+		want       string
+		wantErr    bool
+	}{
+		{http.SameSiteDefaultMode, false, false, "", false},
+		{http.SameSiteLaxMode, false, false, "SameSite=Lax", false},
+		{http.SameSiteStrictMode, false, false, "SameSite=Strict", false},
+		{http.SameSiteNoneMode, false, false, "", true},
+		{http.SameSiteNoneMode, true, false, "SameSite=None", false},
+		{http.SameSiteNoneMode, false, true, "SameSite=None", false},
+	}
+	store := NewCookieStore([]byte("some key"))
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+		w := httptest.NewRecorder()
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Options.SameSite = test.mode
+		session.Options.Secure = test.secure
+		session.Options.AutoSecure = test.autoSecure
+
+		err = session.Save(req, w)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("mode %v: expected an error, got nil", test.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("mode %v: failed to save session: %v", test.mode, err)
+		}
+		cookie := w.Header().Get("Set-Cookie")
+		if test.want != "" && !strings.Contains(cookie, "; "+test.want) {
+			t.Errorf("mode %v: expected %q in %q", test.mode, test.want, cookie)
+		}
+		if test.want == "" && strings.Contains(cookie, "SameSite") {
+			t.Errorf("mode %v: expected no SameSite in %q", test.mode, cookie)
+		}
+		if test.mode == http.SameSiteNoneMode && !strings.Contains(cookie, "; Secure") {
+			t.Errorf("mode %v: expected Secure in %q", test.mode, cookie)
+		}
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	tests := []struct {
+		partitioned bool
+		secure      bool
+		autoSecure  bool
+		wantErr     bool
+	}{
+		{false, false, false, false},
+		{true, false, false, true},
+		{true, true, false, false},
+		{true, false, true, false},
+	}
+	store := NewCookieStore([]byte("some key"))
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		w := httptest.NewRecorder()
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Options.Partitioned = test.partitioned
+		session.Options.Secure = test.secure
+		session.Options.AutoSecure = test.autoSecure
+
+		err = session.Save(req, w)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got nil", test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: failed to save session: %v", test, err)
+		}
+		cookie := w.Header().Get("Set-Cookie")
+		if got := strings.Contains(cookie, "; Partitioned"); got != test.partitioned {
+			t.Errorf("%+v: unexpected Partitioned attribute in %q", test, cookie)
+		}
+		if test.partitioned && !strings.Contains(cookie, "; Secure") {
+			t.Errorf("%+v: expected Secure in %q", test, cookie)
+		}
+	}
+}
+
+func TestPathFromRequest(t *testing.T) {
+	tenant := func(r *http.Request) string {
+		if parts := strings.SplitN(r.URL.Path, "/", 3); len(parts) > 2 {
+			return "/" + parts[1]
+		}
+		return ""
+	}
+	cookies := NewCookieStore([]byte("some key"))
+	cookies.PathFromRequest = tenant
+	redis := NewRedisStore(newFakeRedis().pool, "", []byte("some key"))
+	redis.PathFromRequest = tenant
+	for _, store := range []Store{cookies, redis} {
+		for url, want := range map[string]string{
+			"http://www.example.com/tenant-a/page": "/tenant-a",
+			"http://www.example.com/":              "/",
+		} {
+			req, _ := http.NewRequest("GET", url, nil)
+			session, err := store.New(req, "hello")
+			if err != nil {
+				t.Fatal("failed to create session", err)
+			}
+			w := httptest.NewRecorder()
+			if err = session.Save(req, w); err != nil {
+				t.Fatal("failed to save session", err)
+			}
+			if c := w.Result().Cookies(); len(c) != 1 || c[0].Path != want {
+				t.Errorf("%T %s: expected Path %q, got %v", store, url, want, c)
+			}
+		}
+	}
+}
+
+func TestCookieStoreRaisedMaxLength(t *testing.T) {
+	big := base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(3000))
+	for _, max := range []int{8192, 0} {
+		store := NewCookieStore([]byte("some key"))
+		store.MaxLength(max)
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, _ := store.New(req, "hello")
+		session.Values["big"] = big
+		w := httptest.NewRecorder()
+		if err := session.Save(req, w); err != nil {
+			t.Fatalf("MaxLength(%d): failed to save session: %v", max, err)
+		}
+		cookie := w.Result().Cookies()[0]
+		if len(cookie.Value) <= MaxCookieValueLength {
+			t.Fatalf("MaxLength(%d): expected a cookie over %d bytes, got %d", max, MaxCookieValueLength, len(cookie.Value))
+		}
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.AddCookie(cookie)
+		session, err := store.New(req, "hello")
+		if err != nil || session.IsNew || session.Values["big"] != big {
+			t.Errorf("MaxLength(%d): failed to load the saved session: %v", max, err)
+		}
+	}
+}
+
+func TestCookieStoreMaxLengthIncludesName(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+
+	short, err := store.New(req, "a")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	long, err := store.New(req, strings.Repeat("a", 200))
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	w := httptest.NewRecorder()
+	if err = short.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	// Pick a limit the short session fits in but the long one doesn't.
+	size := len(strings.SplitN(w.Header().Get("Set-Cookie"), ";", 2)[0])
+	store.MaxLength(size + 10)
+	if err = short.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err = long.Save(req, httptest.NewRecorder()); err == nil {
+		t.Fatal("expected the name to count towards the limit")
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	redis := newFakeRedis()
+	database, _ := newTestDatabaseStore(t)
+	stores := map[string]Store{
+		"database":   database,
+		"cookie":     NewCookieStore([]byte("some key")),
+		"filesystem": NewFilesystemStore(dir, []byte("some key")),
+		"redis":      NewRedisStore(redis.pool, "", []byte("some key")),
+		"memory":     NewMemoryStore(),
+	}
+	for kind, store := range stores {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+		w := httptest.NewRecorder()
+		session, err := store.New(req, "hello")
+		if err != nil {
+			t.Fatalf("%s: failed to create session: %v", kind, err)
+		}
+		session.Values["foo"] = "bar"
+		if err = session.Save(req, w); err != nil {
+			t.Fatalf("%s: failed to save session: %v", kind, err)
+		}
+		cookie := w.Header().Get("Set-Cookie")
+
+		w = httptest.NewRecorder()
+		if err = store.Delete(req, w, session); err != nil {
+			t.Fatalf("%s: failed to delete session: %v", kind, err)
+		}
+		if c := w.Header().Get("Set-Cookie"); !strings.Contains(c, "Max-Age=0") {
+			t.Errorf("%s: expected an expiring cookie, got %q", kind, c)
+		}
+		if kind == "cookie" {
+			continue
+		}
+
+		// The old cookie no longer finds the server-side data.
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		req.Header.Add("Cookie", cookie)
+		if session, err = store.New(req, "hello"); err != nil {
+			t.Fatalf("%s: failed to create session: %v", kind, err)
+		}
+		if !session.IsNew || len(session.Values) != 0 {
+			t.Errorf("%s: expected the session data to be removed", kind)
+		}
+	}
+}
+
+func TestSkipUnchangedCookies(t *testing.T) {
+	store := NewCookieStore([]byte("some key"))
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+	for _, name := range []string{"one", "two"} {
+		session, err := store.Get(req, name)
+		if err != nil {
+			t.Fatal("failed to get session", err)
+		}
+		session.Values["foo"] = "bar"
+	}
+	if err = Save(req, w); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if cookies := w.Header()["Set-Cookie"]; len(cookies) != 2 {
+		t.Fatalf("expected new sessions to emit cookies, got %v", cookies)
+	}
+
+	next := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		for _, c := range w.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	req = next()
+	one, _ := store.Get(req, "one")
+	store.Get(req, "two")
+	one.Values["foo"] = "baz"
+	rsp := httptest.NewRecorder()
+	if err = Save(req, rsp); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	cookies := rsp.Header()["Set-Cookie"]
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0], "one=") {
+		t.Fatalf("expected only the mutated session to emit a cookie, got %v", cookies)
+	}
+
+	store.EmitUnchanged = true
+	req = next()
+	store.Get(req, "one")
+	store.Get(req, "two")
+	rsp = httptest.NewRecorder()
+	if err = Save(req, rsp); err != nil {
+		t.Fatal("failed to save sessions", err)
+	}
+	if cookies := rsp.Header()["Set-Cookie"]; len(cookies) != 2 {
+		t.Fatalf("expected EmitUnchanged to emit all cookies, got %v", cookies)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	client := newFakeMemcache()
+	store := NewMemcachedStore(client, "app:", []byte("some key"))
+	n := 0
+	store.IDGenerator = func() (string, error) {
+		n++
+		return fmt.Sprintf("id-%d", n), nil
+	}
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if err = session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if _, ok := client.items["app:id-1"]; !ok || session.ID != "id-1" {
+		t.Errorf("expected the session to be stored as id-1, got %q", session.ID)
+	}
+
+	for _, id := range []string{"", "a/b", "a b", "a;b"} {
+		store.IDGenerator = func() (string, error) { return id, nil }
+		session, _ = store.New(req, "hello")
+		if err = session.Save(req, httptest.NewRecorder()); err == nil {
+			t.Errorf("expected an error for the ID %q", id)
+		}
+	}
+}
+
+func TestRandomID(t *testing.T) {
+	id, err := RandomID()
+	if err != nil {
+		t.Fatal("failed to generate an ID", err)
+	}
+	if len(id) != 43 || !validSessionID(id) {
+		t.Errorf("bad random ID %q", id)
+	}
+}
+
+func TestStoreDefaultOptions(t *testing.T) {
+	stores := map[string]Store{
+		"cookie":     NewCookieStore([]byte("some key")),
+		"filesystem": NewFilesystemStore(t.TempDir(), []byte("some key")),
+		"memory":     NewMemoryStore(),
+	}
+	defaults := func(store Store) *Options {
+		switch s := store.(type) {
+		case *CookieStore:
+			return s.Options
+		case *FilesystemStore:
+			return s.Options
+		case *MemoryStore:
+			return s.Options
+		}
+		return nil
+	}
+	for kind, store := range stores {
+		opts := defaults(store)
+		opts.Secure = true
+		opts.HttpOnly = true
+		opts.SameSite = http.SameSiteLaxMode
+
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		first, _ := store.New(req, "first")
+		second, _ := store.New(req, "second")
+		if first.Options == opts || first.Options == second.Options {
+			t.Fatalf("%s: expected each session to get its own Options", kind)
+		}
+		if !first.Options.Secure || !first.Options.HttpOnly || first.Options.SameSite != http.SameSiteLaxMode {
+			t.Errorf("%s: expected the store defaults, got %+v", kind, first.Options)
+		}
+
+		first.Options.Secure = false
+		first.Options.Path = "/first"
+		if !opts.Secure || opts.Path != "/" || !second.Options.Secure || second.Options.Path != "/" {
+			t.Errorf("%s: expected the override to stay local to its session", kind)
+		}
+
+		w := httptest.NewRecorder()
+		if err := first.Save(req, w); err != nil {
+			t.Fatalf("%s: failed to save session: %v", kind, err)
+		}
+		c := w.Result().Cookies()[0]
+		if c.Secure || c.Path != "/first" || !c.HttpOnly {
+			t.Errorf("%s: expected the session override to win, got %+v", kind, c)
+		}
+	}
+}
+
+// downRedis is a RedisConn to a Redis server that is down.
+type downRedis struct{}
+
+func (downRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (downRedis) Close() error { return nil }
+
+func TestErrorClassification(t *testing.T) {
+	cookies := NewCookieStore([]byte("some key"))
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "hello", Value: "tampered"})
+	session, err := cookies.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) || errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected ErrInvalidCookie for a tampered cookie, got %v", err)
+	}
+	if !session.IsNew {
+		t.Error("expected a new session")
+	}
+
+	// A valid cookie referring to a session in a Redis server that is down.
+	healthy := newFakeRedis()
+	store := NewRedisStore(healthy.pool, "", []byte("some key"))
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ = store.New(req, "hello")
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	down := NewRedisStore(func() RedisConn { return downRedis{} }, "", []byte("some key"))
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	if _, err = down.New(req, "hello"); !errors.Is(err, ErrStoreUnavailable) || errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrStoreUnavailable for a failing backend, got %v", err)
+	}
+
+	// Data that can't be deserialized is invalid, too.
+	for key := range healthy.data {
+		healthy.data[key] = []byte("garbage")
+	}
+	if _, err = store.New(req, "hello"); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie for corrupt data, got %v", err)
+	}
+}
+
+func TestCookiePrefixes(t *testing.T) {
+	tests := []struct {
+		name       string
+		secure     bool
+		autoSecure bool
+		domain     string
+		path       string
+		wantErr    bool
+	}{
+		{"__Secure-id", true, false, "example.com", "/app", false},
+		{"__Secure-id", false, false, "", "/", true},
+		{"__Secure-id", false, true, "", "/", false},
+		{"__Host-id", true, false, "", "/", false},
+		{"__Host-id", false, true, "", "/", false},
+		{"__Host-id", false, false, "", "/", true},
+		{"__Host-id", true, false, "example.com", "/", true},
+		{"__Host-id", true, false, "", "/app", true},
+	}
+	store := NewCookieStore([]byte("some key"))
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal("failed to create request", err)
+		}
+		w := httptest.NewRecorder()
+		session, err := store.Get(req, test.name)
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Options.Secure = test.secure
+		session.Options.AutoSecure = test.autoSecure
+		session.Options.Domain = test.domain
+		session.Options.Path = test.path
+
+		err = session.Save(req, w)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got nil", test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: failed to save session: %v", test, err)
+		}
+		cookie := w.Header().Get("Set-Cookie")
+		if !strings.HasPrefix(cookie, test.name+"=") || !strings.Contains(cookie, "; Secure") {
+			t.Errorf("%+v: expected a Secure %s cookie, got %q", test, test.name, cookie)
+		}
+	}
+}
+
+func TestCookieValueValidation(t *testing.T) {
+	redis := newFakeRedis()
+	backend := NewRedisStore(redis.pool, "session:", []byte("some key"))
+	// Without the check the codecs would try to decode any length.
+	setCodecsMaxLength(backend.Codecs, 0)
+	stores := map[string]Store{
+		"cookie": NewCookieStore([]byte("some key")),
+		"redis":  backend,
+		"memory": NewMemoryStore(),
+	}
+	values := map[string]string{
+		"oversized": strings.Repeat("A", 10<<20),
+		"charset":   "abc$def",
+	}
+	for storeName, store := range stores {
+		for valueName, value := range values {
+			req, err := http.NewRequest("GET", "http://www.example.com", nil)
+			if err != nil {
+				t.Fatal("failed to create request", err)
+			}
+			req.AddCookie(&http.Cookie{Name: "hello", Value: value})
+			start := time.Now()
+			session, err := store.New(req, "hello")
+			if !errors.Is(err, ErrInvalidCookie) {
+				t.Errorf("%s/%s: expected ErrInvalidCookie, got %v", storeName, valueName, err)
+			}
+			if !session.IsNew {
+				t.Errorf("%s/%s: expected a new session", storeName, valueName)
+			}
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("%s/%s: rejecting the value took %v", storeName, valueName, d)
+			}
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	valid := func(store *CookieStore) string {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, _ := store.New(req, "hello")
+		session.Values["foo"] = "bar"
+		w := httptest.NewRecorder()
+		if err := session.Save(req, w); err != nil {
+			f.Fatal("failed to save session", err)
+		}
+		return w.Result().Cookies()[0].Value
+	}
+	signed := NewCookieStore([]byte("some key"))
+	encrypted := NewCookieStore([]byte("some key"), []byte("0123456789abcdef"))
+	serialized := NewCookieStore([]byte("some key"))
+	serialized.Serializer = CompressionSerializer{Serializer: MsgpackSerializer{}}
+	jwt := NewJWTStore([]byte("some key"))
+	jwt.EncryptionKey = []byte("0123456789abcdef")
+
+	for _, seed := range []string{
+		"",
+		valid(signed),
+		valid(encrypted),
+		valid(serialized),
+		valid(signed)[:20],
+		"|||",
+		base64.URLEncoding.EncodeToString([]byte("1|2|3")),
+		base64.URLEncoding.EncodeToString([]byte("1|" + strings.Repeat("A", 100) + "|")),
+		"eyJhbGciOiJub25lIn0.e30.",
+		"....",
+		strings.Repeat("=", 64),
+		// Nested msgpack arrays, a huge gob length and a truncated
+		// deflate stream.
+		strings.Repeat("\x91", 1000),
+		"\xff\xff\xff\xff\xff\xff\xff\xff\x00",
+		"\x01\xec\xc0",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		for _, store := range []Store{signed, encrypted, serialized, jwt} {
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			req.Header.Set("Cookie", "hello="+value)
+			session, err := store.New(req, "hello")
+			if session == nil {
+				t.Fatalf("%T returned a nil session for %q", store, value)
+			}
+			if err != nil && (!session.IsNew || len(session.Values) != 0) {
+				t.Fatalf("%T returned a partial session with %v for %q", store, err, value)
+			}
+		}
+		// The serializers only see authenticated data, but must not
+		// panic even if a key leaked.
+		for _, serializer := range []Serializer{
+			GobSerializer{}, JSONSerializer{}, MsgpackSerializer{},
+			CompressionSerializer{Serializer: GobSerializer{}},
+		} {
+			serializer.Deserialize([]byte(value), NewSession(nil, "hello"))
+		}
+	})
+}
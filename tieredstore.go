@@ -0,0 +1,150 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// NewTieredStore returns a TieredStore reading from primary first, then
+// from secondary.
+func NewTieredStore(primary, secondary Store) *TieredStore {
+	return &TieredStore{Primary: primary, Secondary: secondary}
+}
+
+// TieredStore keeps sessions in two server-side stores: a fast Primary,
+// e.g. a MemcachedStore or RedisStore, in front of a durable Secondary,
+// e.g. a DatabaseStore.
+//
+// New reads the primary first. On a miss, or if the primary fails, the
+// session is read from the secondary and copied to the primary. Save writes
+// the secondary, which sets the cookie, then the primary; only errors of
+// the secondary fail the Save. Delete removes the session from both.
+//
+// The stores are not updated atomically:
+//   - a primary write that fails after the secondary was written drops the
+//     session from the primary, but if that fails too the primary serves
+//     the previous values until they expire;
+//   - a request reading the secondary while another one saves can copy the
+//     old values to the primary after the save;
+//   - sessions written to the secondary by other means are only seen once
+//     they drop out of the primary.
+//
+// Set PrimaryTTL to bound how long such stale copies live.
+//
+// Both stores must be stores of this package keeping sessions under an ID,
+// like RedisStore or DatabaseStore, and share their codecs.
+type TieredStore struct {
+	Primary   Store
+	Secondary Store
+	// PrimaryTTL limits the lifetime, in seconds, of the sessions kept by
+	// the primary. When 0 they live as long as in the secondary.
+	PrimaryTTL int
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *TieredStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns the session of the primary, or that of the secondary if the
+// primary has none, copying it to the primary.
+//
+// See CookieStore.New().
+func (s *TieredStore) New(r *http.Request, name string) (*Session, error) {
+	primary, err := s.primary()
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.Primary.New(r, name)
+	if err == nil && !session.IsNew {
+		session.store = s
+		return session, nil
+	}
+	session, err = s.Secondary.New(r, name)
+	if session == nil {
+		return nil, err
+	}
+	session.store = s
+	if err == nil && !session.IsNew && session.ID != "" {
+		// The primary is only a copy, failing to fill it is not an error.
+		_ = s.savePrimary(r.Context(), primary, session)
+	}
+	return session, err
+}
+
+// Save saves the session to the secondary, then to the primary.
+//
+// If the Options.MaxAge of the session is < 0, or 0 without a StoreTTL, the
+// session is deleted from both stores.
+func (s *TieredStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	primary, err := s.primary()
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if session.ID != "" && (session.renew || session.Options.deletesRecord(false)) {
+		// The session leaves its current ID, drop the copy kept under it.
+		if err := primary.erase(ctx, session); err != nil {
+			return err
+		}
+	}
+	if err := s.Secondary.Save(r, w, session); err != nil {
+		return err
+	}
+	if session.ID == "" {
+		return nil
+	}
+	if err := s.savePrimary(ctx, primary, session); err != nil {
+		// Don't serve the previous values from the primary.
+		_ = primary.erase(ctx, session)
+	}
+	return nil
+}
+
+// Delete removes the session from both stores and expires the session
+// cookie.
+//
+// The session is deleted from the secondary even if the primary fails, and
+// the error of the secondary is returned first.
+func (s *TieredStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	primary, err := s.primary()
+	if err != nil {
+		return err
+	}
+	errPrimary := primary.erase(r.Context(), session)
+	if err := s.Secondary.Delete(r, w, session); err != nil {
+		return err
+	}
+	return errPrimary
+}
+
+// primary returns the backend of the primary store.
+func (s *TieredStore) primary() (backend, error) {
+	b, ok := s.Primary.(backend)
+	if !ok {
+		return nil, fmt.Errorf("sessions: unsupported TieredStore primary %T", s.Primary)
+	}
+	return b, nil
+}
+
+// savePrimary copies the session to the primary, under its ID and with a
+// lifetime of at most PrimaryTTL.
+func (s *TieredStore) savePrimary(ctx context.Context, primary backend,
+	session *Session) error {
+	opts := session.Options
+	if ttl := opts.storeTTL(); s.PrimaryTTL > 0 && (ttl <= 0 || s.PrimaryTTL < ttl) {
+		session.Options = opts.Clone()
+		session.Options.StoreTTL = s.PrimaryTTL
+		defer func() { session.Options = opts }()
+	}
+	return primary.save(ctx, session)
+}
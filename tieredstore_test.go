@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTieredStore(t *testing.T) {
+	cache, durable := newFakeRedis(), newFakeRedis()
+	primary := NewRedisStore(cache.pool, "", []byte("some key"))
+	secondary := NewRedisStore(durable.pool, "", []byte("some key"))
+	store := NewTieredStore(primary, secondary)
+
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	if err = session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	key := "session:" + session.ID
+	if len(cache.data[key]) == 0 || len(durable.data[key]) == 0 {
+		t.Fatal("expected the session in both stores")
+	}
+
+	// A primary miss reads the secondary and fills the primary.
+	delete(cache.data, key)
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if err != nil || session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("failed to read through to the secondary: %v %#v", err, session)
+	}
+	if session.store != store {
+		t.Error("expected the session to belong to the tiered store")
+	}
+	if !bytes.Equal(cache.data[key], durable.data[key]) {
+		t.Error("expected the primary to be filled from the secondary")
+	}
+
+	// The primary is read first.
+	delete(durable.data, key)
+	session, err = store.New(req, "hello")
+	if err != nil || session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("failed to read the primary: %v %#v", err, session)
+	}
+
+	if err = store.Delete(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, ok := cache.data[key]; ok {
+		t.Error("expected the session to be removed from the primary")
+	}
+}
+
+func TestTieredStorePrimaryTTL(t *testing.T) {
+	cache, durable := newFakeRedis(), newFakeRedis()
+	store := NewTieredStore(NewRedisStore(cache.pool, "", []byte("some key")),
+		NewRedisStore(durable.pool, "", []byte("some key")))
+	store.PrimaryTTL = 60
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	session, _ := store.New(req, "hello")
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	key := "session:" + session.ID
+	if cache.ttl[key] != 60 || durable.ttl[key] != 86400*30 {
+		t.Errorf("unexpected TTLs %d and %d", cache.ttl[key], durable.ttl[key])
+	}
+	if session.Options.StoreTTL != 0 {
+		t.Error("expected the session options to be left unchanged")
+	}
+}
+
+func TestTieredStoreUnsupportedPrimary(t *testing.T) {
+	store := NewTieredStore(NewCookieStore([]byte("some key")), NewMemoryStore())
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	if _, err := store.New(req, "hello"); err == nil {
+		t.Error("expected an error for a cookie store primary")
+	}
+}